@@ -13,28 +13,62 @@ import (
 
 // Alias holds all attributes required to start a ssh port forwarding tunnel.
 type Alias struct {
-	Name              string   `toml:"name"`
-	TunnelType        string   `toml:"type"`
-	Verbose           bool     `toml:"verbose"`
-	Insecure          bool     `toml:"insecure"`
-	Detach            bool     `toml:"detach"`
-	Source            []string `toml:"source"`
-	Destination       []string `toml:"destination"`
-	Server            string   `toml:"server"`
-	Key               string   `toml:"key"`
-	KeepAliveInterval string   `toml:"keep-alive-interval"`
-	ConnectionRetries int      `toml:"connection-retries"`
-	WaitAndRetry      string   `toml:"wait-and-retry"`
-	SshAgent          string   `toml:"ssh-agent"`
-	Timeout           string   `toml:"timeout"`
-	SshConfig         string   `toml:"config"`
-	Rpc               bool     `toml:"rpc"`
-	RpcAddress        string   `toml:"rpc-address"`
+	Name                string   `toml:"name"`
+	TunnelType          string   `toml:"type"`
+	Verbose             bool     `toml:"verbose"`
+	Insecure            bool     `toml:"insecure"`
+	Detach              bool     `toml:"detach"`
+	Source              []string `toml:"source"`
+	Destination         []string `toml:"destination"`
+	Server              string   `toml:"server"`
+	Key                 string   `toml:"key"`
+	KeepAliveInterval   string   `toml:"keep-alive-interval"`
+	ConnectionRetries   int      `toml:"connection-retries"`
+	WaitAndRetry        string   `toml:"wait-and-retry"`
+	SshAgent            string   `toml:"ssh-agent"`
+	Timeout             string   `toml:"timeout"`
+	SshConfig           string   `toml:"config"`
+	Rpc                 bool     `toml:"rpc"`
+	RpcAddress          string   `toml:"rpc-address"`
+	Http                bool     `toml:"http"`
+	HttpAddress         string   `toml:"http-address"`
+	Lazy                bool     `toml:"lazy"`
+	IdleDisconnect      string   `toml:"idle-disconnect"`
+	IdleTimeout         []string `toml:"idle-timeout"`
+	MaxLifetime         []string `toml:"max-lifetime"`
+	MaxConnections      []int    `toml:"max-connections"`
+	MaxTotalConnections int      `toml:"max-total-connections"`
+	ConnectionPolicy    string   `toml:"connection-policy"`
+	Allow               []string `toml:"allow"`
+	Deny                []string `toml:"deny"`
+	DialTimeout         string   `toml:"dial-timeout"`
+	UploadLimit         []string `toml:"upload-limit"`
+	DownloadLimit       []string `toml:"download-limit"`
+	TotalUploadLimit    string   `toml:"total-upload-limit"`
+	TotalDownloadLimit  string   `toml:"total-download-limit"`
+	Capture             []string `toml:"capture"`
+	CaptureMaxSize      string   `toml:"capture-max-size"`
+	CaptureMaxTotalSize string   `toml:"capture-max-total-size"`
+	SourceTlsCert       []string `toml:"source-tls-cert"`
+	SourceTlsKey        []string `toml:"source-tls-key"`
+	DestinationTls      []bool   `toml:"destination-tls"`
+	DestinationTlsName  []string `toml:"destination-tls-server-name"`
+	DestinationTlsCa    []string `toml:"destination-tls-ca"`
+	ProxyProtocol       []string `toml:"proxy-protocol"`
+	UdpSource           []string `toml:"udp-source"`
+	UdpDestination      []string `toml:"udp-destination"`
+	UdpRelay            string   `toml:"udp-relay"`
+	UdpTimeout          string   `toml:"udp-timeout"`
+	HttpProxy           []string `toml:"http-proxy"`
+	HttpProxyAllow      []string `toml:"http-proxy-allow"`
+	Backends            []string `toml:"backends"`
+	LoadBalance         []string `toml:"load-balance"`
+	HealthCheckInterval string   `toml:"health-check-interval"`
 }
 
 // String parses a Alias object to a string representation.
 func (a Alias) String() string {
-	return fmt.Sprintf("[verbose: %t, insecure: %t, detach: %t, source: %s, destination: %s, server: %s, key: %s, keep-alive-interval: %s, connection-retries: %d, wait-and-retry: %s, ssh-agent: %s, timeout: %s, config: %s, rpc: %t, rpc-address: %s]",
+	return fmt.Sprintf("[verbose: %t, insecure: %t, detach: %t, source: %s, destination: %s, server: %s, key: %s, keep-alive-interval: %s, connection-retries: %d, wait-and-retry: %s, ssh-agent: %s, timeout: %s, config: %s, rpc: %t, rpc-address: %s, http: %t, http-address: %s, lazy: %t, idle-disconnect: %s, idle-timeout: %s, max-lifetime: %s, max-connections: %v, max-total-connections: %d, connection-policy: %s, allow: %s, deny: %s, dial-timeout: %s, upload-limit: %s, download-limit: %s, total-upload-limit: %s, total-download-limit: %s, capture: %s, capture-max-size: %s, capture-max-total-size: %s, source-tls-cert: %s, source-tls-key: %s, destination-tls: %v, destination-tls-server-name: %s, destination-tls-ca: %s, proxy-protocol: %s, udp-source: %s, udp-destination: %s, udp-relay: %s, udp-timeout: %s, http-proxy: %s, http-proxy-allow: %s, backends: %s, load-balance: %s, health-check-interval: %s]",
 		a.Verbose,
 		a.Insecure,
 		a.Detach,
@@ -50,6 +84,40 @@ func (a Alias) String() string {
 		a.SshConfig,
 		a.Rpc,
 		a.RpcAddress,
+		a.Http,
+		a.HttpAddress,
+		a.Lazy,
+		a.IdleDisconnect,
+		a.IdleTimeout,
+		a.MaxLifetime,
+		a.MaxConnections,
+		a.MaxTotalConnections,
+		a.ConnectionPolicy,
+		a.Allow,
+		a.Deny,
+		a.DialTimeout,
+		a.UploadLimit,
+		a.DownloadLimit,
+		a.TotalUploadLimit,
+		a.TotalDownloadLimit,
+		a.Capture,
+		a.CaptureMaxSize,
+		a.CaptureMaxTotalSize,
+		a.SourceTlsCert,
+		a.SourceTlsKey,
+		a.DestinationTls,
+		a.DestinationTlsName,
+		a.DestinationTlsCa,
+		a.ProxyProtocol,
+		a.UdpSource,
+		a.UdpDestination,
+		a.UdpRelay,
+		a.UdpTimeout,
+		a.HttpProxy,
+		a.HttpProxyAllow,
+		a.Backends,
+		a.LoadBalance,
+		a.HealthCheckInterval,
 	)
 }
 
@@ -106,14 +174,20 @@ func Show(aliasName string) (string, error) {
 		return "", fmt.Errorf("could not show alias %s configuration: %v", aliasName, err)
 	}
 
-	var aliases bytes.Buffer
-	e := toml.NewEncoder(&aliases)
+	return a.ToToml()
+}
+
+// ToToml returns the TOML representation of an alias, exactly as it is
+// persisted on its configuration file.
+func (a Alias) ToToml() (string, error) {
+	var buf bytes.Buffer
+	e := toml.NewEncoder(&buf)
 
-	if err = e.Encode(a); err != nil {
+	if err := e.Encode(a); err != nil {
 		return "", err
 	}
 
-	return aliases.String(), nil
+	return buf.String(), nil
 }
 
 // ShowAll displays the configuration parameters for all persisted aliases.
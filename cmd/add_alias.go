@@ -1,9 +1,23 @@
 package cmd
 
 import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/davrodpin/mole/alias"
+	"github.com/davrodpin/mole/mole"
+
+	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
+var (
+	fromSSHConfig string
+	dryRun        bool
+	sshConfigPath string
+)
+
 var addAliasCmd = &cobra.Command{
 	Use:   "alias local [name]",
 	Short: "Adds an alias for a ssh tunneling configuration",
@@ -12,12 +26,81 @@ command flags so it can be reused later.
 
 The alias configuration file is saved under the ".mole" directory, inside the
 user home directory.
+
+Aliases can also be created from the hosts declared on a ssh config file by
+using the --from-ssh-config flag, which accepts either a host name or a
+pattern (e.g. "db-*"). Every LocalForward and RemoteForward line of a host
+becomes a channel of its alias, along with its user, port, identity file and
+identity agent. Use --dry-run to display the aliases instead of saving them.
 	`,
+	Example: `mole add alias --from-ssh-config example
+mole add alias --from-ssh-config 'db-*' --dry-run`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if fromSSHConfig != "" {
+			return nil
+		}
+
+		if len(args) < 1 {
+			return errors.New("alias name not provided")
+		}
+
+		return nil
+	},
+	Run: func(cmd *cobra.Command, arg []string) {
+		if fromSSHConfig == "" {
+			return
+		}
+
+		defaults := mole.Configuration{
+			KeepAliveInterval: defaultKeepAliveInterval,
+			ConnectionRetries: defaultConnectionRetries,
+			WaitAndRetry:      defaultWaitAndRetry,
+			Timeout:           defaultTimeout,
+			RpcAddress:        defaultListenAddress,
+			HttpAddress:       defaultListenAddress,
+		}
 
-	Args: cobra.MinimumNArgs(1),
-	Run:  func(cmd *cobra.Command, arg []string) {},
+		aliases, err := mole.AliasesFromSSHConfig(sshConfigPath, fromSSHConfig, defaults)
+		if err != nil {
+			log.WithError(err).Error("failed to read aliases from ssh config file")
+			os.Exit(1)
+		}
+
+		if len(aliases) == 0 {
+			log.WithFields(log.Fields{
+				"host": fromSSHConfig,
+			}).Error("no ssh config host with forwarding configuration found")
+			os.Exit(1)
+		}
+
+		for _, al := range aliases {
+			if dryRun {
+				t, err := al.ToToml()
+				if err != nil {
+					log.WithError(err).Error("failed to display tunnel alias")
+					os.Exit(1)
+				}
+
+				fmt.Printf("# %s\n%s\n", al.Name, t)
+
+				continue
+			}
+
+			if err := alias.Add(al); err != nil {
+				log.WithError(err).Errorf("failed to add tunnel alias %s", al.Name)
+				os.Exit(1)
+			}
+
+			log.Infof("alias %s added", al.Name)
+		}
+	},
 }
 
 func init() {
+	addAliasCmd.Flags().StringVarP(&fromSSHConfig, "from-ssh-config", "", "", "create aliases from the ssh config hosts matching the given host name or pattern")
+	addAliasCmd.Flags().BoolVarP(&dryRun, "dry-run", "", false, "display the aliases created from the ssh config file instead of saving them")
+	addAliasCmd.Flags().StringVarP(&sshConfigPath, "config", "c", defaultSshConfig, `set config file path
+commands of "Match exec" blocks run once per lookup of a host and must exit within 5s to match`)
+
 	addCmd.AddCommand(addAliasCmd)
 }
@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"os"
+	"time"
+
+	"github.com/davrodpin/mole/mole"
+	"github.com/davrodpin/mole/tunnel"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	agentAddress string
+	agentTimeout time.Duration
+
+	agentCmd = &cobra.Command{
+		Use:   "agent",
+		Short: "Relays udp datagrams sent through the udp channels of other mole instances",
+		Long: `Relays udp datagrams sent through the udp channels of other mole instances.
+
+ssh servers only forward TCP connections, so udp channels send their datagrams
+over a TCP connection to a mole agent, which must run on a host that can reach
+the udp destinations, usually the ssh server itself. The agent address, as seen
+by the ssh server, is given to the instances with --udp-relay.
+
+The agent should listen on an address that is only reachable by the ssh server,
+like the loopback interface, since it relays datagrams to any destination.`,
+		Example: `mole agent --address 127.0.0.1:7000
+mole start local --udp-source :5353 --udp-destination 10.0.0.2:53 --udp-relay 127.0.0.1:7000 --server example`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, arg []string) {
+			err := mole.RunAgent(agentAddress, agentTimeout)
+			if err != nil {
+				log.WithError(err).WithFields(log.Fields{
+					"address": agentAddress,
+				}).Error("mole agent stopped with an error")
+				os.Exit(1)
+			}
+		},
+	}
+)
+
+func init() {
+	agentCmd.Flags().StringVarP(&agentAddress, "address", "a", "127.0.0.1:7000", "address the agent listens on for udp channels")
+	agentCmd.Flags().DurationVarP(&agentTimeout, "udp-timeout", "", tunnel.DefaultUDPTimeout, "time a udp session is kept open without any datagram going through it")
+
+	rootCmd.AddCommand(agentCmd)
+}
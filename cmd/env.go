@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/davrodpin/mole/mole"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	envCmd = &cobra.Command{
+		Use:   "env [alias name or id]",
+		Short: "Prints shell export statements describing an instance of mole",
+		Long: `Prints shell export statements describing an instance of mole.
+
+The same environment variables set by "mole exec" are printed:
+
+  MOLE_ID                   instance identifier
+  MOLE_SOURCE_<n>           source address of the nth channel
+  MOLE_SOURCE_<n>_HOST      host of the source address of the nth channel
+  MOLE_SOURCE_<n>_PORT      port of the source address of the nth channel
+  MOLE_DESTINATION_<n>      destination address of the nth channel
+
+Detached instances are supported, even when their rpc server is disabled.`,
+		Example: `eval "$(mole env example)"`,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) < 1 {
+				return errors.New("alias name or id not provided")
+			}
+
+			id = args[0]
+
+			return nil
+		},
+		Run: func(cmd *cobra.Command, arg []string) {
+			exports, err := mole.Env(id)
+			if err != nil {
+				log.WithError(err).WithFields(log.Fields{
+					"id": id,
+				}).Error("could not retrieve environment of mole instance")
+				os.Exit(1)
+			}
+
+			for _, e := range exports {
+				fmt.Println(e)
+			}
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(envCmd)
+}
@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"errors"
+	"os"
+
+	"github.com/davrodpin/mole/alias"
+	"github.com/davrodpin/mole/mole"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	flag "github.com/spf13/pflag"
+)
+
+var (
+	execArgs []string
+)
+
+var execCmd = &cobra.Command{
+	Use:   "exec [alias] -- <command> [args...]",
+	Short: "Runs a command with a temporary ssh tunnel",
+	Long: `Runs a command with a temporary ssh tunnel.
+
+The tunnel is described either by the same flags used by "start local" or by an
+alias, in which case only --verbose and --insecure override the alias settings.
+
+The command starts once all tunnel channels are ready to accept connections
+and the following environment variables are set for it:
+
+  MOLE_ID                   instance identifier
+  MOLE_SOURCE_<n>           source address of the nth channel
+  MOLE_SOURCE_<n>_HOST      host of the source address of the nth channel
+  MOLE_SOURCE_<n>_PORT      port of the source address of the nth channel
+  MOLE_DESTINATION_<n>      destination address of the nth channel
+
+SIGTERM is passed through to the command, while SIGINT and SIGQUIT, which the
+terminal already sends to it, only make mole wait for it to exit. The tunnel is
+torn down once the command exits and mole exits with the same status code as
+the command, or with 127 if it could not be found and 126 if it could not be
+executed.
+`,
+	Example: `mole exec --server example --destination db:5432 -- sh -c 'psql -h $MOLE_SOURCE_0_HOST -p $MOLE_SOURCE_0_PORT'
+mole exec example -- ./run-migrations.sh`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		dash := cmd.ArgsLenAtDash()
+		if dash < 0 || dash == len(args) {
+			return errors.New("command not provided: use -- to separate it from mole arguments")
+		}
+
+		if dash > 1 {
+			return errors.New("only one alias can be provided")
+		}
+
+		if dash == 1 {
+			aliasName = args[0]
+		}
+
+		execArgs = args[dash:]
+
+		return nil
+	},
+	Run: func(cmd *cobra.Command, arg []string) {
+		// mole logs must not get mixed with the output of the command
+		log.SetOutput(os.Stderr)
+
+		if aliasName != "" {
+			cmd.Flags().Visit(func(f *flag.Flag) {
+				givenFlags = append(givenFlags, f.Name)
+			})
+
+			al, err := alias.Get(aliasName)
+			if err != nil {
+				log.WithError(err).Errorf("failed to run command with tunnel from alias %s", aliasName)
+				os.Exit(1)
+			}
+
+			err = conf.Merge(al, givenFlags)
+			if err != nil {
+				log.WithError(err).Errorf("failed to run command with tunnel from alias %s", aliasName)
+				os.Exit(1)
+			}
+
+			// the alias name would clash with any instance started from the same
+			// alias, so a random identifier is used instead.
+			conf.Id = ""
+		} else {
+			if conf.Server.Host == "" {
+				log.Error("either an alias or the --server flag must be provided")
+				os.Exit(1)
+			}
+
+			conf.TunnelType = "local"
+		}
+
+		conf.Detach = false
+
+		code, err := mole.New(conf).Exec(execArgs[0], execArgs[1:]...)
+		if err != nil {
+			log.WithError(err).Error("error running command")
+		}
+
+		os.Exit(code)
+	},
+}
+
+func init() {
+	err := bindTunnelFlags(conf, execCmd)
+	if err != nil {
+		log.WithError(err).Error("error parsing command line arguments")
+		os.Exit(1)
+	}
+
+	// the command always runs in foreground
+	err = execCmd.Flags().MarkHidden("detach")
+	if err != nil {
+		log.WithError(err).Error("error parsing command line arguments")
+		os.Exit(1)
+	}
+
+	rootCmd.AddCommand(execCmd)
+}
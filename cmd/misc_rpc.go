@@ -18,7 +18,9 @@ var (
 	miscRpcCmd = &cobra.Command{
 		Use:   "rpc [alias or id] [method] [params]",
 		Short: "Executes a remote procedure call on a given mole instance",
-		Long:  "Executes a remote procedure call on a given mole instance",
+		Long: `Executes a remote procedure call on a given mole instance.
+
+The optional params argument must be a valid JSON value (e.g. '{"key": "value"}').`,
 		Args: func(cmd *cobra.Command, args []string) error {
 			if len(args) < 2 {
 				return fmt.Errorf("not enough arguments.")
@@ -34,7 +36,22 @@ var (
 			return nil
 		},
 		Run: func(cmd *cobra.Command, arg []string) {
-			resp, err := rpc.CallById(context.Background(), id, method, params)
+			var p interface{}
+
+			if params != "" {
+				if !json.Valid([]byte(params)) {
+					log.WithFields(log.Fields{
+						"id":     id,
+						"params": params,
+					}).Error("rpc params must be a valid JSON value.")
+
+					os.Exit(1)
+				}
+
+				p = json.RawMessage(params)
+			}
+
+			resp, err := rpc.CallById(context.Background(), id, method, p)
 			if err != nil {
 				log.WithError(err).WithFields(log.Fields{
 					"id": id,
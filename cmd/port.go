@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/davrodpin/mole/mole"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	portDestination string
+
+	portCmd = &cobra.Command{
+		Use:   "port [alias name or id] [destination]",
+		Short: "Prints the source address assigned to the channels of an instance of mole",
+		Long: `Prints the source address assigned to the channels of an instance of mole.
+
+This is useful to discover the port randomly assigned to a channel started
+without a source address. If a destination is given, only the source address
+of the channel forwarding connections to it is printed, otherwise the source
+address of every channel is printed, one per line.
+
+Detached instances are supported, even when their rpc server is disabled.`,
+		Example: `mole port example 172.17.0.100:80`,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) < 1 {
+				return errors.New("alias name or id not provided")
+			}
+
+			id = args[0]
+
+			if len(args) > 1 {
+				portDestination = args[1]
+			}
+
+			return nil
+		},
+		Run: func(cmd *cobra.Command, arg []string) {
+			ports, err := mole.Ports(id, portDestination)
+			if err != nil {
+				log.WithError(err).WithFields(log.Fields{
+					"id": id,
+				}).Error("could not retrieve source addresses of mole instance")
+				os.Exit(1)
+			}
+
+			for _, p := range ports {
+				fmt.Println(p)
+			}
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(portCmd)
+}
@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/davrodpin/mole/mole"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	pruneCmd = &cobra.Command{
+		Use:   "prune",
+		Short: "Removes files left behind by stale instances of mole",
+		Long: `Removes files left behind by stale instances of mole.
+
+An instance is considered stale when its directory, under $HOME/.mole, still
+has a pid file but the process recorded on it is gone or is not an instance of
+mole anymore, or when it has a state file but no pid file. This usually happens
+when a detached instance crashes.
+
+The log file of stale instances is kept, so it can still be shown with
+"mole show logs". Directories with neither a pid nor a state file, like the
+ones of instances that stopped cleanly, are left untouched.
+
+Stale instances are also removed every time an instance starts.`,
+		Run: func(cmd *cobra.Command, arg []string) {
+			pruned, err := mole.Prune()
+			if err != nil {
+				log.WithError(err).Error("error removing stale instances")
+				os.Exit(1)
+			}
+
+			for _, id := range pruned {
+				fmt.Printf("%s\n", id)
+			}
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(pruneCmd)
+}
@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"errors"
+	"os"
+
+	"github.com/davrodpin/mole/mole"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	reloadCmd = &cobra.Command{
+		Use:   "reload [alias name]",
+		Short: "Reloads the alias configuration of a running instance of mole",
+		Long: `Reloads the alias configuration of a running instance of mole.
+
+The instance re-reads its alias and applies the differences without stopping:
+new channels start listening, removed channels are closed and changes to the
+keep alive interval or connection retries take effect right away. The
+connection to the ssh server is only re-established if the server or its
+authentication settings changed.
+
+The same can be achieved by sending a SIGHUP to the instance process or by
+calling the "reload" rpc method.`,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) < 1 {
+				return errors.New("alias name not provided")
+			}
+
+			id = args[0]
+
+			return nil
+		},
+		Run: func(cmd *cobra.Command, arg []string) {
+			err := mole.Reload(id)
+			if err != nil {
+				log.WithError(err).WithFields(log.Fields{
+					"id": id,
+				}).Error("error reloading mole instance")
+				os.Exit(1)
+			}
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(reloadCmd)
+}
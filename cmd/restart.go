@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"errors"
+	"os"
+
+	"github.com/davrodpin/mole/mole"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	restartCmd = &cobra.Command{
+		Use:   "restart [alias name or id]",
+		Short: "Restarts an instance of mole",
+		Long: `Restarts an instance of mole by either a given auto generated id or alias.
+
+If there is an alias with the given name, the instance is started again using
+the alias configuration, so any change made to the alias is applied.
+Otherwise, the configuration persisted by the instance on its state file is
+used.
+
+The restarted instance always runs in background.`,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) < 1 {
+				return errors.New("alias name or id not provided")
+			}
+
+			id = args[0]
+
+			return nil
+		},
+		Run: func(cmd *cobra.Command, arg []string) {
+			err := mole.Restart(id)
+			if err != nil {
+				log.WithError(err).WithFields(log.Fields{
+					"id": id,
+				}).Error("error restarting mole instance")
+				os.Exit(1)
+			}
+		},
+	}
+)
+
+func init() {
+	// id is a hidden flag used to carry the unique identifier of the instance to
+	// the child process when the instance is restarted in background.
+	restartCmd.Flags().StringVarP(&conf.Id, mole.IdFlagName, "", "", "")
+	err := restartCmd.Flags().MarkHidden(mole.IdFlagName)
+	if err != nil {
+		log.WithError(err).Error("error parsing command line arguments")
+		os.Exit(1)
+	}
+
+	rootCmd.AddCommand(restartCmd)
+}
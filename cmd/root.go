@@ -5,12 +5,22 @@ import (
 	"time"
 
 	"github.com/davrodpin/mole/mole"
+	"github.com/davrodpin/mole/tunnel"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	flag "github.com/spf13/pflag"
 )
 
+const (
+	defaultKeepAliveInterval = 10 * time.Second
+	defaultConnectionRetries = 3
+	defaultSshConfig         = "$HOME/.ssh/config"
+	defaultWaitAndRetry      = 3 * time.Second
+	defaultTimeout           = 3 * time.Second
+	defaultListenAddress     = "127.0.0.1:0"
+)
+
 var (
 	aliasName  string
 	id         string
@@ -31,6 +41,26 @@ func Execute() error {
 }
 
 func bindFlags(conf *mole.Configuration, cmd *cobra.Command) error {
+	err := bindTunnelFlags(conf, cmd)
+	if err != nil {
+		return err
+	}
+
+	err = cmd.MarkFlagRequired("server")
+	if err != nil {
+		return err
+	}
+
+	flag.Visit(func(f *flag.Flag) {
+		givenFlags = append(givenFlags, f.Name)
+	})
+
+	return nil
+}
+
+// bindTunnelFlags binds all flags describing a tunnel, without requiring any
+// of them, so they can also be used to override the settings of an alias.
+func bindTunnelFlags(conf *mole.Configuration, cmd *cobra.Command) error {
 	cmd.Flags().BoolVarP(&conf.Verbose, "verbose", "v", false, "increase log verbosity")
 	cmd.Flags().BoolVarP(&conf.Insecure, "insecure", "i", false, "skip host key validation when connecting to ssh server")
 	cmd.Flags().BoolVarP(&conf.Detach, "detach", "x", false, "run process in background")
@@ -40,34 +70,89 @@ multiple -source conf can be provided`)
 multiple -destination conf can be provided`)
 	cmd.Flags().VarP(&conf.Server, "server", "s", "set server address: [<user>@]<host>[:<port>]")
 	cmd.Flags().StringVarP(&conf.Key, "key", "k", "", "set server authentication key file path")
-	cmd.Flags().DurationVarP(&conf.KeepAliveInterval, "keep-alive-interval", "K", 10*time.Second, "time interval for keep alive packets to be sent")
-	cmd.Flags().IntVarP(&conf.ConnectionRetries, "connection-retries", "R", 3, `maximum number of connection retries to the ssh server
+	cmd.Flags().DurationVarP(&conf.KeepAliveInterval, "keep-alive-interval", "K", defaultKeepAliveInterval, "time interval for keep alive packets to be sent")
+	cmd.Flags().IntVarP(&conf.ConnectionRetries, "connection-retries", "R", defaultConnectionRetries, `maximum number of connection retries to the ssh server
 provide 0 to never give up or a negative number to disable`)
-	cmd.Flags().StringVarP(&conf.SshConfig, "config", "c", "$HOME/.ssh/config", "set config file path")
-	cmd.Flags().DurationVarP(&conf.WaitAndRetry, "retry-wait", "w", 3*time.Second, "time to wait before trying to reconnect to ssh server")
+	cmd.Flags().StringVarP(&conf.SshConfig, "config", "c", defaultSshConfig, `set config file path
+commands of "Match exec" blocks run once per lookup of a host and must exit within 5s to match`)
+	cmd.Flags().DurationVarP(&conf.WaitAndRetry, "retry-wait", "w", defaultWaitAndRetry, "time to wait before trying to reconnect to ssh server")
 	cmd.Flags().StringVarP(&conf.SshAgent, "ssh-agent", "A", "", "unix socket to communicate with a ssh agent")
-	cmd.Flags().DurationVarP(&conf.Timeout, "timeout", "t", 3*time.Second, "ssh server connection timeout")
+	cmd.Flags().DurationVarP(&conf.Timeout, "timeout", "t", defaultTimeout, "ssh server connection timeout")
 	cmd.Flags().BoolVarP(&conf.Rpc, "rpc", "", false, "enable the rpc server")
-	cmd.Flags().StringVarP(&conf.RpcAddress, "rpc-address", "", "127.0.0.1:0", `set the network address of the rpc server.
+	cmd.Flags().StringVarP(&conf.RpcAddress, "rpc-address", "", defaultListenAddress, `set the network address of the rpc server.
 The default value uses a random free port to listen for requests.
 The full address is kept on $HOME/.mole/<id>.`)
+	cmd.Flags().BoolVarP(&conf.Http, "http", "", false, "enable the http gateway to the rpc methods")
+	cmd.Flags().StringVarP(&conf.HttpAddress, "http-address", "", defaultListenAddress, `set the network address of the http gateway, which must be a loopback address.
+The default value uses a random free port to listen for requests.
+The full address is kept on $HOME/.mole/<id>.`)
+	cmd.Flags().BoolVarP(&conf.Lazy, "lazy", "", false, `connect to the ssh server only when the first client connects
+only supported by local tunnels`)
+	cmd.Flags().DurationVarP(&conf.IdleDisconnect, "idle-disconnect", "", 0, `disconnect a lazy tunnel from the ssh server after being idle
+for the given time, 0 keeps the connection open`)
+	cmd.Flags().DurationSliceVarP(&conf.IdleTimeout, "idle-timeout", "", nil, `close connections without any data transferred for the given time
+one value per channel, in the same order, or a single value for all channels`)
+	cmd.Flags().DurationSliceVarP(&conf.MaxLifetime, "max-lifetime", "", nil, `close connections open for longer than the given time
+one value per channel, in the same order, or a single value for all channels`)
+	cmd.Flags().IntSliceVarP(&conf.MaxConnections, "max-connections", "", nil, `maximum number of concurrent connections
+one value per channel, in the same order, or a single value for all channels`)
+	cmd.Flags().IntVarP(&conf.MaxTotalConnections, "max-total-connections", "", 0, "maximum number of concurrent connections across all channels")
+	cmd.Flags().StringVarP(&conf.ConnectionPolicy, "connection-policy", "", string(tunnel.QueuePolicy), `what to do with new connections once the maximum is reached:
+queue: leave them on the listener backlog until a connection is closed
+reject: close them right away
+hold: accept them but only connect them to the destination once a connection is closed`)
+	cmd.Flags().StringArrayVarP(&conf.Allow, "allow", "", nil, `comma separated list of networks, in CIDR notation, to accept connections from
+one flag per channel, in the same order, or a single flag for all channels`)
+	cmd.Flags().StringArrayVarP(&conf.Deny, "deny", "", nil, `comma separated list of networks, in CIDR notation, to refuse connections from
+one flag per channel, in the same order, or a single flag for all channels`)
+	cmd.Flags().DurationVarP(&conf.DialTimeout, "dial-timeout", "", 0, `maximum time to wait for a connection to a destination to be established
+0 disables the timeout`)
+	cmd.Flags().StringSliceVarP(&conf.UploadLimit, "upload-limit", "", nil, `maximum rate of data sent to the ssh server, in bytes per second (e.g. 512K, 2M)
+one value per channel, in the same order, or a single value for all channels`)
+	cmd.Flags().StringSliceVarP(&conf.DownloadLimit, "download-limit", "", nil, `maximum rate of data received from the ssh server, in bytes per second (e.g. 512K, 2M)
+one value per channel, in the same order, or a single value for all channels`)
+	cmd.Flags().StringVarP(&conf.TotalUploadLimit, "total-upload-limit", "", "", "maximum rate of data sent to the ssh server across all channels, in bytes per second")
+	cmd.Flags().StringVarP(&conf.TotalDownloadLimit, "total-download-limit", "", "", "maximum rate of data received from the ssh server across all channels, in bytes per second")
+	cmd.Flags().StringArrayVarP(&conf.Capture, "capture", "", nil, `directory to write the data exchanged by each connection to, as a pcap file
+one flag per channel, in the same order, or a single flag for all channels`)
+	cmd.Flags().StringVarP(&conf.CaptureMaxSize, "capture-max-size", "", "", "maximum size of each capture file (e.g. 10M)")
+	cmd.Flags().StringVarP(&conf.CaptureMaxTotalSize, "capture-max-total-size", "", "", "maximum size of all capture files together (e.g. 1G)")
+	cmd.Flags().StringArrayVarP(&conf.SourceTlsCert, "source-tls-cert", "", nil, `certificate file, in PEM format, to accept tls connections on the source address
+one flag per channel, in the same order, or a single flag for all channels`)
+	cmd.Flags().StringArrayVarP(&conf.SourceTlsKey, "source-tls-key", "", nil, `private key file, in PEM format, of the source tls certificate
+one flag per channel, in the same order, or a single flag for all channels`)
+	cmd.Flags().BoolSliceVarP(&conf.DestinationTls, "destination-tls", "", nil, `connect to the destination over tls (e.g. --destination-tls=false,true)
+one value per channel, in the same order, or a single value for all channels`)
+	cmd.Flags().StringArrayVarP(&conf.DestinationTlsName, "destination-tls-server-name", "", nil, `server name used to verify the destination certificate, defaults to the destination host
+one flag per channel, in the same order, or a single flag for all channels`)
+	cmd.Flags().StringArrayVarP(&conf.DestinationTlsCa, "destination-tls-ca", "", nil, `file with the certificate authorities, in PEM format, trusted to verify the destination certificate
+one flag per channel, in the same order, or a single flag for all channels`)
+	cmd.Flags().StringSliceVarP(&conf.ProxyProtocol, "proxy-protocol", "", nil, `send a PROXY protocol header (v1 or v2) with the client address to the destination
+one value per channel, in the same order, or a single value for all channels`)
+	cmd.Flags().StringArrayVarP(&conf.UdpSource, "udp-source", "", nil, `set source endpoint address of a udp channel: [<host>]:<port>
+multiple --udp-source flags can be provided, each one paired with a --udp-destination`)
+	cmd.Flags().StringArrayVarP(&conf.UdpDestination, "udp-destination", "", nil, `set destination endpoint address of a udp channel: <host>:<port>
+the destination must be reachable from the udp relay`)
+	cmd.Flags().StringVarP(&conf.UdpRelay, "udp-relay", "", "", `address of the udp relay, started by "mole agent", as seen by the ssh server
+required by udp channels`)
+	cmd.Flags().DurationVarP(&conf.UdpTimeout, "udp-timeout", "", tunnel.DefaultUDPTimeout, "time a udp session is kept open without any datagram going through it")
+	cmd.Flags().StringArrayVarP(&conf.HttpProxy, "http-proxy", "", nil, `set source endpoint address of a channel acting as an http proxy: [<host>]:<port>
+targets asked through CONNECT or absolute http URIs are reached from the ssh server
+multiple --http-proxy flags can be provided`)
+	cmd.Flags().StringArrayVarP(&conf.HttpProxyAllow, "http-proxy-allow", "", nil, `host http proxy clients can connect to, either a name or *.<domain>
+multiple --http-proxy-allow flags can be provided, any host is allowed if none is given`)
+	cmd.Flags().StringArrayVarP(&conf.Backends, "backends", "", nil, `comma separated list of destinations sharing the connections of a channel with its --destination
+one flag per channel, in the same order as --destination, channels without a flag have no backends`)
+	cmd.Flags().StringSliceVarP(&conf.LoadBalance, "load-balance", "", nil, `how the destination of each connection to a channel with --backends is picked: round-robin, random or least-connections
+one value per channel, in the same order, or a single value for all channels (default round-robin)`)
+	cmd.Flags().DurationVarP(&conf.HealthCheckInterval, "health-check-interval", "", tunnel.DefaultHealthCheckInterval, `time between two attempts to reach each destination of channels with --backends
+destinations that can't be reached are skipped until they recover, 0 disables health checks`)
+
+	// --destination-tls alone enables tls for all channels
+	cmd.Flags().Lookup("destination-tls").NoOptDefVal = "true"
 
 	// id is a hidden flag used to carry the unique identifier of the instance to
 	// the child process when the `--detached` flag is used.
 	cmd.Flags().StringVarP(&conf.Id, mole.IdFlagName, "", "", "")
-	err := cmd.Flags().MarkHidden(mole.IdFlagName)
-	if err != nil {
-		return err
-	}
-
-	err = cmd.MarkFlagRequired("server")
-	if err != nil {
-		return err
-	}
-
-	flag.Visit(func(f *flag.Flag) {
-		givenFlags = append(givenFlags, f.Name)
-	})
-
-	return nil
+	return cmd.Flags().MarkHidden(mole.IdFlagName)
 }
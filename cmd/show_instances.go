@@ -16,7 +16,8 @@ var (
 		Short: "Shows runtime information about application instances",
 		Long: `Shows runtime information about application instances.
 
-Only instances with rpc enabled will be shown by this command.`,
+Instances with rpc enabled report their live configuration. For any other
+instance, the state persisted on $HOME/.mole/<id>/state is shown instead.`,
 		Args: func(cmd *cobra.Command, args []string) error {
 			if len(args) > 0 {
 				id = args[0]
@@ -68,5 +68,14 @@ func init() {
 	startAliasCmd.Flags().BoolVarP(&conf.Insecure, "insecure", "i", false, "skip host key validation when connecting to ssh server")
 	startAliasCmd.Flags().BoolVarP(&conf.Detach, "detach", "x", false, "run process in background")
 
+	// id is a hidden flag used to carry the unique identifier of the instance to
+	// the child process when the `--detached` flag is used.
+	startAliasCmd.Flags().StringVarP(&conf.Id, mole.IdFlagName, "", "", "")
+	err := startAliasCmd.Flags().MarkHidden(mole.IdFlagName)
+	if err != nil {
+		log.WithError(err).Error("error parsing command line arguments")
+		os.Exit(1)
+	}
+
 	startCmd.AddCommand(startAliasCmd)
 }
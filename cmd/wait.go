@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"github.com/davrodpin/mole/mole"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	waitTimeout time.Duration
+
+	waitCmd = &cobra.Command{
+		Use:   "wait [alias name or id]",
+		Short: "Waits for an instance of mole to be ready to accept connections",
+		Long: `Waits for an instance of mole to be ready to accept connections.
+
+The command blocks until the instance is connected to the ssh server and all of
+its channels are listening, which makes it useful for scripts that start an
+instance with --detach and need to know when its tunnel can be used.
+
+The command exits with a non-zero status code if the instance is not ready
+within the given timeout or if it stops running before being ready, and right
+away if the instance is not running.`,
+		Example: `mole start alias example --detach && mole wait example --timeout 30s`,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) < 1 {
+				return errors.New("alias name or id not provided")
+			}
+
+			id = args[0]
+
+			return nil
+		},
+		Run: func(cmd *cobra.Command, arg []string) {
+			_, err := mole.Wait(id, waitTimeout)
+			if err != nil {
+				log.WithError(err).WithFields(log.Fields{
+					"id": id,
+				}).Error("mole instance is not ready")
+				os.Exit(1)
+			}
+
+			log.WithFields(log.Fields{
+				"id": id,
+			}).Info("mole instance is ready")
+		},
+	}
+)
+
+func init() {
+	waitCmd.Flags().DurationVarP(&waitTimeout, "timeout", "t", time.Minute, "maximum time to wait for the instance to be ready, 0 waits forever")
+
+	rootCmd.AddCommand(waitCmd)
+}
@@ -9,8 +9,9 @@ import (
 )
 
 const (
-	InstancePidFile = "pid"
-	InstanceLogFile = "mole.log"
+	InstancePidFile   = "pid"
+	InstanceLogFile   = "mole.log"
+	InstanceStateFile = "state"
 )
 
 type InstanceDirInfo struct {
@@ -128,6 +129,46 @@ func GetLogFileLocation(id string) (string, error) {
 	return lfp, nil
 }
 
+// GetStateFileLocation returns the file system location of the file where the
+// runtime state of an specific application instance is persisted.
+func GetStateFileLocation(id string) (string, error) {
+	d, err := Dir()
+	if err != nil {
+		return "", err
+	}
+
+	sfp := filepath.Join(d, id, InstanceStateFile)
+
+	return sfp, nil
+}
+
+// Instances returns the id of all application instances that have a
+// directory under the mole home directory, running or not.
+func Instances() ([]string, error) {
+	home, err := Dir()
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := ioutil.ReadDir(home)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+
+		return nil, err
+	}
+
+	ids := []string{}
+	for _, e := range entries {
+		if e.IsDir() {
+			ids = append(ids, e.Name())
+		}
+	}
+
+	return ids, nil
+}
+
 // CreatePidFile creates a file, inside the directory allocated for instance,
 // witht the instance process id.
 func CreatePidFile(id string) (string, error) {
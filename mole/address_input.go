@@ -2,8 +2,11 @@ package mole
 
 import (
 	"fmt"
+	"net"
 	"regexp"
 	"strings"
+
+	"github.com/davrodpin/mole/tunnel"
 )
 
 const (
@@ -33,6 +36,23 @@ func (ai AddressInput) String() string {
 
 // Set parses a string representation of AddressInput into its proper attributes.
 func (ai *AddressInput) Set(value string) error {
+	// unix socket paths and IPv6 addresses can't be parsed by the regular
+	// expression used for host names.
+	if tunnel.IsSocketPath(value) {
+		ai.User, ai.Host, ai.Port = "", value, ""
+		return nil
+	}
+
+	if strings.HasPrefix(value, "[") {
+		host, port, err := net.SplitHostPort(value)
+		if err != nil {
+			return err
+		}
+
+		ai.User, ai.Host, ai.Port = "", host, port
+		return nil
+	}
+
 	result := parseServerInput(value)
 	ai.User = strings.Trim(result["user"], "@")
 	ai.Host = result["host"]
@@ -53,6 +73,10 @@ func (ai AddressInput) Address() string {
 		return ai.Host
 	}
 
+	if strings.Contains(ai.Host, ":") {
+		return net.JoinHostPort(ai.Host, ai.Port)
+	}
+
 	return fmt.Sprintf(AddressFormat, ai.Host, ai.Port)
 }
 
@@ -47,6 +47,12 @@ func TestAddressInputListSet(t *testing.T) {
 		{
 			"mole@mole-server:22",
 		},
+		{
+			"[::1]:8080",
+		},
+		{
+			"/var/run/app.sock",
+		},
 	}
 
 	for id, test := range tests {
@@ -76,6 +82,11 @@ func TestAddressInputAddress(t *testing.T) {
 			"",
 			"mole-server",
 		},
+		{
+			"::1",
+			"22",
+			"[::1]:22",
+		},
 	}
 
 	for id, test := range tests {
@@ -0,0 +1,49 @@
+package mole
+
+import (
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/davrodpin/mole/tunnel"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RunAgent runs a udp relay on the given address, relaying the datagrams sent
+// through the udp channels of other mole instances to their destinations, until
+// the process receives a termination signal.
+func RunAgent(address string, timeout time.Duration) error {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"address": l.Addr(),
+	}).Info("mole agent is waiting for udp channels")
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	stopped := make(chan struct{})
+	go func() {
+		sig := <-sigs
+		log.Debugf("process signal %s received", sig)
+		close(stopped)
+		l.Close()
+	}()
+
+	err = tunnel.ServeUDPRelay(l, timeout)
+
+	select {
+	case <-stopped:
+		log.Info("mole agent stopped")
+		return nil
+	default:
+		return err
+	}
+}
@@ -0,0 +1,39 @@
+package mole
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAppendIdArg(t *testing.T) {
+	tests := []struct {
+		args     []string
+		expected []string
+	}{
+		{
+			[]string{"mole", "start", "local"},
+			[]string{"mole", "start", "local", "--id", "example"},
+		},
+		{
+			[]string{"mole", "start", "alias", "example", "--detach"},
+			[]string{"mole", "start", "alias", "example", "--detach", "--id", "example"},
+		},
+		{
+			[]string{"mole", "start", "local", "--id", "other"},
+			[]string{"mole", "start", "local", "--id", "other"},
+		},
+	}
+
+	for _, test := range tests {
+		args := append([]string{}, test.args...)
+		newArgs := appendIdArg("example", args)
+
+		if !reflect.DeepEqual(test.expected, newArgs) {
+			t.Errorf("unexpected arguments: want %v, got %v", test.expected, newArgs)
+		}
+
+		if !reflect.DeepEqual(test.args, args) {
+			t.Errorf("arguments given are not expected to change: want %v, got %v", test.args, args)
+		}
+	}
+}
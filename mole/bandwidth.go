@@ -0,0 +1,123 @@
+package mole
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// BandwidthParams describes a change to the rate limits of a running
+// instance. Rates use the same format as the --upload-limit and
+// --download-limit flags, with "0" removing the limit, and rates not given are
+// kept unchanged.
+type BandwidthParams struct {
+	// Channel is the index, starting at zero, of the channel whose limits are
+	// changed. The limits shared by all channels are changed if not given.
+	Channel  *int    `json:"channel"`
+	Upload   *string `json:"upload"`
+	Download *string `json:"download"`
+}
+
+// SetBandwidth changes the rate limits of the running tunnel, either of a
+// single channel or the ones shared by all channels, without interrupting any
+// connection.
+func (c *Client) SetBandwidth(params BandwidthParams) error {
+	c.mu.Lock()
+	err := c.setBandwidth(params)
+	c.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return c.saveState()
+}
+
+// setBandwidth does the work of SetBandwidth.
+//
+// The caller must hold c.mu.
+func (c *Client) setBandwidth(params BandwidthParams) error {
+	if c.Tunnel == nil {
+		return fmt.Errorf("instance %s has no tunnel running", c.Conf.Id)
+	}
+
+	if params.Channel == nil {
+		upload := optionalString(params.Upload, c.Conf.TotalUploadLimit)
+		download := optionalString(params.Download, c.Conf.TotalDownloadLimit)
+
+		bw, err := parseBandwidth(upload, download)
+		if err != nil {
+			return err
+		}
+
+		c.Tunnel.SetBandwidth(bw)
+		c.Conf.TotalUploadLimit = upload
+		c.Conf.TotalDownloadLimit = download
+	} else {
+		n := *params.Channel
+		size := len(c.Tunnel.Channels())
+
+		if n < 0 || n >= size {
+			return fmt.Errorf("channel %d not found: the tunnel has %d channels", n, size)
+		}
+
+		upload := optionalString(params.Upload, stringAt(c.Conf.UploadLimit, n))
+		download := optionalString(params.Download, stringAt(c.Conf.DownloadLimit, n))
+
+		bw, err := parseBandwidth(upload, download)
+		if err != nil {
+			return err
+		}
+
+		err = c.Tunnel.SetChannelBandwidth(n, bw)
+		if err != nil {
+			return err
+		}
+
+		c.Conf.UploadLimit = setStringAt(c.Conf.UploadLimit, n, size, upload)
+		c.Conf.DownloadLimit = setStringAt(c.Conf.DownloadLimit, n, size, download)
+	}
+
+	log.WithFields(log.Fields{
+		"id":                   c.Conf.Id,
+		"upload-limit":         c.Conf.UploadLimit,
+		"download-limit":       c.Conf.DownloadLimit,
+		"total-upload-limit":   c.Conf.TotalUploadLimit,
+		"total-download-limit": c.Conf.TotalDownloadLimit,
+	}).Info("bandwidth limits changed")
+
+	return nil
+}
+
+func optionalString(value *string, def string) string {
+	if value == nil {
+		return def
+	}
+
+	return *value
+}
+
+// setStringAt returns a list with the value of each of the given number of
+// channels, as seen by stringAt, after setting the value for the nth channel.
+// The list is empty if no channel has a value.
+func setStringAt(values []string, n, size int, value string) []string {
+	updated := make([]string, size)
+	empty := true
+
+	for i := range updated {
+		updated[i] = stringAt(values, i)
+		if i == n {
+			updated[i] = value
+		}
+
+		if updated[i] != "" {
+			empty = false
+		}
+	}
+
+	if empty {
+		return nil
+	}
+
+	return updated
+}
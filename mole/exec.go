@@ -0,0 +1,188 @@
+package mole
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+
+	"github.com/davrodpin/mole/fsutils"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// EnvPrefix is the prefix of the environment variables describing an
+	// application instance.
+	EnvPrefix = "MOLE_"
+)
+
+// Exec starts the tunnel and, once all of its channels are ready to accept
+// connections, runs the given command with the addresses of each channel
+// exported as environment variables (see Runtime.Environment).
+//
+// SIGTERM received while the command runs is passed through to it, while
+// SIGINT and SIGQUIT, which the terminal sends to the whole process group, the
+// command included, only keep mole waiting for the command to exit. The tunnel
+// is torn down after the command exits and its exit code is returned.
+func (c *Client) Exec(name string, args ...string) (int, error) {
+	if c.Conf.Detach {
+		return 1, errors.New("a command can't be executed by a detached instance")
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- c.start(false)
+	}()
+
+	select {
+	case <-c.ready:
+	case err := <-errc:
+		if err == nil {
+			err = errors.New("tunnel stopped before being ready")
+		}
+
+		return 1, err
+	}
+
+	defer c.teardown(errc)
+
+	rt, err := c.Runtime()
+	if err != nil {
+		return 1, err
+	}
+
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), rt.Environment()...)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	defer signal.Stop(sigs)
+
+	err = cmd.Start()
+	if err != nil {
+		return startExitCode(err), err
+	}
+
+	log.WithFields(log.Fields{
+		"id":      c.Conf.Id,
+		"command": cmd.String(),
+	}).Debug("command started")
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		for {
+			select {
+			case sig := <-sigs:
+				if sig == syscall.SIGINT || sig == syscall.SIGQUIT {
+					log.Debugf("process signal %s received, waiting for the command to exit", sig)
+					continue
+				}
+
+				log.Debugf("process signal %s received, passing it to the command", sig)
+
+				err := cmd.Process.Signal(sig)
+				if err != nil {
+					log.WithError(err).Warn("could not pass signal to the command")
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	err = cmd.Wait()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return exitCode(exitErr), nil
+		}
+
+		return 1, err
+	}
+
+	return 0, nil
+}
+
+// teardown stops the tunnel started by Exec and removes the instance files.
+func (c *Client) teardown(errc chan error) {
+	select {
+	case err := <-errc:
+		if err != nil {
+			log.WithError(err).Warn("tunnel stopped while the command was running")
+		}
+	default:
+		c.Tunnel.Stop()
+		<-errc
+	}
+
+	d, err := fsutils.InstanceDir(c.Conf.Id)
+	if err != nil {
+		log.WithError(err).Warn("could not find instance directory")
+		return
+	}
+
+	err = os.RemoveAll(d.Dir)
+	if err != nil {
+		log.WithError(err).Warn("could not remove instance directory")
+	}
+}
+
+// startExitCode returns the exit code for a command that could not be started,
+// following the shell convention of 127 for commands that could not be found
+// and 126 for the ones that could not be executed.
+func startExitCode(err error) int {
+	if errors.Is(err, exec.ErrNotFound) || errors.Is(err, os.ErrNotExist) {
+		return 127
+	}
+
+	return 126
+}
+
+// exitCode returns the exit code of a command, following the shell convention
+// of 128 plus the signal number for commands killed by a signal.
+func exitCode(err *exec.ExitError) int {
+	if ws, ok := err.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+
+	return err.ExitCode()
+}
+
+// Environment returns the environment variables describing the application
+// instance, in the "key=value" form:
+//
+//	MOLE_ID                   instance identifier
+//	MOLE_SOURCE_<n>           source address of the nth channel
+//	MOLE_SOURCE_<n>_HOST      host of the source address of the nth channel
+//	MOLE_SOURCE_<n>_PORT      port of the source address of the nth channel
+//	MOLE_DESTINATION_<n>      destination address of the nth channel
+func (rt Runtime) Environment() []string {
+	env := []string{fmt.Sprintf("%sID=%s", EnvPrefix, rt.Id)}
+
+	for i, s := range rt.Source {
+		addr := s.Address()
+		env = append(env, fmt.Sprintf("%sSOURCE_%d=%s", EnvPrefix, i, addr))
+
+		if host, port, err := net.SplitHostPort(addr); err == nil {
+			env = append(env,
+				fmt.Sprintf("%sSOURCE_%d_HOST=%s", EnvPrefix, i, host),
+				fmt.Sprintf("%sSOURCE_%d_PORT=%s", EnvPrefix, i, port),
+			)
+		}
+	}
+
+	for i, d := range rt.Destination {
+		env = append(env, fmt.Sprintf("%sDESTINATION_%d=%s", EnvPrefix, i, d.Address()))
+	}
+
+	return env
+}
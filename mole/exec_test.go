@@ -0,0 +1,42 @@
+package mole_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/davrodpin/mole/mole"
+)
+
+func TestRuntimeEnvironment(t *testing.T) {
+	source := mole.AddressInputList{}
+	source.Set("127.0.0.1:54321")
+	source.Set("/tmp/mole.sock")
+
+	destination := mole.AddressInputList{}
+	destination.Set("db:5432")
+	destination.Set("/var/run/app.sock")
+
+	rt := mole.Runtime{
+		Configuration: mole.Configuration{
+			Id:          "id1",
+			Source:      source,
+			Destination: destination,
+		},
+	}
+
+	expected := []string{
+		"MOLE_ID=id1",
+		"MOLE_SOURCE_0=127.0.0.1:54321",
+		"MOLE_SOURCE_0_HOST=127.0.0.1",
+		"MOLE_SOURCE_0_PORT=54321",
+		"MOLE_SOURCE_1=/tmp/mole.sock",
+		"MOLE_DESTINATION_0=db:5432",
+		"MOLE_DESTINATION_1=/var/run/app.sock",
+	}
+
+	env := rt.Environment()
+
+	if !reflect.DeepEqual(expected, env) {
+		t.Errorf("unexpected environment:\n\texpected: %v\n\tvalue   : %v", expected, env)
+	}
+}
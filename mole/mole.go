@@ -2,11 +2,13 @@ package mole
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sync"
 	"syscall"
 	"time"
 
@@ -17,7 +19,6 @@ import (
 
 	"github.com/awnumar/memguard"
 	"github.com/gofrs/uuid"
-	"github.com/mitchellh/mapstructure"
 	daemon "github.com/sevlyar/go-daemon"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ssh/terminal"
@@ -35,45 +36,113 @@ const (
 var cli *Client
 
 type Configuration struct {
-	Id                string           `json:"id" mapstructure:"id" toml:"id"`
-	TunnelType        string           `json:"tunnel-type" mapstructure:"tunnel-type" toml:"tunnel-type"`
-	Verbose           bool             `json:"verbose" mapstructure:"verbose" toml:"verbose"`
-	Insecure          bool             `json:"insecure" mapstructure:"insecure" toml:"insecure"`
-	Detach            bool             `json:"detach" mapstructure:"detach" toml:"detach"`
-	Source            AddressInputList `json:"source" mapstructure:"source" toml:"source"`
-	Destination       AddressInputList `json:"destination" mapstructure:"destination" toml:"destination"`
-	Server            AddressInput     `json:"server" mapstructure:"server" toml:"server"`
-	Key               string           `json:"key" mapstructure:"key" toml:"key"`
-	KeepAliveInterval time.Duration    `json:"keep-alive-interval" mapstructure:"keep-alive-interva" toml:"keep-alive-interval"`
-	ConnectionRetries int              `json:"connection-retries" mapstructure:"connection-retries" toml:"connection-retries"`
-	WaitAndRetry      time.Duration    `json:"wait-and-retry" mapstructure:"wait-and-retry" toml:"wait-and-retry"`
-	SshAgent          string           `json:"ssh-agent" mapstructure:"ssh-agent" toml:"ssh-agent"`
-	Timeout           time.Duration    `json:"timeout" mapstructure:"timeout" toml:"timeout"`
-	SshConfig         string           `json:"ssh-config" mapstructure:"ssh-config" toml:"ssh-config"`
-	Rpc               bool             `json:"rpc" mapstructure:"rpc" toml:"rpc"`
-	RpcAddress        string           `json:"rpc-address" mapstructure:"rpc-address" toml:"rpc-address"`
+	Id                  string           `json:"id" mapstructure:"id" toml:"id"`
+	TunnelType          string           `json:"tunnel-type" mapstructure:"tunnel-type" toml:"tunnel-type"`
+	Verbose             bool             `json:"verbose" mapstructure:"verbose" toml:"verbose"`
+	Insecure            bool             `json:"insecure" mapstructure:"insecure" toml:"insecure"`
+	Detach              bool             `json:"detach" mapstructure:"detach" toml:"detach"`
+	Source              AddressInputList `json:"source" mapstructure:"source" toml:"source"`
+	Destination         AddressInputList `json:"destination" mapstructure:"destination" toml:"destination"`
+	Server              AddressInput     `json:"server" mapstructure:"server" toml:"server"`
+	Key                 string           `json:"key" mapstructure:"key" toml:"key"`
+	KeepAliveInterval   time.Duration    `json:"keep-alive-interval" mapstructure:"keep-alive-interva" toml:"keep-alive-interval"`
+	ConnectionRetries   int              `json:"connection-retries" mapstructure:"connection-retries" toml:"connection-retries"`
+	WaitAndRetry        time.Duration    `json:"wait-and-retry" mapstructure:"wait-and-retry" toml:"wait-and-retry"`
+	SshAgent            string           `json:"ssh-agent" mapstructure:"ssh-agent" toml:"ssh-agent"`
+	Timeout             time.Duration    `json:"timeout" mapstructure:"timeout" toml:"timeout"`
+	SshConfig           string           `json:"ssh-config" mapstructure:"ssh-config" toml:"ssh-config"`
+	Rpc                 bool             `json:"rpc" mapstructure:"rpc" toml:"rpc"`
+	RpcAddress          string           `json:"rpc-address" mapstructure:"rpc-address" toml:"rpc-address"`
+	Http                bool             `json:"http" mapstructure:"http" toml:"http"`
+	HttpAddress         string           `json:"http-address" mapstructure:"http-address" toml:"http-address"`
+	Lazy                bool             `json:"lazy" mapstructure:"lazy" toml:"lazy"`
+	IdleDisconnect      time.Duration    `json:"idle-disconnect" mapstructure:"idle-disconnect" toml:"idle-disconnect"`
+	IdleTimeout         []time.Duration  `json:"idle-timeout" mapstructure:"idle-timeout" toml:"idle-timeout"`
+	MaxLifetime         []time.Duration  `json:"max-lifetime" mapstructure:"max-lifetime" toml:"max-lifetime"`
+	MaxConnections      []int            `json:"max-connections" mapstructure:"max-connections" toml:"max-connections"`
+	MaxTotalConnections int              `json:"max-total-connections" mapstructure:"max-total-connections" toml:"max-total-connections"`
+	ConnectionPolicy    string           `json:"connection-policy" mapstructure:"connection-policy" toml:"connection-policy"`
+	Allow               []string         `json:"allow" mapstructure:"allow" toml:"allow"`
+	Deny                []string         `json:"deny" mapstructure:"deny" toml:"deny"`
+	DialTimeout         time.Duration    `json:"dial-timeout" mapstructure:"dial-timeout" toml:"dial-timeout"`
+	UploadLimit         []string         `json:"upload-limit" mapstructure:"upload-limit" toml:"upload-limit"`
+	DownloadLimit       []string         `json:"download-limit" mapstructure:"download-limit" toml:"download-limit"`
+	TotalUploadLimit    string           `json:"total-upload-limit" mapstructure:"total-upload-limit" toml:"total-upload-limit"`
+	TotalDownloadLimit  string           `json:"total-download-limit" mapstructure:"total-download-limit" toml:"total-download-limit"`
+	Capture             []string         `json:"capture" mapstructure:"capture" toml:"capture"`
+	CaptureMaxSize      string           `json:"capture-max-size" mapstructure:"capture-max-size" toml:"capture-max-size"`
+	CaptureMaxTotalSize string           `json:"capture-max-total-size" mapstructure:"capture-max-total-size" toml:"capture-max-total-size"`
+	SourceTlsCert       []string         `json:"source-tls-cert" mapstructure:"source-tls-cert" toml:"source-tls-cert"`
+	SourceTlsKey        []string         `json:"source-tls-key" mapstructure:"source-tls-key" toml:"source-tls-key"`
+	DestinationTls      []bool           `json:"destination-tls" mapstructure:"destination-tls" toml:"destination-tls"`
+	DestinationTlsName  []string         `json:"destination-tls-server-name" mapstructure:"destination-tls-server-name" toml:"destination-tls-server-name"`
+	DestinationTlsCa    []string         `json:"destination-tls-ca" mapstructure:"destination-tls-ca" toml:"destination-tls-ca"`
+	ProxyProtocol       []string         `json:"proxy-protocol" mapstructure:"proxy-protocol" toml:"proxy-protocol"`
+	UdpSource           []string         `json:"udp-source" mapstructure:"udp-source" toml:"udp-source"`
+	UdpDestination      []string         `json:"udp-destination" mapstructure:"udp-destination" toml:"udp-destination"`
+	UdpRelay            string           `json:"udp-relay" mapstructure:"udp-relay" toml:"udp-relay"`
+	UdpTimeout          time.Duration    `json:"udp-timeout" mapstructure:"udp-timeout" toml:"udp-timeout"`
+	HttpProxy           []string         `json:"http-proxy" mapstructure:"http-proxy" toml:"http-proxy"`
+	HttpProxyAllow      []string         `json:"http-proxy-allow" mapstructure:"http-proxy-allow" toml:"http-proxy-allow"`
+	Backends            []string         `json:"backends" mapstructure:"backends" toml:"backends"`
+	LoadBalance         []string         `json:"load-balance" mapstructure:"load-balance" toml:"load-balance"`
+	HealthCheckInterval time.Duration    `json:"health-check-interval" mapstructure:"health-check-interval" toml:"health-check-interval"`
 }
 
 // ParseAlias translates a Configuration object to an Alias object.
 func (c Configuration) ParseAlias(name string) *alias.Alias {
 	return &alias.Alias{
-		Name:              name,
-		TunnelType:        c.TunnelType,
-		Verbose:           c.Verbose,
-		Insecure:          c.Insecure,
-		Detach:            c.Detach,
-		Source:            c.Source.List(),
-		Destination:       c.Destination.List(),
-		Server:            c.Server.String(),
-		Key:               c.Key,
-		KeepAliveInterval: c.KeepAliveInterval.String(),
-		ConnectionRetries: c.ConnectionRetries,
-		WaitAndRetry:      c.WaitAndRetry.String(),
-		SshAgent:          c.SshAgent,
-		Timeout:           c.Timeout.String(),
-		SshConfig:         c.SshConfig,
-		Rpc:               c.Rpc,
-		RpcAddress:        c.RpcAddress,
+		Name:                name,
+		TunnelType:          c.TunnelType,
+		Verbose:             c.Verbose,
+		Insecure:            c.Insecure,
+		Detach:              c.Detach,
+		Source:              c.Source.List(),
+		Destination:         c.Destination.List(),
+		Server:              c.Server.String(),
+		Key:                 c.Key,
+		KeepAliveInterval:   c.KeepAliveInterval.String(),
+		ConnectionRetries:   c.ConnectionRetries,
+		WaitAndRetry:        c.WaitAndRetry.String(),
+		SshAgent:            c.SshAgent,
+		Timeout:             c.Timeout.String(),
+		SshConfig:           c.SshConfig,
+		Rpc:                 c.Rpc,
+		RpcAddress:          c.RpcAddress,
+		Http:                c.Http,
+		HttpAddress:         c.HttpAddress,
+		Lazy:                c.Lazy,
+		IdleDisconnect:      c.IdleDisconnect.String(),
+		IdleTimeout:         formatDurations(c.IdleTimeout),
+		MaxLifetime:         formatDurations(c.MaxLifetime),
+		MaxConnections:      c.MaxConnections,
+		MaxTotalConnections: c.MaxTotalConnections,
+		ConnectionPolicy:    c.ConnectionPolicy,
+		Allow:               c.Allow,
+		Deny:                c.Deny,
+		DialTimeout:         c.DialTimeout.String(),
+		UploadLimit:         c.UploadLimit,
+		DownloadLimit:       c.DownloadLimit,
+		TotalUploadLimit:    c.TotalUploadLimit,
+		TotalDownloadLimit:  c.TotalDownloadLimit,
+		Capture:             c.Capture,
+		CaptureMaxSize:      c.CaptureMaxSize,
+		CaptureMaxTotalSize: c.CaptureMaxTotalSize,
+		SourceTlsCert:       c.SourceTlsCert,
+		SourceTlsKey:        c.SourceTlsKey,
+		DestinationTls:      c.DestinationTls,
+		DestinationTlsName:  c.DestinationTlsName,
+		DestinationTlsCa:    c.DestinationTlsCa,
+		ProxyProtocol:       c.ProxyProtocol,
+		UdpSource:           c.UdpSource,
+		UdpDestination:      c.UdpDestination,
+		UdpRelay:            c.UdpRelay,
+		UdpTimeout:          c.UdpTimeout.String(),
+		HttpProxy:           c.HttpProxy,
+		HttpProxyAllow:      c.HttpProxyAllow,
+		Backends:            c.Backends,
+		LoadBalance:         c.LoadBalance,
+		HealthCheckInterval: c.HealthCheckInterval.String(),
 	}
 }
 
@@ -81,14 +150,25 @@ func (c Configuration) ParseAlias(name string) *alias.Alias {
 type Client struct {
 	Conf   *Configuration
 	Tunnel *tunnel.Tunnel
-	sigs   chan os.Signal
+	// mu guards Conf and Tunnel once the client started, since they are read
+	// and changed by rpc calls and reloads.
+	mu         sync.Mutex
+	sigs       chan os.Signal
+	reloadSigs chan os.Signal
+	startedAt  time.Time
+	// ready is closed the first time the tunnel becomes ready to accept
+	// connections.
+	ready     chan struct{}
+	readyOnce sync.Once
 }
 
 // New initializes a new mole's client.
 func New(conf *Configuration) *Client {
 	cli = &Client{
-		Conf: conf,
-		sigs: make(chan os.Signal, 1),
+		Conf:       conf,
+		sigs:       make(chan os.Signal, 1),
+		reloadSigs: make(chan os.Signal, 1),
+		ready:      make(chan struct{}),
 	}
 
 	return cli
@@ -97,10 +177,18 @@ func New(conf *Configuration) *Client {
 // Start kicks off mole's client, establishing the tunnel and its channels
 // based on the client configuration attributes.
 func (c *Client) Start() error {
+	return c.start(true)
+}
+
+// start does the work of Start. Signals asking the application to terminate
+// only stop a foreground instance if stopOnSignal is set.
+func (c *Client) start(stopOnSignal bool) error {
 	// memguard is used to securely keep sensitive information in memory.
 	// This call makes sure all data will be destroy when the program exits.
 	defer memguard.Purge()
 
+	c.startedAt = time.Now()
+
 	if c.Conf.Id == "" {
 		u, err := uuid.NewV4()
 		if err != nil {
@@ -109,6 +197,13 @@ func (c *Client) Start() error {
 		c.Conf.Id = u.String()[:8]
 	}
 
+	// files left behind by other instances are cleaned up automatically, while
+	// the ones of this instance are checked below.
+	_, err := Prune(c.Conf.Id)
+	if err != nil {
+		log.WithError(err).Warn("error removing stale instances")
+	}
+
 	r, err := c.Running()
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -128,6 +223,15 @@ func (c *Client) Start() error {
 
 	log.Infof("instance identifier is %s", c.Conf.Id)
 
+	err = removeRunFiles(c.Conf.Id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"id": c.Conf.Id,
+		}).WithError(err).Error("error removing files of a previous run of the instance")
+
+		return err
+	}
+
 	if c.Conf.Detach {
 		var err error
 
@@ -145,7 +249,7 @@ func (c *Client) Start() error {
 
 			return err
 		}
-	} else {
+	} else if stopOnSignal {
 		go c.handleSignals()
 	}
 
@@ -179,11 +283,37 @@ func (c *Client) Start() error {
 			return err
 		}
 
+		c.mu.Lock()
 		c.Conf.RpcAddress = addr.String()
+		c.mu.Unlock()
 
 		log.Infof("rpc server address saved on %s", rd)
 	}
 
+	if c.Conf.Http {
+		addr, err := rpc.StartHTTP(c.Conf.HttpAddress)
+		if err != nil {
+			return err
+		}
+
+		hd := filepath.Join(d.Dir, "http")
+
+		err = ioutil.WriteFile(hd, []byte(addr.String()), 0644)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"id": c.Conf.Id,
+			}).WithError(err).Error("error creating file with http address")
+
+			return err
+		}
+
+		c.mu.Lock()
+		c.Conf.HttpAddress = addr.String()
+		c.mu.Unlock()
+
+		log.Infof("http server address saved on %s", hd)
+	}
+
 	t, err := createTunnel(c.Conf)
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -193,7 +323,19 @@ func (c *Client) Start() error {
 		return err
 	}
 
+	c.mu.Lock()
 	c.Tunnel = t
+	c.mu.Unlock()
+
+	err = c.saveState()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"id": c.Conf.Id,
+		}).WithError(err).Warn("error saving instance state")
+	}
+
+	go c.handleReady(c.Tunnel.ReadyChanged())
+	go c.handleReload()
 
 	if err = c.Tunnel.Start(); err != nil {
 		log.WithFields(log.Fields{
@@ -206,7 +348,8 @@ func (c *Client) Start() error {
 	return nil
 }
 
-// Stop shuts down a detached mole's application instance.
+// Stop shuts down a detached mole's application instance. The log file of a
+// detached instance is kept, so it can still be shown after the instance stops.
 func (c *Client) Stop() error {
 	pfp, err := fsutils.GetPidFileLocation(c.Conf.Id)
 	if err != nil {
@@ -227,7 +370,7 @@ func (c *Client) Stop() error {
 	}
 
 	if c.Conf.Detach {
-		err = os.RemoveAll(pfp)
+		err = removeInstanceFiles(filepath.Dir(pfp))
 		if err != nil {
 			return err
 		}
@@ -251,6 +394,39 @@ func (c *Client) Stop() error {
 	return nil
 }
 
+// handleReady persists the instance state every time the tunnel becomes ready
+// to accept connections or loses its connection to the ssh server, so the
+// state reflects the addresses assigned to each channel and whether the
+// tunnel is ready, even after a reconnection.
+//
+// changed must be taken from the tunnel before it starts, so the first time it
+// becomes ready is not missed.
+func (c *Client) handleReady(changed <-chan struct{}) {
+	for {
+		<-changed
+		changed = c.Tunnel.ReadyChanged()
+
+		if c.Tunnel.IsReady() {
+			c.readyOnce.Do(func() { close(c.ready) })
+		}
+
+		err := c.saveState()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"id": c.id(),
+			}).WithError(err).Warn("error saving instance state")
+		}
+	}
+}
+
+// id returns the identifier of the instance.
+func (c *Client) id() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.Conf.Id
+}
+
 func (c *Client) handleSignals() {
 	signal.Notify(c.sigs, syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
 	sig := <-c.sigs
@@ -339,26 +515,165 @@ func (c *Configuration) Merge(al *alias.Alias, givenFlags []string) error {
 
 	c.RpcAddress = al.RpcAddress
 
+	c.Http = al.Http
+
+	c.HttpAddress = al.HttpAddress
+
+	c.Lazy = al.Lazy
+
+	idl, err := parseOptionalDuration(al.IdleDisconnect)
+	if err != nil {
+		return err
+	}
+	c.IdleDisconnect = idl
+
+	it, err := parseDurations(al.IdleTimeout)
+	if err != nil {
+		return err
+	}
+	c.IdleTimeout = it
+
+	ml, err := parseDurations(al.MaxLifetime)
+	if err != nil {
+		return err
+	}
+	c.MaxLifetime = ml
+
+	c.MaxConnections = al.MaxConnections
+
+	c.MaxTotalConnections = al.MaxTotalConnections
+
+	c.ConnectionPolicy = al.ConnectionPolicy
+
+	c.Allow = al.Allow
+
+	c.Deny = al.Deny
+
+	dt, err := parseOptionalDuration(al.DialTimeout)
+	if err != nil {
+		return err
+	}
+	c.DialTimeout = dt
+
+	c.UploadLimit = al.UploadLimit
+
+	c.DownloadLimit = al.DownloadLimit
+
+	c.TotalUploadLimit = al.TotalUploadLimit
+
+	c.TotalDownloadLimit = al.TotalDownloadLimit
+
+	c.Capture = al.Capture
+
+	c.CaptureMaxSize = al.CaptureMaxSize
+
+	c.CaptureMaxTotalSize = al.CaptureMaxTotalSize
+
+	c.SourceTlsCert = al.SourceTlsCert
+
+	c.SourceTlsKey = al.SourceTlsKey
+
+	c.DestinationTls = al.DestinationTls
+
+	c.DestinationTlsName = al.DestinationTlsName
+
+	c.DestinationTlsCa = al.DestinationTlsCa
+
+	c.ProxyProtocol = al.ProxyProtocol
+
+	c.UdpSource = al.UdpSource
+
+	c.UdpDestination = al.UdpDestination
+
+	c.UdpRelay = al.UdpRelay
+
+	ut, err := parseOptionalDuration(al.UdpTimeout)
+	if err != nil {
+		return err
+	}
+	c.UdpTimeout = ut
+
+	c.HttpProxy = al.HttpProxy
+
+	c.HttpProxyAllow = al.HttpProxyAllow
+
+	c.Backends = al.Backends
+
+	c.LoadBalance = al.LoadBalance
+
+	hci, err := parseOptionalDuration(al.HealthCheckInterval)
+	if err != nil {
+		return err
+	}
+	c.HealthCheckInterval = hci
+
 	return nil
 }
 
+// parseOptionalDuration parses a duration from an alias attribute that may be
+// missing on aliases created by older versions, in which case it is zero.
+func parseOptionalDuration(d string) (time.Duration, error) {
+	if d == "" {
+		return 0, nil
+	}
+
+	return time.ParseDuration(d)
+}
+
+// parseDurations parses a list of durations from an alias attribute.
+func parseDurations(ds []string) ([]time.Duration, error) {
+	if len(ds) == 0 {
+		return nil, nil
+	}
+
+	durations := make([]time.Duration, len(ds))
+	for i, d := range ds {
+		dur, err := time.ParseDuration(d)
+		if err != nil {
+			return nil, err
+		}
+		durations[i] = dur
+	}
+
+	return durations, nil
+}
+
+// formatDurations translates a list of durations to its alias representation.
+func formatDurations(durations []time.Duration) []string {
+	if len(durations) == 0 {
+		return nil
+	}
+
+	ds := make([]string, len(durations))
+	for i, d := range durations {
+		ds[i] = d.String()
+	}
+
+	return ds
+}
+
 // ShowInstances returns the runtime information about all instances of mole
-// running on the system with rpc enabled.
+// found on the system.
 func ShowInstances() (*InstancesRuntime, error) {
-	ctx := context.Background()
-	data, err := rpc.ShowAll(ctx)
+	ids, err := fsutils.Instances()
 	if err != nil {
 		return nil, err
 	}
 
-	var instances []Runtime
+	runtime := InstancesRuntime{}
 
-	err = mapstructure.Decode(data, &instances)
-	if err != nil {
-		return nil, err
-	}
+	for _, id := range ids {
+		r, err := ShowInstance(id)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"id": id,
+			}).WithError(err).Debug("could not retrieve information about application instance")
 
-	runtime := InstancesRuntime(instances)
+			continue
+		}
+
+		runtime = append(runtime, *r)
+	}
 
 	if len(runtime) == 0 {
 		return nil, fmt.Errorf("no instances were found.")
@@ -369,15 +684,60 @@ func ShowInstances() (*InstancesRuntime, error) {
 
 // ShowInstance returns the runtime information about an application instance
 // from the given id or alias.
+//
+// The information is retrieved through rpc when it is enabled for the
+// instance, falling back to the state file persisted by the instance
+// otherwise. Instances which process is gone are reported as stale.
 func ShowInstance(id string) (*Runtime, error) {
+	alive, err := running(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if !alive {
+		s, err := stale(id)
+		if err != nil {
+			return nil, err
+		}
+
+		// what is left of instances that stopped cleanly is their log file.
+		if !s {
+			if _, err := pid(id); os.IsNotExist(err) {
+				return nil, fmt.Errorf("no instance of mole with id %s is running", id)
+			}
+		}
+
+		rt, err := loadState(id)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"id": id,
+			}).WithError(err).Debug("could not load state of stale instance")
+
+			rt = &Runtime{Configuration: Configuration{Id: id}}
+		}
+
+		rt.Status = StatusStale
+
+		return rt, nil
+	}
+
 	ctx := context.Background()
 	info, err := rpc.Show(ctx, id)
 	if err != nil {
-		return nil, err
+		log.WithFields(log.Fields{
+			"id": id,
+		}).WithError(err).Debug("could not retrieve instance information through rpc, using state file")
+
+		r, serr := loadState(id)
+		if serr != nil {
+			return nil, fmt.Errorf("could not retrieve information about instance %s: %v", id, serr)
+		}
+
+		return r, nil
 	}
 
 	var r Runtime
-	err = mapstructure.Decode(info, &r)
+	err = decodeRuntime(info, &r)
 	if err != nil {
 		return nil, err
 	}
@@ -385,6 +745,109 @@ func ShowInstance(id string) (*Runtime, error) {
 	return &r, nil
 }
 
+// Prune removes the files left behind by stale application instances, which
+// are instances whose pid file points to a process that is gone or is not an
+// instance of mole anymore, or whose state file was left behind without a pid
+// file (e.g. pid, state and rpc files). Log files are kept, so they can still
+// be shown, and so is the instance directory holding them.
+//
+// Directories with neither a pid nor a state file, like the ones of instances
+// that stopped cleanly or not created by mole, and instances still starting up
+// are left untouched. The instances given by exclude are never removed.
+func Prune(exclude ...string) ([]string, error) {
+	ids, err := fsutils.Instances()
+	if err != nil {
+		return nil, err
+	}
+
+	var fl flags = exclude
+	pruned := []string{}
+
+	for _, id := range ids {
+		if fl.lookup(id) {
+			continue
+		}
+
+		s, err := stale(id)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"id": id,
+			}).WithError(err).Warn("could not check if instance is stale")
+
+			continue
+		}
+
+		if !s {
+			continue
+		}
+
+		d, err := fsutils.InstanceDir(id)
+		if err != nil {
+			return pruned, err
+		}
+
+		err = removeInstanceFiles(d.Dir)
+		if err != nil {
+			return pruned, err
+		}
+
+		log.WithFields(log.Fields{
+			"id": id,
+		}).Debug("stale instance removed")
+
+		pruned = append(pruned, id)
+	}
+
+	return pruned, nil
+}
+
+// removeRunFiles removes the state, rpc and http files left by a previous run
+// of an application instance, before its pid file is created, so they are
+// never taken as the ones of the new run (e.g. by "mole wait").
+func removeRunFiles(id string) error {
+	d, err := fsutils.InstanceDir(id)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range []string{fsutils.InstanceStateFile, "rpc", "http"} {
+		err = os.Remove(filepath.Join(d.Dir, f))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removeInstanceFiles removes all files of an instance directory but its log
+// file, removing the directory itself if there is no log file.
+func removeInstanceFiles(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	keep := false
+	for _, e := range entries {
+		if e.Name() == fsutils.InstanceLogFile {
+			keep = true
+			continue
+		}
+
+		err = os.RemoveAll(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return err
+		}
+	}
+
+	if keep {
+		return nil
+	}
+
+	return os.Remove(dir)
+}
+
 func startDaemonProcess(instanceConf *DetachedInstance) error {
 	args := appendIdArg(instanceConf.Id, os.Args)
 
@@ -443,6 +906,102 @@ func (fs flags) lookup(flag string) bool {
 }
 
 func createTunnel(conf *Configuration) (*tunnel.Tunnel, error) {
+	s, err := createServer(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	source, destination, err := channelAddresses(conf)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	t, err := tunnel.New(conf.TunnelType, s, source, destination, conf.SshConfig)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	//TODO need to find a way to require the attributes below to be always set
+	// since they are not optional (functionality will break if they are not
+	// set and CLI parsing is the one setting the default values).
+	// That could be done by make them required in the constructor's signature or
+	// by creating a configuration struct for a tunnel object.
+	t.ConnectionRetries = conf.ConnectionRetries
+	t.WaitAndRetry = conf.WaitAndRetry
+	t.KeepAliveInterval = conf.KeepAliveInterval
+	t.Lazy = conf.Lazy
+	t.IdleDisconnect = conf.IdleDisconnect
+	t.DialTimeout = conf.DialTimeout
+	t.HealthCheckInterval = conf.HealthCheckInterval
+	opts, err := channelOptions(conf, len(t.Channels()))
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	t.SetChannelOptions(opts)
+
+	policy, err := tunnel.ParseConnectionPolicy(conf.ConnectionPolicy)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	t.SetConnectionLimit(conf.MaxTotalConnections, policy)
+
+	bw, err := tunnelBandwidth(conf)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	t.SetBandwidth(bw)
+
+	fileSize, totalSize, err := captureLimits(conf)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	t.SetCaptureLimits(fileSize, totalSize)
+
+	err = addUDPChannels(t, conf)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	for _, source := range conf.HttpProxy {
+		err = t.AddHTTPProxy(source, conf.HttpProxyAllow)
+		if err != nil {
+			log.Error(err)
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+// addUDPChannels adds the udp channels described by the given configuration
+// to the tunnel.
+func addUDPChannels(t *tunnel.Tunnel, conf *Configuration) error {
+	if len(conf.UdpSource) != len(conf.UdpDestination) {
+		return fmt.Errorf("each udp source must have a matching udp destination: %d sources and %d destinations given", len(conf.UdpSource), len(conf.UdpDestination))
+	}
+
+	if len(conf.UdpSource) > 0 && conf.UdpRelay == "" {
+		return fmt.Errorf("udp channels require the address of a udp relay")
+	}
+
+	for i, src := range conf.UdpSource {
+		err := t.AddUDPChannel(src, conf.UdpDestination[i], conf.UdpRelay, conf.UdpTimeout)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func createServer(conf *Configuration) (*tunnel.Server, error) {
 	s, err := tunnel.NewServer(conf.Server.User, conf.Server.Address(), conf.Key, conf.SshAgent, conf.SshConfig)
 	if err != nil {
 		log.Errorf("error processing server options: %v\n", err)
@@ -467,37 +1026,211 @@ func createTunnel(conf *Configuration) (*tunnel.Tunnel, error) {
 
 	log.Debugf("server: %s", s)
 
-	source := make([]string, len(conf.Source))
+	return s, nil
+}
+
+// channelAddresses returns the source and destination addresses of all
+// channels described by the given configuration.
+func channelAddresses(conf *Configuration) (source, destination []string, err error) {
+	source = make([]string, len(conf.Source))
 	for i, r := range conf.Source {
 		source[i] = r.String()
 	}
 
-	destination := make([]string, len(conf.Destination))
+	destination = make([]string, len(conf.Destination))
 	for i, r := range conf.Destination {
-		if r.Port == "" {
-			log.WithError(err).Errorf("missing port in destination address: %s", r.String())
-			return nil, err
+		if r.Port == "" && !tunnel.IsSocketPath(r.Host) {
+			return nil, nil, fmt.Errorf("missing port in destination address: %s", r.String())
 		}
 
 		destination[i] = r.String()
 	}
 
-	t, err := tunnel.New(conf.TunnelType, s, source, destination, conf.SshConfig)
+	return source, destination, nil
+}
+
+// channelOptions returns the options of each of the given number of channels
+// described by the given configuration, in the same order as the channels.
+// Options given only once apply to all channels, except for backends, which
+// are only given to the channel with the same index.
+func channelOptions(conf *Configuration, channels int) ([]tunnel.ChannelOptions, error) {
+	if len(conf.Backends) > channels {
+		return nil, fmt.Errorf("%d backend lists given for %d channels: each list must match the destination of its channel", len(conf.Backends), channels)
+	}
+
+	size := 0
+	for _, n := range []int{len(conf.IdleTimeout), len(conf.MaxLifetime), len(conf.MaxConnections), len(conf.Allow), len(conf.Deny), len(conf.UploadLimit), len(conf.DownloadLimit), len(conf.Capture),
+		len(conf.SourceTlsCert), len(conf.SourceTlsKey), len(conf.DestinationTls), len(conf.DestinationTlsName), len(conf.DestinationTlsCa), len(conf.ProxyProtocol),
+		len(conf.Backends), len(conf.LoadBalance)} {
+		if n > size {
+			size = n
+		}
+	}
+
+	// a single set of options would be applied to all channels, including its
+	// backends.
+	if len(conf.Backends) > 0 && channels > size {
+		size = channels
+	}
+
+	opts := make([]tunnel.ChannelOptions, size)
+	for i := range opts {
+		allow, err := tunnel.ParseCIDRList(stringAt(conf.Allow, i))
+		if err != nil {
+			return nil, err
+		}
+
+		deny, err := tunnel.ParseCIDRList(stringAt(conf.Deny, i))
+		if err != nil {
+			return nil, err
+		}
+
+		bw, err := parseBandwidth(stringAt(conf.UploadLimit, i), stringAt(conf.DownloadLimit, i))
+		if err != nil {
+			return nil, err
+		}
+
+		var sourceTLS, destinationTLS *tls.Config
+
+		cert, key := stringAt(conf.SourceTlsCert, i), stringAt(conf.SourceTlsKey, i)
+		if cert != "" || key != "" {
+			sourceTLS, err = tunnel.NewServerTLSConfig(cert, key)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if boolAt(conf.DestinationTls, i) {
+			destinationTLS, err = tunnel.NewClientTLSConfig(stringAt(conf.DestinationTlsName, i), stringAt(conf.DestinationTlsCa, i))
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		proxy, err := tunnel.ParseProxyProtocol(stringAt(conf.ProxyProtocol, i))
+		if err != nil {
+			return nil, err
+		}
+
+		balance, err := tunnel.ParseBalance(stringAt(conf.LoadBalance, i))
+		if err != nil {
+			return nil, err
+		}
+
+		var backends []string
+		if i < len(conf.Backends) {
+			backends = tunnel.ParseBackends(conf.Backends[i])
+		}
+
+		opts[i] = tunnel.ChannelOptions{
+			IdleTimeout:    durationAt(conf.IdleTimeout, i),
+			MaxLifetime:    durationAt(conf.MaxLifetime, i),
+			MaxConnections: intAt(conf.MaxConnections, i),
+			Allow:          allow,
+			Deny:           deny,
+			Bandwidth:      bw,
+			Capture:        stringAt(conf.Capture, i),
+			SourceTLS:      sourceTLS,
+			DestinationTLS: destinationTLS,
+			ProxyProtocol:  proxy,
+			Backends:       backends,
+			Balance:        balance,
+		}
+	}
+
+	return opts, nil
+}
+
+// tunnelBandwidth returns the rate limits shared by all channels of the
+// tunnel described by the given configuration.
+func tunnelBandwidth(conf *Configuration) (tunnel.Bandwidth, error) {
+	return parseBandwidth(conf.TotalUploadLimit, conf.TotalDownloadLimit)
+}
+
+// captureLimits returns the maximum size of each capture file and of all
+// capture files together described by the given configuration.
+func captureLimits(conf *Configuration) (fileSize, totalSize int64, err error) {
+	fileSize, err = tunnel.ParseSize(conf.CaptureMaxSize)
 	if err != nil {
-		log.Error(err)
-		return nil, err
+		return 0, 0, err
 	}
 
-	//TODO need to find a way to require the attributes below to be always set
-	// since they are not optional (functionality will break if they are not
-	// set and CLI parsing is the one setting the default values).
-	// That could be done by make them required in the constructor's signature or
-	// by creating a configuration struct for a tunnel object.
-	t.ConnectionRetries = conf.ConnectionRetries
-	t.WaitAndRetry = conf.WaitAndRetry
-	t.KeepAliveInterval = conf.KeepAliveInterval
+	totalSize, err = tunnel.ParseSize(conf.CaptureMaxTotalSize)
+	if err != nil {
+		return 0, 0, err
+	}
 
-	return t, nil
+	return fileSize, totalSize, nil
+}
+
+func parseBandwidth(upload, download string) (tunnel.Bandwidth, error) {
+	up, err := tunnel.ParseRate(upload)
+	if err != nil {
+		return tunnel.Bandwidth{}, err
+	}
+
+	down, err := tunnel.ParseRate(download)
+	if err != nil {
+		return tunnel.Bandwidth{}, err
+	}
+
+	return tunnel.Bandwidth{Upload: up, Download: down}, nil
+}
+
+// durationAt returns the duration set for the nth channel, which is the only
+// duration in the list when a single one is given.
+func durationAt(durations []time.Duration, n int) time.Duration {
+	if len(durations) == 1 {
+		return durations[0]
+	}
+
+	if n < len(durations) {
+		return durations[n]
+	}
+
+	return 0
+}
+
+// intAt returns the number set for the nth channel, which is the only number
+// in the list when a single one is given.
+func intAt(numbers []int, n int) int {
+	if len(numbers) == 1 {
+		return numbers[0]
+	}
+
+	if n < len(numbers) {
+		return numbers[n]
+	}
+
+	return 0
+}
+
+// boolAt returns the value set for the nth channel, which is the only value in
+// the list when a single one is given.
+func boolAt(values []bool, n int) bool {
+	if len(values) == 1 {
+		return values[0]
+	}
+
+	if n < len(values) {
+		return values[n]
+	}
+
+	return false
+}
+
+// stringAt returns the value set for the nth channel, which is the only value
+// in the list when a single one is given.
+func stringAt(values []string, n int) string {
+	if len(values) == 1 {
+		return values[0]
+	}
+
+	if n < len(values) {
+		return values[n]
+	}
+
+	return ""
 }
 
 // appendIdArg adds the id argument to the list of arguments passed by the user.
@@ -512,8 +1245,8 @@ func appendIdArg(id string, args []string) (newArgs []string) {
 
 	newArgs = make([]string, len(args)+2)
 	copy(newArgs, args)
-	newArgs[len(args)-2] = fmt.Sprintf("--%s", IdFlagName)
-	newArgs[len(args)-1] = id
+	newArgs[len(args)] = fmt.Sprintf("--%s", IdFlagName)
+	newArgs[len(args)+1] = id
 
 	return
 }
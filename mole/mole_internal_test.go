@@ -0,0 +1,88 @@
+package mole
+
+import (
+	"os/exec"
+	"reflect"
+	"testing"
+)
+
+func TestChannelOptionsBackends(t *testing.T) {
+	destination := AddressInputList{}
+	destination.Set("db1:5432")
+	destination.Set("cache1:6379")
+
+	conf := &Configuration{
+		Destination: destination,
+		Backends:    []string{"db2:5432,db3:5432"},
+	}
+
+	opts, err := channelOptions(conf, 2)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+
+	if len(opts) != 2 {
+		t.Errorf("unexpected number of channel options: want 2, got %d", len(opts))
+		return
+	}
+
+	if !reflect.DeepEqual(opts[0].Backends, []string{"db2:5432", "db3:5432"}) {
+		t.Errorf("unexpected backends for the first channel: %v", opts[0].Backends)
+	}
+
+	if len(opts[1].Backends) != 0 {
+		t.Errorf("second channel is not expected to have backends: %v", opts[1].Backends)
+	}
+
+	conf.Backends = []string{"db2:5432", "cache2:6379", "other:80"}
+
+	_, err = channelOptions(conf, 2)
+	if err == nil {
+		t.Errorf("more backend lists than channels are expected to be rejected")
+	}
+
+	// channels read from the ssh config file have no destination on the
+	// configuration, but may still have backends.
+	conf.Destination = AddressInputList{}
+	conf.Backends = []string{"db2:5432", "cache2:6379"}
+
+	opts, err = channelOptions(conf, 3)
+	if err != nil {
+		t.Errorf("unexpected error for channels read from the ssh config file: %v", err)
+		return
+	}
+
+	if len(opts) != 3 {
+		t.Errorf("unexpected number of channel options: want 3, got %d", len(opts))
+		return
+	}
+
+	if !reflect.DeepEqual(opts[1].Backends, []string{"cache2:6379"}) || len(opts[2].Backends) != 0 {
+		t.Errorf("unexpected backends for channels read from the ssh config file: %v", opts)
+	}
+}
+
+func TestStartExitCode(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected int
+	}{
+		{"mole-command-that-does-not-exist", 127},
+		{"./mole-command-that-does-not-exist", 127},
+		// directories can't be executed
+		{"/", 126},
+	}
+
+	for _, test := range tests {
+		err := exec.Command(test.name).Start()
+		if err == nil {
+			t.Errorf("command %s is not expected to start", test.name)
+			continue
+		}
+
+		if code := startExitCode(err); code != test.expected {
+			t.Errorf("unexpected exit code for %s: want %d, got %d: %v", test.name, test.expected, code, err)
+		}
+	}
+}
@@ -1,7 +1,9 @@
 package mole_test
 
 import (
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/davrodpin/mole/alias"
 	"github.com/davrodpin/mole/mole"
@@ -88,3 +90,52 @@ func TestAliasMerge(t *testing.T) {
 	}
 
 }
+
+func TestAliasChannelLimits(t *testing.T) {
+	conf := mole.Configuration{
+		Source:             mole.AddressInputList{},
+		KeepAliveInterval:  10 * time.Second,
+		IdleTimeout:        []time.Duration{5 * time.Minute, 0},
+		MaxLifetime:        []time.Duration{8 * time.Hour},
+		Allow:              []string{"192.168.1.0/24,10.0.0.1"},
+		UploadLimit:        []string{"512K", "0"},
+		TotalDownloadLimit: "2M",
+	}
+
+	al := conf.ParseAlias("example")
+
+	if !reflect.DeepEqual(al.IdleTimeout, []string{"5m0s", "0s"}) {
+		t.Errorf("unexpected alias idle timeout: %s", al.IdleTimeout)
+	}
+
+	if !reflect.DeepEqual(al.MaxLifetime, []string{"8h0m0s"}) {
+		t.Errorf("unexpected alias max lifetime: %s", al.MaxLifetime)
+	}
+
+	merged := mole.Configuration{}
+	err := merged.Merge(al, []string{})
+	if err != nil {
+		t.Errorf("error merging alias: %v", err)
+		return
+	}
+
+	if !reflect.DeepEqual(merged.IdleTimeout, conf.IdleTimeout) {
+		t.Errorf("idle timeout doesn't match: expected: %s, value: %s", conf.IdleTimeout, merged.IdleTimeout)
+	}
+
+	if !reflect.DeepEqual(merged.MaxLifetime, conf.MaxLifetime) {
+		t.Errorf("max lifetime doesn't match: expected: %s, value: %s", conf.MaxLifetime, merged.MaxLifetime)
+	}
+
+	if !reflect.DeepEqual(merged.Allow, conf.Allow) {
+		t.Errorf("allow list doesn't match: expected: %s, value: %s", conf.Allow, merged.Allow)
+	}
+
+	if !reflect.DeepEqual(merged.UploadLimit, conf.UploadLimit) {
+		t.Errorf("upload limit doesn't match: expected: %s, value: %s", conf.UploadLimit, merged.UploadLimit)
+	}
+
+	if merged.TotalDownloadLimit != conf.TotalDownloadLimit {
+		t.Errorf("total download limit doesn't match: expected: %s, value: %s", conf.TotalDownloadLimit, merged.TotalDownloadLimit)
+	}
+}
@@ -0,0 +1,73 @@
+package mole
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Ports returns the source address of the channels of an application
+// instance, given its id or alias, in the same order the channels were
+// configured.
+//
+// If a destination is given, only the source address of the channel
+// forwarding connections to it is returned. A destination given as ":<port>"
+// refers to 127.0.0.1, the same way it does when starting a tunnel.
+func Ports(id, destination string) ([]string, error) {
+	rt, err := ShowInstance(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if rt.Status != StatusRunning {
+		return nil, fmt.Errorf("instance %s is not running", id)
+	}
+
+	if destination == "" {
+		return rt.Source.List(), nil
+	}
+
+	source, err := rt.SourceOf(destination)
+	if err != nil {
+		return nil, err
+	}
+
+	return []string{source}, nil
+}
+
+// SourceOf returns the source address of the channel forwarding connections to
+// the given destination.
+func (rt Runtime) SourceOf(destination string) (string, error) {
+	if strings.HasPrefix(destination, ":") {
+		destination = "127.0.0.1" + destination
+	}
+
+	for i, d := range rt.Destination {
+		if d.Address() == destination && i < len(rt.Source) {
+			return rt.Source[i].Address(), nil
+		}
+	}
+
+	return "", fmt.Errorf("instance %s has no channel to destination %s", rt.Id, destination)
+}
+
+// Env returns the environment variables describing a running application
+// instance, given its id or alias, as shell export statements.
+func Env(id string) ([]string, error) {
+	rt, err := ShowInstance(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if rt.Status != StatusRunning {
+		return nil, fmt.Errorf("instance %s is not running", id)
+	}
+
+	var exports []string
+
+	for _, e := range rt.Environment() {
+		kv := strings.SplitN(e, "=", 2)
+		exports = append(exports, fmt.Sprintf("export %s='%s'", kv[0], strings.ReplaceAll(kv[1], "'", `'\''`)))
+	}
+
+	return exports, nil
+}
@@ -0,0 +1,89 @@
+package mole_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/davrodpin/mole/fsutils"
+	"github.com/davrodpin/mole/mole"
+)
+
+func TestPortsAndEnv(t *testing.T) {
+	id := "test-ports"
+
+	source := mole.AddressInputList{}
+	source.Set("127.0.0.1:54321")
+	source.Set("127.0.0.1:54322")
+
+	destination := mole.AddressInputList{}
+	destination.Set("db:5432")
+	destination.Set("127.0.0.1:80")
+
+	rt := mole.Runtime{
+		Configuration: mole.Configuration{
+			Id:          id,
+			Source:      source,
+			Destination: destination,
+		},
+	}
+
+	state, err := rt.ToToml()
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+
+	d := filepath.Join(home, ".mole", id)
+	os.MkdirAll(d, 0755)
+	ioutil.WriteFile(filepath.Join(d, fsutils.InstancePidFile), []byte(strconv.Itoa(os.Getpid())), 0644)
+	ioutil.WriteFile(filepath.Join(d, fsutils.InstanceStateFile), []byte(state), 0644)
+
+	tests := []struct {
+		destination string
+		expected    []string
+		fails       bool
+	}{
+		{"", []string{"127.0.0.1:54321", "127.0.0.1:54322"}, false},
+		{"db:5432", []string{"127.0.0.1:54321"}, false},
+		{":80", []string{"127.0.0.1:54322"}, false},
+		{"db:3306", nil, true},
+	}
+
+	for _, test := range tests {
+		ports, err := mole.Ports(id, test.destination)
+
+		if test.fails {
+			if err == nil {
+				t.Errorf("expected error for destination %s, got %v", test.destination, ports)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("unexpected error for destination %s: %v", test.destination, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(test.expected, ports) {
+			t.Errorf("unexpected ports for destination %s: want: %v, got: %v", test.destination, test.expected, ports)
+		}
+	}
+
+	env, err := mole.Env(id)
+	if err != nil {
+		t.Errorf("unexpected error retrieving environment: %v", err)
+	}
+
+	if len(env) == 0 || env[0] != "export MOLE_ID='test-ports'" {
+		t.Errorf("unexpected environment: %v", env)
+	}
+
+	_, err = mole.Ports("test-ports-missing", "")
+	if err == nil {
+		t.Errorf("expected error for an instance that is not running")
+	}
+}
@@ -0,0 +1,379 @@
+package mole
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"time"
+
+	"github.com/davrodpin/mole/alias"
+	"github.com/davrodpin/mole/fsutils"
+	"github.com/davrodpin/mole/tunnel"
+
+	ps "github.com/mitchellh/go-ps"
+	daemon "github.com/sevlyar/go-daemon"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// StopTimeout is the maximum time to wait for the process of an application
+	// instance to exit after being asked to terminate, before killing it, and
+	// then after being killed.
+	StopTimeout = 10 * time.Second
+)
+
+// Reload re-reads the alias the client was started from and applies the
+// differences to the running tunnel.
+//
+// Channels that are still present on the alias keep serving connections,
+// while changes to the keep alive interval or connection retries take effect
+// without reconnecting. The connection to the ssh server is only
+// re-established when the server or its authentication settings change.
+func (c *Client) Reload() error {
+	c.mu.Lock()
+	err := c.reload()
+	c.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return c.saveState()
+}
+
+// reload does the work of Reload.
+//
+// The caller must hold c.mu.
+func (c *Client) reload() error {
+	al, err := alias.Get(c.Conf.Id)
+	if err != nil {
+		return fmt.Errorf("instance %s can't be reloaded: %v", c.Conf.Id, err)
+	}
+
+	conf := *c.Conf
+
+	err = conf.Merge(al, []string{"detach"})
+	if err != nil {
+		return fmt.Errorf("instance %s can't be reloaded: %v", c.Conf.Id, err)
+	}
+
+	if conf.TunnelType != c.Conf.TunnelType {
+		return fmt.Errorf("instance %s can't be reloaded: tunnel type can't be changed from %s to %s, restart the instance instead", c.Conf.Id, c.Conf.TunnelType, conf.TunnelType)
+	}
+
+	if conf.Rpc != c.Conf.Rpc || conf.Http != c.Conf.Http {
+		log.WithFields(log.Fields{
+			"id": c.Conf.Id,
+		}).Warn("rpc and http settings can't be reloaded, restart the instance to apply them")
+	}
+
+	conf.Rpc = c.Conf.Rpc
+	conf.RpcAddress = c.Conf.RpcAddress
+	conf.Http = c.Conf.Http
+	conf.HttpAddress = c.Conf.HttpAddress
+
+	if conf.Verbose {
+		log.SetLevel(log.DebugLevel)
+	} else {
+		log.SetLevel(log.InfoLevel)
+	}
+
+	if c.Tunnel != nil {
+		source, destination, err := channelAddresses(&conf)
+		if err != nil {
+			return err
+		}
+
+		channels, err := c.Tunnel.ChannelCount(source, destination)
+		if err != nil {
+			return err
+		}
+
+		opts, err := channelOptions(&conf, channels)
+		if err != nil {
+			return err
+		}
+
+		policy, err := tunnel.ParseConnectionPolicy(conf.ConnectionPolicy)
+		if err != nil {
+			return err
+		}
+
+		bw, err := tunnelBandwidth(&conf)
+		if err != nil {
+			return err
+		}
+
+		captureFileSize, captureTotalSize, err := captureLimits(&conf)
+		if err != nil {
+			return err
+		}
+
+		if conf.Source.String() != c.Conf.Source.String() || conf.Destination.String() != c.Conf.Destination.String() {
+			err = c.Tunnel.SetChannels(source, destination)
+			if err != nil {
+				return err
+			}
+
+			log.WithFields(log.Fields{
+				"id": c.Conf.Id,
+			}).Info("tunnel channels reloaded")
+		}
+
+		c.Tunnel.SetChannelOptions(opts)
+		c.Tunnel.SetConnectionLimit(conf.MaxTotalConnections, policy)
+		c.Tunnel.SetBandwidth(bw)
+		c.Tunnel.SetCaptureLimits(captureFileSize, captureTotalSize)
+
+		c.Tunnel.SetConnectionRetries(conf.ConnectionRetries)
+		c.Tunnel.SetWaitAndRetry(conf.WaitAndRetry)
+		c.Tunnel.SetIdleDisconnect(conf.IdleDisconnect)
+		c.Tunnel.SetDialTimeout(conf.DialTimeout)
+
+		if conf.Lazy != c.Conf.Lazy {
+			log.WithFields(log.Fields{
+				"id": c.Conf.Id,
+			}).Warn("lazy mode can't be changed on a running instance, restart it for the change to take effect")
+
+			conf.Lazy = c.Conf.Lazy
+		}
+
+		if !reflect.DeepEqual(conf.UdpSource, c.Conf.UdpSource) || !reflect.DeepEqual(conf.UdpDestination, c.Conf.UdpDestination) ||
+			conf.UdpRelay != c.Conf.UdpRelay || conf.UdpTimeout != c.Conf.UdpTimeout {
+			log.WithFields(log.Fields{
+				"id": c.Conf.Id,
+			}).Warn("udp channels can't be changed on a running instance, restart it for the change to take effect")
+
+			conf.UdpSource = c.Conf.UdpSource
+			conf.UdpDestination = c.Conf.UdpDestination
+			conf.UdpRelay = c.Conf.UdpRelay
+			conf.UdpTimeout = c.Conf.UdpTimeout
+		}
+
+		if !reflect.DeepEqual(conf.HttpProxy, c.Conf.HttpProxy) || !reflect.DeepEqual(conf.HttpProxyAllow, c.Conf.HttpProxyAllow) {
+			log.WithFields(log.Fields{
+				"id": c.Conf.Id,
+			}).Warn("http proxy channels can't be changed on a running instance, restart it for the change to take effect")
+
+			conf.HttpProxy = c.Conf.HttpProxy
+			conf.HttpProxyAllow = c.Conf.HttpProxyAllow
+		}
+
+		if conf.HealthCheckInterval != c.Conf.HealthCheckInterval {
+			log.WithFields(log.Fields{
+				"id": c.Conf.Id,
+			}).Warn("health check interval can't be changed on a running instance, restart it for the change to take effect")
+
+			conf.HealthCheckInterval = c.Conf.HealthCheckInterval
+		}
+
+		if conf.KeepAliveInterval != c.Conf.KeepAliveInterval {
+			c.Tunnel.SetKeepAliveInterval(conf.KeepAliveInterval)
+		}
+
+		if serverChanged(c.Conf, &conf) {
+			s, err := createServer(&conf)
+			if err != nil {
+				return err
+			}
+
+			log.WithFields(log.Fields{
+				"id":     c.Conf.Id,
+				"server": s,
+			}).Info("ssh server settings changed, reconnecting")
+
+			c.Tunnel.SetServer(s)
+		}
+	}
+
+	*c.Conf = conf
+
+	return nil
+}
+
+// handleReload reloads the client configuration every time the process
+// receives a SIGHUP.
+func (c *Client) handleReload() {
+	signal.Notify(c.reloadSigs, syscall.SIGHUP)
+
+	for sig := range c.reloadSigs {
+		log.Debugf("process signal %s received", sig)
+
+		err := c.Reload()
+		if err != nil {
+			log.WithError(err).Error("instance not reloaded")
+		}
+	}
+}
+
+// Reload asks a running application instance, given its id or alias, to
+// reload its alias configuration.
+func Reload(id string) error {
+	p, err := process(id)
+	if err != nil {
+		return err
+	}
+
+	return p.Signal(syscall.SIGHUP)
+}
+
+// Restart stops a running application instance, given its id or alias, and
+// starts it again in background.
+//
+// The instance is started using the alias with the same name, so any change
+// made to the alias is applied, or the configuration persisted on its state
+// file if there is no such alias.
+func Restart(id string) error {
+	conf, err := restartConfiguration(id)
+	if err != nil {
+		return err
+	}
+
+	// the restart command is executed again by the detached child process,
+	// which must not stop anything.
+	if !daemon.WasReborn() {
+		err = terminate(id)
+		if err != nil {
+			return err
+		}
+	}
+
+	conf.Detach = true
+
+	return New(conf).Start()
+}
+
+func restartConfiguration(id string) (*Configuration, error) {
+	conf := &Configuration{}
+
+	al, err := alias.Get(id)
+	if err == nil {
+		err = conf.Merge(al, []string{})
+		if err != nil {
+			return nil, err
+		}
+
+		return conf, nil
+	}
+
+	rt, err := loadState(id)
+	if err != nil {
+		return nil, fmt.Errorf("can't restart instance %s: no alias or state could be found: %v", id, err)
+	}
+
+	conf = &rt.Configuration
+	conf.Id = id
+
+	return conf, nil
+}
+
+// terminate asks the process of an application instance to terminate,
+// killing it if it doesn't exit within StopTimeout, and removes the files that
+// only make sense while it is running, keeping its state and log files.
+func terminate(id string) error {
+	p, err := process(id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"id": id,
+		}).WithError(err).Debug("instance is not running")
+	} else {
+		err = p.Signal(syscall.SIGTERM)
+		if err != nil {
+			return err
+		}
+
+		exited, err := waitExit(p.Pid, StopTimeout)
+		if err != nil {
+			return err
+		}
+
+		if !exited {
+			log.WithFields(log.Fields{
+				"id":  id,
+				"pid": p.Pid,
+			}).Warnf("instance did not terminate after %s, killing it", StopTimeout)
+
+			err = p.Kill()
+			if err != nil {
+				return err
+			}
+
+			exited, err = waitExit(p.Pid, StopTimeout)
+			if err != nil {
+				return err
+			}
+
+			if !exited {
+				return fmt.Errorf("instance %s did not stop after being killed", id)
+			}
+		}
+	}
+
+	d, err := fsutils.InstanceDir(id)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range []string{d.PidFile, filepath.Join(d.Dir, "rpc"), filepath.Join(d.Dir, "http")} {
+		err = os.Remove(f)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// waitExit waits up to the given timeout for the process with the given pid to
+// exit, telling whether it did.
+func waitExit(pid int, timeout time.Duration) (bool, error) {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		p, err := ps.FindProcess(pid)
+		if err != nil {
+			return false, err
+		}
+
+		if p == nil {
+			return true, nil
+		}
+
+		if time.Now().After(deadline) {
+			return false, nil
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// process returns the process of a running application instance.
+func process(id string) (*os.Process, error) {
+	r, err := running(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if !r {
+		return nil, fmt.Errorf("no instance of mole with id %s is running", id)
+	}
+
+	pid, err := pid(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.FindProcess(pid)
+}
+
+func serverChanged(current, updated *Configuration) bool {
+	return current.Server != updated.Server ||
+		current.Key != updated.Key ||
+		current.SshAgent != updated.SshAgent ||
+		current.Insecure != updated.Insecure ||
+		current.Timeout != updated.Timeout ||
+		current.SshConfig != updated.SshConfig
+}
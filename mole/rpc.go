@@ -13,25 +13,65 @@ import (
 
 func init() {
 	rpc.Register("show-instance", ShowRpc)
+	rpc.Register("show-instances", ShowAllRpc)
+	rpc.Register("reload", ReloadRpc)
+	rpc.Register("set-bandwidth", SetBandwidthRpc)
 }
 
 // ShowRpc is a rpc callback that returns runtime information about the mole client.
-func ShowRpc(params interface{}) (json.RawMessage, error) {
+func ShowRpc() (*Runtime, error) {
 	if cli == nil {
 		return nil, fmt.Errorf("client configuration could not be found.")
 	}
 
-	runtime, err := cli.Runtime()
+	return cli.Runtime()
+}
+
+// InstancesResult is the result of the show-instances rpc method. The list of
+// instances is wrapped in an object since rpc results are decoded as objects.
+type InstancesResult struct {
+	Instances InstancesRuntime `json:"instances"`
+}
+
+// ShowAllRpc is a rpc callback that returns runtime information about all
+// mole instances running on the system.
+func ShowAllRpc() (*InstancesResult, error) {
+	instances, err := ShowInstances()
+	if err != nil {
+		return nil, err
+	}
+
+	return &InstancesResult{Instances: *instances}, nil
+}
+
+// ReloadRpc is a rpc callback that reloads the alias configuration of the
+// mole client, returning its updated runtime information.
+func ReloadRpc() (*Runtime, error) {
+	if cli == nil {
+		return nil, fmt.Errorf("client configuration could not be found.")
+	}
+
+	err := cli.Reload()
 	if err != nil {
 		return nil, err
 	}
 
-	cj, err := json.Marshal(runtime)
+	return cli.Runtime()
+}
+
+// SetBandwidthRpc is a rpc callback that changes the rate limits of the mole
+// client, returning its updated runtime information.
+func SetBandwidthRpc(params BandwidthParams) (*Runtime, error) {
+	if cli == nil {
+		return nil, fmt.Errorf("client configuration could not be found.")
+	}
+
+	err := cli.SetBandwidth(params)
 	if err != nil {
 		return nil, err
 	}
 
-	return json.RawMessage(cj), nil
+	return cli.Runtime()
 }
 
 // Rpc calls a remote procedure on another mole instance given its id or alias.
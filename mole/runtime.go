@@ -5,11 +5,27 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/davrodpin/mole/fsutils"
+	"github.com/davrodpin/mole/tunnel"
 	ps "github.com/mitchellh/go-ps"
+	"github.com/mitchellh/mapstructure"
+)
+
+const (
+	// StatusRunning is the status of an application instance which process is
+	// alive.
+	StatusRunning = "running"
+
+	// StatusStale is the status of an application instance which files are
+	// still on the file system but which process is gone, usually because it
+	// crashed or was killed.
+	StatusStale = "stale"
 )
 
 type Formatter interface {
@@ -17,7 +33,25 @@ type Formatter interface {
 }
 
 // Runtime holds runtime data about an application instance.
-type Runtime Configuration
+type Runtime struct {
+	Configuration `mapstructure:",squash"`
+
+	// Pid is the process identifier of the application instance.
+	Pid int `json:"pid" mapstructure:"pid" toml:"pid"`
+
+	// StartedAt is the time the application instance was started.
+	StartedAt time.Time `json:"started-at" mapstructure:"started-at" toml:"started-at"`
+
+	// Status tells if the application instance process is alive.
+	Status string `json:"status" mapstructure:"status" toml:"status"`
+
+	// Ready tells if the application instance is connected to the ssh server
+	// and all of its channels are ready to accept connections.
+	Ready bool `json:"ready" mapstructure:"ready" toml:"ready"`
+
+	// Stats holds connection counters for each channel.
+	Stats []tunnel.ChannelStats `json:"stats" mapstructure:"stats" toml:"stats"`
+}
 
 // Format parses a Runtime object into a string representation based on the given
 // format (i.e. toml).
@@ -69,13 +103,24 @@ func (ir InstancesRuntime) ToToml() (string, error) {
 }
 
 func (c *Client) Runtime() (*Runtime, error) {
-	runtime := Runtime(*c.Conf)
+	c.mu.Lock()
+	runtime := Runtime{
+		Configuration: *c.Conf,
+		Pid:           os.Getpid(),
+		StartedAt:     c.startedAt,
+		Status:        StatusRunning,
+	}
+	t := c.Tunnel
+	c.mu.Unlock()
+
+	if t != nil {
+		runtime.Ready = t.IsReady()
+		runtime.Stats = t.Stats()
 
-	if c.Tunnel != nil {
 		source := &AddressInputList{}
 		destination := &AddressInputList{}
 
-		for _, channel := range c.Tunnel.Channels() {
+		for _, channel := range t.Channels() {
 			var err error
 
 			err = source.Set(channel.Source)
@@ -99,7 +144,99 @@ func (c *Client) Runtime() (*Runtime, error) {
 
 // Running checks if an instance of mole is running on the system.
 func (c *Client) Running() (bool, error) {
-	d, err := fsutils.InstanceDir(c.Conf.Id)
+	return running(c.Conf.Id)
+}
+
+// saveState persists the runtime information of the client to the instance
+// state file, so it can be retrieved by other processes even when the rpc
+// server is disabled.
+func (c *Client) saveState() error {
+	rt, err := c.Runtime()
+	if err != nil {
+		return err
+	}
+
+	s, err := rt.ToToml()
+	if err != nil {
+		return err
+	}
+
+	sfl, err := fsutils.GetStateFileLocation(rt.Id)
+	if err != nil {
+		return err
+	}
+
+	// the state file is written to a temporary file first and then renamed, so
+	// readers never see a partially written state.
+	tmp, err := ioutil.TempFile(filepath.Dir(sfl), fmt.Sprintf("%s.*", fsutils.InstanceStateFile))
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.WriteString(s)
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), sfl)
+}
+
+// loadState reads the runtime information persisted by an application
+// instance, updating its status based on whether its process is alive.
+func loadState(id string) (*Runtime, error) {
+	sfl, err := fsutils.GetStateFileLocation(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var rt Runtime
+	if _, err := toml.DecodeFile(sfl, &rt); err != nil {
+		return nil, err
+	}
+
+	r, err := running(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if r {
+		rt.Status = StatusRunning
+	} else {
+		rt.Status = StatusStale
+	}
+
+	return &rt, nil
+}
+
+// decodeRuntime decodes the generic representation of a Runtime (e.g. the
+// response of a remote procedure call) into output.
+func decodeRuntime(input, output interface{}) error {
+	d, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.StringToTimeHookFunc(time.RFC3339Nano),
+		Result:     output,
+	})
+	if err != nil {
+		return err
+	}
+
+	return d.Decode(input)
+}
+
+// running checks if the process recorded on the pid file of an application
+// instance is alive and is an instance of mole.
+//
+// Process identifiers are reused by the operating system, so a pid file left
+// behind by an instance that crashed may point to an unrelated process.
+func running(id string) (bool, error) {
+	d, err := fsutils.InstanceDir(id)
 	if err != nil {
 		return false, err
 	}
@@ -108,24 +245,106 @@ func (c *Client) Running() (bool, error) {
 		return false, nil
 	}
 
-	pd, err := ioutil.ReadFile(d.PidFile)
+	pid, err := pid(id)
 	if err != nil {
+		if _, ok := err.(*strconv.NumError); ok {
+			// a pid file that can't be parsed was most likely truncated by a process
+			// that didn't exit cleanly.
+			return false, nil
+		}
+
 		return false, err
 	}
 
-	pid, err := strconv.Atoi(string(pd))
+	p, err := ps.FindProcess(pid)
 	if err != nil {
 		return false, err
 	}
 
-	ps, err := ps.FindProcess(pid)
+	if p == nil {
+		return false, nil
+	}
+
+	return isMole(p)
+}
+
+// stale tells if the pid file of an application instance points to a process
+// that is gone or is not an instance of mole, or if the instance has no pid
+// file but left its state file behind, since instances that stop cleanly
+// remove both. Instances with a pid file that can't be parsed are not stale:
+// they are still being created.
+func stale(id string) (bool, error) {
+	pid, err := pid(id)
 	if err != nil {
+		if os.IsNotExist(err) {
+			sfl, err := fsutils.GetStateFileLocation(id)
+			if err != nil {
+				return false, err
+			}
+
+			_, err = os.Stat(sfl)
+			if os.IsNotExist(err) {
+				return false, nil
+			}
+
+			return err == nil, err
+		}
+
+		if _, ok := err.(*strconv.NumError); ok {
+			return false, nil
+		}
+
 		return false, err
 	}
 
-	if ps == nil {
-		return false, nil
+	p, err := ps.FindProcess(pid)
+	if err != nil {
+		return false, err
+	}
+
+	if p == nil {
+		return true, nil
+	}
+
+	m, err := isMole(p)
+	if err != nil {
+		return false, err
+	}
+
+	return !m, nil
+}
+
+// pid returns the process id recorded on the pid file of an application
+// instance.
+func pid(id string) (int, error) {
+	d, err := fsutils.InstanceDir(id)
+	if err != nil {
+		return -1, err
+	}
+
+	pd, err := ioutil.ReadFile(d.PidFile)
+	if err != nil {
+		return -1, err
+	}
+
+	return strconv.Atoi(strings.TrimSpace(string(pd)))
+}
+
+// isMole tells if the given process runs the same executable as the current
+// process.
+func isMole(p ps.Process) (bool, error) {
+	if p.Pid() == os.Getpid() {
+		return true, nil
+	}
+
+	self, err := ps.FindProcess(os.Getpid())
+	if err != nil {
+		return false, err
+	}
+
+	if self == nil {
+		return false, fmt.Errorf("could not find information about the current process")
 	}
 
-	return true, nil
+	return p.Executable() == self.Executable(), nil
 }
@@ -1,11 +1,19 @@
 package mole_test
 
 import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/davrodpin/mole/fsutils"
 	"github.com/davrodpin/mole/mole"
+	"github.com/davrodpin/mole/rpc"
 
 	"github.com/andreyvit/diff"
 )
@@ -24,6 +32,24 @@ timeout = 0
 ssh-config = ""
 rpc = false
 rpc-address = ""
+http = false
+http-address = ""
+lazy = false
+idle-disconnect = 0
+max-total-connections = 0
+connection-policy = ""
+dial-timeout = 0
+total-upload-limit = ""
+total-download-limit = ""
+capture-max-size = ""
+capture-max-total-size = ""
+udp-relay = ""
+udp-timeout = 0
+health-check-interval = 0
+pid = 0
+started-at = 0001-01-01T00:00:00Z
+status = ""
+ready = false
 
 [server]
   user = ""
@@ -46,6 +72,24 @@ const expectedMultipleInstances string = `[instances]
     ssh-config = ""
     rpc = false
     rpc-address = ""
+    http = false
+    http-address = ""
+    lazy = false
+    idle-disconnect = 0
+    max-total-connections = 0
+    connection-policy = ""
+    dial-timeout = 0
+    total-upload-limit = ""
+    total-download-limit = ""
+    capture-max-size = ""
+    capture-max-total-size = ""
+    udp-relay = ""
+    udp-timeout = 0
+    health-check-interval = 0
+    pid = 0
+    started-at = 0001-01-01T00:00:00Z
+    status = ""
+    ready = false
     [instances.id1.server]
       user = ""
       host = ""
@@ -65,6 +109,24 @@ const expectedMultipleInstances string = `[instances]
     ssh-config = ""
     rpc = false
     rpc-address = ""
+    http = false
+    http-address = ""
+    lazy = false
+    idle-disconnect = 0
+    max-total-connections = 0
+    connection-policy = ""
+    dial-timeout = 0
+    total-upload-limit = ""
+    total-download-limit = ""
+    capture-max-size = ""
+    capture-max-total-size = ""
+    udp-relay = ""
+    udp-timeout = 0
+    health-check-interval = 0
+    pid = 0
+    started-at = 0001-01-01T00:00:00Z
+    status = ""
+    ready = false
     [instances.id2.server]
       user = ""
       host = ""
@@ -72,8 +134,8 @@ const expectedMultipleInstances string = `[instances]
 
 func TestFormatRuntimeToML(t *testing.T) {
 	instances := []mole.Runtime{
-		mole.Runtime{Id: "id1"},
-		mole.Runtime{Id: "id2"},
+		mole.Runtime{Configuration: mole.Configuration{Id: "id1"}},
+		mole.Runtime{Configuration: mole.Configuration{Id: "id2"}},
 	}
 
 	runtimes := mole.InstancesRuntime(instances)
@@ -82,7 +144,7 @@ func TestFormatRuntimeToML(t *testing.T) {
 		formatter mole.Formatter
 		expected  string
 	}{
-		{formatter: mole.Runtime{Id: "id1"}, expected: expectedInstance},
+		{formatter: mole.Runtime{Configuration: mole.Configuration{Id: "id1"}}, expected: expectedInstance},
 		{formatter: runtimes, expected: expectedMultipleInstances},
 	}
 
@@ -120,3 +182,196 @@ func TestClientRunning(t *testing.T) {
 		t.Errorf("client was supposed to be running")
 	}
 }
+
+func TestShowInstanceFromStateFile(t *testing.T) {
+	tests := []struct {
+		id             string
+		pid            string
+		expectedStatus string
+	}{
+		{id: "test-state-running", pid: strconv.Itoa(os.Getpid()), expectedStatus: mole.StatusRunning},
+		{id: "test-state-stopped", pid: "999999999", expectedStatus: mole.StatusStale},
+	}
+
+	for _, test := range tests {
+		rt := mole.Runtime{
+			Configuration: mole.Configuration{Id: test.id, TunnelType: "local"},
+			StartedAt:     time.Date(2021, 9, 28, 10, 0, 0, 0, time.UTC),
+		}
+
+		state, err := rt.ToToml()
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+
+		d := filepath.Join(home, ".mole", test.id)
+		os.MkdirAll(d, 0755)
+		ioutil.WriteFile(filepath.Join(d, fsutils.InstancePidFile), []byte(test.pid), 0644)
+		ioutil.WriteFile(filepath.Join(d, fsutils.InstanceStateFile), []byte(state), 0644)
+
+		r, err := mole.ShowInstance(test.id)
+		if err != nil {
+			t.Errorf("error showing instance %s: %v", test.id, err)
+			continue
+		}
+
+		if r.Id != test.id || r.TunnelType != "local" || !r.StartedAt.Equal(rt.StartedAt) {
+			t.Errorf("unexpected runtime for instance %s: %+v", test.id, r)
+		}
+
+		if r.Status != test.expectedStatus {
+			t.Errorf("unexpected status for instance %s: want: %s, got: %s", test.id, test.expectedStatus, r.Status)
+		}
+	}
+}
+
+func TestPrune(t *testing.T) {
+	tests := []struct {
+		id  string
+		pid string
+		// noPid creates the instance directory without a pid file.
+		noPid  bool
+		state  bool
+		log    bool
+		pruned bool
+	}{
+		{id: "test-prune-running", pid: strconv.Itoa(os.Getpid()), state: true, pruned: false},
+		{id: "test-prune-gone", pid: "999999999", state: true, pruned: true},
+		{id: "test-prune-reused", pid: "1", state: true, pruned: true},
+		{id: "test-prune-gone-with-logs", pid: "999999999", state: true, log: true, pruned: true},
+		{id: "test-prune-starting", pid: "", pruned: false},
+		{id: "test-prune-stopped", noPid: true, log: true, pruned: false},
+		{id: "test-prune-left-behind", noPid: true, state: true, log: true, pruned: true},
+		{id: "test-prune-not-an-instance", noPid: true, pruned: false},
+	}
+
+	// marker is a file on every directory, removed only if it is pruned.
+	marker := "marker"
+
+	for _, test := range tests {
+		d := filepath.Join(home, ".mole", test.id)
+		os.MkdirAll(d, 0755)
+		ioutil.WriteFile(filepath.Join(d, marker), []byte(marker), 0644)
+
+		if test.state {
+			ioutil.WriteFile(filepath.Join(d, fsutils.InstanceStateFile), []byte("state"), 0644)
+		}
+
+		if !test.noPid {
+			ioutil.WriteFile(filepath.Join(d, fsutils.InstancePidFile), []byte(test.pid), 0644)
+		}
+
+		if test.log {
+			ioutil.WriteFile(filepath.Join(d, fsutils.InstanceLogFile), []byte("log"), 0644)
+		}
+	}
+
+	_, err := mole.Prune()
+	if err != nil {
+		t.Errorf("error pruning stale instances: %v", err)
+	}
+
+	for _, test := range tests {
+		d := filepath.Join(home, ".mole", test.id)
+		_, err := os.Stat(filepath.Join(d, marker))
+
+		if test.pruned && !os.IsNotExist(err) {
+			t.Errorf("stale instance %s was not removed", test.id)
+		}
+
+		if !test.pruned && err != nil {
+			t.Errorf("instance %s was removed: %v", test.id, err)
+		}
+
+		_, err = os.Stat(filepath.Join(d, fsutils.InstanceLogFile))
+		if test.log && err != nil {
+			t.Errorf("log file of instance %s was removed: %v", test.id, err)
+		}
+
+		_, err = os.Stat(d)
+		if test.pruned && !test.log && !os.IsNotExist(err) {
+			t.Errorf("directory of stale instance %s was not removed", test.id)
+		}
+	}
+}
+
+func TestStopDetached(t *testing.T) {
+	id := "test-stop-detached"
+
+	cmd := exec.Command("sleep", "10")
+	err := cmd.Start()
+	if err != nil {
+		t.Errorf("error starting process: %v", err)
+		return
+	}
+	defer cmd.Process.Kill()
+
+	d := filepath.Join(home, ".mole", id)
+	os.MkdirAll(d, 0755)
+	ioutil.WriteFile(filepath.Join(d, fsutils.InstancePidFile), []byte(strconv.Itoa(cmd.Process.Pid)), 0644)
+
+	for _, f := range []string{fsutils.InstanceStateFile, "rpc", "http", fsutils.InstanceLogFile} {
+		ioutil.WriteFile(filepath.Join(d, f), []byte(f), 0644)
+	}
+
+	err = mole.New(&mole.Configuration{Id: id, Detach: true}).Stop()
+	if err != nil {
+		t.Errorf("error stopping instance: %v", err)
+		return
+	}
+
+	for _, f := range []string{fsutils.InstancePidFile, fsutils.InstanceStateFile, "rpc", "http"} {
+		if _, err := os.Stat(filepath.Join(d, f)); !os.IsNotExist(err) {
+			t.Errorf("file %s of stopped instance was not removed", f)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(d, fsutils.InstanceLogFile)); err != nil {
+		t.Errorf("log file of stopped instance was removed: %v", err)
+	}
+
+	// an instance that stopped cleanly is not shown as stale.
+	if rt, err := mole.ShowInstance(id); err == nil {
+		t.Errorf("stopped instance is not expected to be shown: status %s", rt.Status)
+	}
+}
+
+func TestShowInstancesRpc(t *testing.T) {
+	id := "test-show-instances-rpc"
+
+	rt := mole.Runtime{Configuration: mole.Configuration{Id: id, TunnelType: "local"}}
+
+	state, err := rt.ToToml()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	d := filepath.Join(home, ".mole", id)
+	os.MkdirAll(d, 0755)
+	ioutil.WriteFile(filepath.Join(d, fsutils.InstancePidFile), []byte(strconv.Itoa(os.Getpid())), 0644)
+	ioutil.WriteFile(filepath.Join(d, fsutils.InstanceStateFile), []byte(state), 0644)
+	defer os.RemoveAll(d)
+
+	addr, err := rpc.Start(rpc.DefaultAddress)
+	if err != nil {
+		t.Fatalf("error initializing rpc server: %v", err)
+	}
+
+	resp, err := rpc.Call(context.Background(), addr.String(), "show-instances", nil)
+	if err != nil {
+		t.Fatalf("error calling show-instances: %v", err)
+	}
+
+	instances, ok := resp["instances"].([]interface{})
+	if !ok {
+		t.Fatalf("unexpected show-instances response: %v", resp)
+	}
+
+	for _, i := range instances {
+		if r, ok := i.(map[string]interface{}); ok && r["id"] == id {
+			return
+		}
+	}
+
+	t.Errorf("instance %s not found on show-instances response: %v", id, resp)
+}
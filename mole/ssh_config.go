@@ -0,0 +1,99 @@
+package mole
+
+import (
+	"fmt"
+
+	"github.com/davrodpin/mole/alias"
+	"github.com/davrodpin/mole/tunnel"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// AliasesFromSSHConfig converts the hosts declared on a ssh config file that
+// match the given host name or pattern into aliases.
+//
+// Every LocalForward and RemoteForward line of a host becomes a channel of
+// the alias, while its user, port, identity file and identity agent are used
+// to build the server settings. Hosts declaring both local and remote
+// forwards produce two aliases, the one holding the remote forwards being
+// suffixed by "-remote". Hosts without any forward are skipped.
+//
+// Any other attribute of the aliases is taken from defaults.
+func AliasesFromSSHConfig(configPath, pattern string, defaults Configuration) ([]*alias.Alias, error) {
+	cfg, err := tunnel.NewSSHConfigFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	hosts, err := cfg.Hosts(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	aliases := []*alias.Alias{}
+
+	for _, host := range hosts {
+		h := cfg.Get(host)
+
+		if len(h.LocalForwards) == 0 && len(h.RemoteForwards) == 0 {
+			log.WithFields(log.Fields{
+				"host": host,
+			}).Warn("ssh config host has no forwarding configuration, skipping it")
+			continue
+		}
+
+		name := host
+
+		if len(h.LocalForwards) > 0 {
+			conf, err := sshHostConfiguration(host, "local", h, h.LocalForwards, configPath, defaults)
+			if err != nil {
+				return nil, err
+			}
+
+			aliases = append(aliases, conf.ParseAlias(name))
+			name = fmt.Sprintf("%s-remote", host)
+		}
+
+		if len(h.RemoteForwards) > 0 {
+			conf, err := sshHostConfiguration(host, "remote", h, h.RemoteForwards, configPath, defaults)
+			if err != nil {
+				return nil, err
+			}
+
+			aliases = append(aliases, conf.ParseAlias(name))
+		}
+	}
+
+	return aliases, nil
+}
+
+func sshHostConfiguration(host, tunnelType string, h *tunnel.SSHHost, forwards []*tunnel.ForwardConfig, configPath string, defaults Configuration) (*Configuration, error) {
+	conf := defaults
+	conf.TunnelType = tunnelType
+	conf.Key = h.Key
+	conf.SshAgent = h.IdentityAgent
+	conf.SshConfig = configPath
+	conf.Source = AddressInputList{}
+	conf.Destination = AddressInputList{}
+
+	hostname := h.Hostname
+	if hostname == "" {
+		hostname = host
+	}
+
+	conf.Server = AddressInput{User: h.User, Host: hostname, Port: h.Port}
+
+	for _, f := range forwards {
+		err := conf.Source.Set(f.Source)
+		if err != nil {
+			return nil, fmt.Errorf("invalid forward source %s for host %s: %v", f.Source, host, err)
+		}
+
+		err = conf.Destination.Set(f.Destination)
+		if err != nil {
+			return nil, fmt.Errorf("invalid forward destination %s for host %s: %v", f.Destination, host, err)
+		}
+	}
+
+	return &conf, nil
+}
@@ -0,0 +1,94 @@
+package mole
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/davrodpin/mole/fsutils"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// WaitInterval is the time between consecutive checks of the state of an
+	// application instance while waiting for it to be ready.
+	WaitInterval = 100 * time.Millisecond
+)
+
+// Wait blocks until the application instance, given its id or alias, is
+// connected to the ssh server and all of its channels are ready to accept
+// connections, returning its runtime information.
+//
+// An instance that is still starting (e.g. right after `start --detach`
+// returns) is waited for. An error is returned right away if the instance is
+// not running, if it stops running before being ready, or if it is not ready
+// within the given timeout. A timeout of zero waits forever.
+func Wait(id string, timeout time.Duration) (*Runtime, error) {
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		deadline = time.After(timeout)
+	}
+
+	ticker := time.NewTicker(WaitInterval)
+	defer ticker.Stop()
+
+	seen := false
+
+	for {
+		alive, err := exists(id)
+		if err != nil {
+			return nil, err
+		}
+
+		if !alive {
+			if seen {
+				return nil, fmt.Errorf("instance %s stopped before being ready", id)
+			}
+
+			return nil, fmt.Errorf("instance %s is not running", id)
+		}
+
+		rt, err := ShowInstance(id)
+
+		switch {
+		case err != nil:
+			log.WithFields(log.Fields{
+				"id": id,
+			}).WithError(err).Debug("instance information not available yet")
+		case rt.Status == StatusRunning:
+			if rt.Ready {
+				return rt, nil
+			}
+
+			seen = true
+		}
+
+		select {
+		case <-deadline:
+			return nil, fmt.Errorf("instance %s was not ready after %s", id, timeout)
+		case <-ticker.C:
+		}
+	}
+}
+
+// exists tells if an application instance is either running or still being
+// started, which is the case while its pid file exists and doesn't point to a
+// process that is gone or is not an instance of mole.
+func exists(id string) (bool, error) {
+	d, err := fsutils.InstanceDir(id)
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := os.Stat(d.PidFile); os.IsNotExist(err) {
+		return false, nil
+	}
+
+	st, err := stale(id)
+	if err != nil {
+		return false, err
+	}
+
+	return !st, nil
+}
@@ -0,0 +1,81 @@
+package mole_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/davrodpin/mole/fsutils"
+	"github.com/davrodpin/mole/mole"
+)
+
+func TestWait(t *testing.T) {
+	tests := []struct {
+		id    string
+		pid   string
+		ready bool
+		fails bool
+	}{
+		{id: "test-wait-ready", pid: strconv.Itoa(os.Getpid()), ready: true, fails: false},
+		{id: "test-wait-not-ready", pid: strconv.Itoa(os.Getpid()), ready: false, fails: true},
+		{id: "test-wait-stale", pid: "999999999", ready: true, fails: true},
+		{id: "test-wait-missing", fails: true},
+	}
+
+	for _, test := range tests {
+		if test.pid != "" {
+			rt := mole.Runtime{
+				Configuration: mole.Configuration{Id: test.id},
+				Ready:         test.ready,
+			}
+
+			state, err := rt.ToToml()
+			if err != nil {
+				t.Errorf(err.Error())
+			}
+
+			d := filepath.Join(home, ".mole", test.id)
+			os.MkdirAll(d, 0755)
+			ioutil.WriteFile(filepath.Join(d, fsutils.InstancePidFile), []byte(test.pid), 0644)
+			ioutil.WriteFile(filepath.Join(d, fsutils.InstanceStateFile), []byte(state), 0644)
+		}
+
+		_, err := mole.Wait(test.id, 300*time.Millisecond)
+
+		if test.fails && err == nil {
+			t.Errorf("expected wait for instance %s to fail", test.id)
+		}
+
+		if !test.fails && err != nil {
+			t.Errorf("unexpected error waiting for instance %s: %v", test.id, err)
+		}
+	}
+}
+
+func TestWaitNotRunning(t *testing.T) {
+	d := filepath.Join(home, ".mole", "test-wait-gone")
+	os.MkdirAll(d, 0755)
+	ioutil.WriteFile(filepath.Join(d, fsutils.InstancePidFile), []byte("999999999"), 0644)
+
+	// instances that are not running are not waited for, even without timeout.
+	for _, id := range []string{"test-wait-gone", "test-wait-unknown"} {
+		errc := make(chan error, 1)
+
+		go func(id string) {
+			_, err := mole.Wait(id, 0)
+			errc <- err
+		}(id)
+
+		select {
+		case err := <-errc:
+			if err == nil {
+				t.Errorf("expected wait for instance %s to fail", id)
+			}
+		case <-time.After(1 * time.Second):
+			t.Errorf("wait for instance %s is expected to fail right away", id)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package rpc
 
 import (
 	"context"
+	"errors"
 	"net"
 	"os"
 	"path/filepath"
@@ -45,6 +46,9 @@ func CallById(context context.Context, id, method string, params interface{}) (m
 
 // Call initiates a JSON-RPC call to a given rpc server address, using the
 // specified method and waits for the response.
+//
+// If the remote procedure fails, the error returned is an *Error holding the
+// code and message sent by the server.
 func Call(ctx context.Context, addr, method string, params interface{}) (map[string]interface{}, error) {
 	tc, err := net.Dial("tcp", addr)
 	if err != nil {
@@ -54,10 +58,16 @@ func Call(ctx context.Context, addr, method string, params interface{}) (map[str
 	stream := jsonrpc2.NewBufferedStream(tc, jsonrpc2.VarintObjectCodec{})
 	h := &Handler{}
 	conn := jsonrpc2.NewConn(ctx, stream, h)
+	defer conn.Close()
 
 	var r map[string]interface{}
 	err = conn.Call(ctx, method, params, &r)
 	if err != nil {
+		var jerr *jsonrpc2.Error
+		if errors.As(err, &jerr) {
+			return nil, &Error{Code: jerr.Code, Message: jerr.Message}
+		}
+
 		return nil, err
 	}
 
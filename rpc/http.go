@@ -0,0 +1,207 @@
+package rpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// HttpMethodPrefix is the url path prefix used to call registered methods
+	// through the http gateway (e.g. POST /rpc/show-instance).
+	HttpMethodPrefix = "/rpc/"
+)
+
+// httpRoutes maps read-only http endpoints to registered methods.
+var httpRoutes = map[string]string{
+	"/instance":  "show-instance",
+	"/instances": "show-instances",
+}
+
+// StartHTTP initializes a http server that exposes all registered methods
+// as JSON over HTTP. The server will be waiting for connections on a random
+// port if no address is given.
+//
+// The following endpoints are available:
+//
+//	GET  /rpc              lists the name of all registered methods
+//	POST /rpc/<method>     calls a method using the request body as params
+//	GET  /instance         runtime information about this instance
+//	GET  /instances        runtime information about all instances
+//
+// The http server does not authenticate its clients, relying on being bound
+// to the loopback interface instead, so addresses on other interfaces are
+// refused. To keep web pages opened by the user from calling methods,
+// requests carrying an Origin header or a Host other than a loopback address
+// are rejected and methods are only called by requests with a JSON body.
+func StartHTTP(address string) (net.Addr, error) {
+	if address == "" {
+		address = DefaultAddress
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isLoopback(host) {
+		return nil, fmt.Errorf("http gateway must listen on a loopback address: %s", address)
+	}
+
+	lis, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		err := http.Serve(lis, NewHTTPHandler())
+		if err != nil {
+			log.WithError(err).Warn("http server stopped")
+		}
+	}()
+
+	return lis.Addr(), nil
+}
+
+// NewHTTPHandler returns a http.Handler that serves the registered methods.
+func NewHTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/rpc", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeHTTPError(w, http.StatusMethodNotAllowed, NewError(CodeInvalidRequest, "method %s not allowed", r.Method))
+			return
+		}
+
+		writeHTTPResult(w, Methods())
+	})
+
+	mux.HandleFunc(HttpMethodPrefix, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeHTTPError(w, http.StatusMethodNotAllowed, NewError(CodeInvalidRequest, "method %s not allowed", r.Method))
+			return
+		}
+
+		mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || mediaType != "application/json" {
+			writeHTTPError(w, http.StatusUnsupportedMediaType, NewError(CodeInvalidRequest, "content type must be application/json"))
+			return
+		}
+
+		params, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeHTTPError(w, http.StatusBadRequest, NewError(CodeInvalidRequest, "could not read request body: %v", err))
+			return
+		}
+
+		serveMethod(w, r, strings.TrimPrefix(r.URL.Path, HttpMethodPrefix), params)
+	})
+
+	for path, method := range httpRoutes {
+		method := method
+
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet {
+				writeHTTPError(w, http.StatusMethodNotAllowed, NewError(CodeInvalidRequest, "method %s not allowed", r.Method))
+				return
+			}
+
+			serveMethod(w, r, method, nil)
+		})
+	}
+
+	return localOnly(mux)
+}
+
+// localOnly rejects requests that may have been sent by a web page, either
+// cross-site, carrying an Origin header, or through a host name resolving to
+// the loopback interface (DNS rebinding), carrying a Host other than a
+// loopback address.
+func localOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+
+		if r.Header.Get("Origin") != "" || !isLoopback(host) {
+			log.WithFields(log.Fields{
+				"host":   r.Host,
+				"origin": r.Header.Get("Origin"),
+				"path":   r.URL.Path,
+			}).Warn("http request rejected: only local clients are allowed")
+
+			writeHTTPError(w, http.StatusForbidden, NewError(CodeInvalidRequest, "request not allowed"))
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// isLoopback tells if the given host is localhost or a loopback ip address.
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+
+	return ip != nil && ip.IsLoopback()
+}
+
+func serveMethod(w http.ResponseWriter, r *http.Request, method string, params []byte) {
+	logger := log.WithFields(log.Fields{
+		"method": method,
+		"path":   r.URL.Path,
+	})
+
+	logger.Info("http request received")
+
+	result, rerr := invoke(r.Context(), method, params)
+	if rerr != nil {
+		logger.WithError(rerr).Warn("error executing rpc method.")
+		writeHTTPError(w, httpStatus(rerr), rerr)
+
+		return
+	}
+
+	writeHTTPResult(w, result)
+}
+
+func writeHTTPResult(w http.ResponseWriter, result interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	err := json.NewEncoder(w).Encode(result)
+	if err != nil {
+		log.WithError(err).Error("could not send http response")
+	}
+}
+
+func writeHTTPError(w http.ResponseWriter, status int, rerr *Error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	err := json.NewEncoder(w).Encode(map[string]*Error{"error": rerr})
+	if err != nil {
+		log.WithError(err).Error("could not send http response")
+	}
+}
+
+func httpStatus(rerr *Error) int {
+	switch rerr.Code {
+	case CodeMethodNotFound:
+		return http.StatusNotFound
+	case CodeInvalidParams, CodeInvalidRequest:
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
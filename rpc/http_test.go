@@ -0,0 +1,167 @@
+package rpc_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/davrodpin/mole/rpc"
+)
+
+func TestHTTPCallMethod(t *testing.T) {
+	rpc.Register("httptest", func(params testParams) (*testResult, error) {
+		return &testResult{Message: params.Message}, nil
+	})
+
+	srv := httptest.NewServer(rpc.NewHTTPHandler())
+	defer srv.Close()
+
+	tests := []struct {
+		method         string
+		path           string
+		contentType    string
+		body           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{http.MethodPost, "/rpc/httptest", "application/json", `{"message":"hello"}`, http.StatusOK, `{"message":"hello"}`},
+		{http.MethodPost, "/rpc/httptest", "application/json; charset=utf-8", `{"message":"hello"}`, http.StatusOK, `{"message":"hello"}`},
+		{http.MethodPost, "/rpc/httptest", "application/json", `"hello"`, http.StatusBadRequest, ""},
+		{http.MethodPost, "/rpc/httptest", "text/plain", `{"message":"hello"}`, http.StatusUnsupportedMediaType, ""},
+		{http.MethodPost, "/rpc/httptest", "", `{"message":"hello"}`, http.StatusUnsupportedMediaType, ""},
+		{http.MethodPost, "/rpc/notregistered", "application/json", ``, http.StatusNotFound, `{"error":{"code":-32601,"message":"method notregistered not found"}}`},
+		{http.MethodGet, "/rpc/httptest", "", ``, http.StatusMethodNotAllowed, ""},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, srv.URL+test.path, strings.NewReader(test.body))
+		if err != nil {
+			t.Errorf("error creating http request: %v", err)
+			continue
+		}
+
+		if test.contentType != "" {
+			req.Header.Set("Content-Type", test.contentType)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Errorf("error making http request: %v", err)
+			continue
+		}
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != test.expectedStatus {
+			t.Errorf("unexpected status code for %s %s: want: %d, got: %d", test.method, test.path, test.expectedStatus, resp.StatusCode)
+		}
+
+		if test.expectedBody != "" && strings.TrimSpace(string(body)) != test.expectedBody {
+			t.Errorf("unexpected response body for %s %s: want: %s, got: %s", test.method, test.path, test.expectedBody, string(body))
+		}
+	}
+}
+
+func TestHTTPListMethods(t *testing.T) {
+	rpc.Register("httplist", func() (*testResult, error) {
+		return &testResult{}, nil
+	})
+
+	srv := httptest.NewServer(rpc.NewHTTPHandler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/rpc")
+	if err != nil {
+		t.Errorf("error making http request: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	var methods []string
+	err = json.NewDecoder(resp.Body).Decode(&methods)
+	if err != nil {
+		t.Errorf("error decoding http response: %v", err)
+		return
+	}
+
+	for _, m := range methods {
+		if m == "httplist" {
+			return
+		}
+	}
+
+	t.Errorf("registered method not listed: %v", methods)
+}
+
+func TestHTTPRejectsNonLocalRequests(t *testing.T) {
+	rpc.Register("httplocal", func() (*testResult, error) {
+		return &testResult{}, nil
+	})
+
+	srv := httptest.NewServer(rpc.NewHTTPHandler())
+	defer srv.Close()
+
+	tests := []struct {
+		host           string
+		origin         string
+		expectedStatus int
+	}{
+		{"", "", http.StatusOK},
+		{"localhost", "", http.StatusOK},
+		{"[::1]:8181", "", http.StatusOK},
+		{"", "https://example.com", http.StatusForbidden},
+		{"attacker.example.com", "", http.StatusForbidden},
+		{"192.168.0.10:8181", "", http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/rpc/httplocal", strings.NewReader(""))
+		if err != nil {
+			t.Errorf("error creating http request: %v", err)
+			continue
+		}
+
+		req.Header.Set("Content-Type", "application/json")
+
+		if test.host != "" {
+			req.Host = test.host
+		}
+
+		if test.origin != "" {
+			req.Header.Set("Origin", test.origin)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Errorf("error making http request: %v", err)
+			continue
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != test.expectedStatus {
+			t.Errorf("unexpected status code for host %q and origin %q: want: %d, got: %d", test.host, test.origin, test.expectedStatus, resp.StatusCode)
+		}
+	}
+}
+
+func TestStartHTTPRequiresLoopbackAddress(t *testing.T) {
+	for _, address := range []string{":0", "0.0.0.0:0", "[::]:0"} {
+		if _, err := rpc.StartHTTP(address); err == nil {
+			t.Errorf("http gateway must refuse to listen on %s", address)
+		}
+	}
+
+	addr, err := rpc.StartHTTP("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("error starting http gateway on a loopback address: %v", err)
+		return
+	}
+
+	if !strings.HasPrefix(addr.String(), "127.0.0.1:") {
+		t.Errorf("unexpected http gateway address: %s", addr)
+	}
+}
@@ -0,0 +1,202 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+const (
+	// CodeInvalidRequest is the JSON-RPC error code returned when the request
+	// itself is not valid.
+	CodeInvalidRequest = jsonrpc2.CodeInvalidRequest
+
+	// CodeInvalidParams is the JSON-RPC error code returned when the parameters
+	// of a request can't be decoded into the type expected by the method.
+	CodeInvalidParams = jsonrpc2.CodeInvalidParams
+
+	// CodeMethodNotFound is the JSON-RPC error code returned when the requested
+	// method is not registered.
+	CodeMethodNotFound = jsonrpc2.CodeMethodNotFound
+
+	// CodeInternalError is the JSON-RPC error code returned when a method fails
+	// without providing a more specific error.
+	CodeInternalError = jsonrpc2.CodeInternalError
+)
+
+var (
+	registeredMethods = sync.Map{}
+
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// Error is a JSON-RPC error object. Methods can return an *Error to reply
+// with a specific error code; any other error is reported to the caller as an
+// internal error carrying the error message.
+type Error struct {
+	Code    int64       `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// NewError returns a new *Error with the given code and formatted message.
+func NewError(code int64, format string, a ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+// Error returns a string representation of an Error.
+func (e *Error) Error() string {
+	return fmt.Sprintf("rpc error %d: %s", e.Code, e.Message)
+}
+
+func (e *Error) toJsonRpc() *jsonrpc2.Error {
+	je := &jsonrpc2.Error{Code: e.Code, Message: e.Message}
+
+	if e.Data != nil {
+		je.SetError(e.Data)
+	}
+
+	return je
+}
+
+// Method represents a procedure that can be called remotely.
+type Method struct {
+	name   string
+	fn     reflect.Value
+	ctx    bool
+	params reflect.Type
+}
+
+// Register adds a new method that can be called remotely.
+//
+// The handler must be a function with one of the following signatures, where
+// P is the type the request parameters are decoded into and R is the type of
+// the result sent back to the caller:
+//
+//	func() (R, error)
+//	func(P) (R, error)
+//	func(context.Context) (R, error)
+//	func(context.Context, P) (R, error)
+//
+// Register panics if handler does not match any of the signatures above.
+func Register(name string, handler interface{}) {
+	m, err := newMethod(name, handler)
+	if err != nil {
+		panic(err)
+	}
+
+	registeredMethods.Store(name, m)
+}
+
+// Methods returns the names of all registered methods, sorted alphabetically.
+func Methods() []string {
+	var names []string
+
+	registeredMethods.Range(func(key, value interface{}) bool {
+		names = append(names, key.(string))
+		return true
+	})
+
+	sort.Strings(names)
+
+	return names
+}
+
+func newMethod(name string, handler interface{}) (*Method, error) {
+	fn := reflect.ValueOf(handler)
+	ft := fn.Type()
+
+	if ft.Kind() != reflect.Func {
+		return nil, fmt.Errorf("rpc method %s: handler must be a function, got %s", name, ft)
+	}
+
+	if ft.NumOut() != 2 || !ft.Out(1).Implements(errorType) {
+		return nil, fmt.Errorf("rpc method %s: handler must return a result and an error", name)
+	}
+
+	m := &Method{name: name, fn: fn}
+
+	in := ft.NumIn()
+	if in > 0 && ft.In(0) == contextType {
+		m.ctx = true
+		in--
+	}
+
+	switch in {
+	case 0:
+	case 1:
+		m.params = ft.In(ft.NumIn() - 1)
+	default:
+		return nil, fmt.Errorf("rpc method %s: handler must accept at most one parameter besides context", name)
+	}
+
+	return m, nil
+}
+
+// invoke decodes params into the type declared by the method handler, calls
+// it and returns its result. Any error is translated to an *Error.
+func invoke(ctx context.Context, name string, params []byte) (interface{}, *Error) {
+	v, ok := registeredMethods.Load(name)
+	if !ok {
+		return nil, NewError(CodeMethodNotFound, "method %s not found", name)
+	}
+
+	m := v.(*Method)
+
+	var args []reflect.Value
+
+	if m.ctx {
+		args = append(args, reflect.ValueOf(ctx))
+	}
+
+	if m.params != nil {
+		p, err := m.decodeParams(params)
+		if err != nil {
+			return nil, NewError(CodeInvalidParams, "invalid params for method %s: %v", name, err)
+		}
+
+		args = append(args, p)
+	}
+
+	out := m.fn.Call(args)
+
+	if err, _ := out[1].Interface().(error); err != nil {
+		var rerr *Error
+		if errors.As(err, &rerr) {
+			return nil, rerr
+		}
+
+		return nil, NewError(CodeInternalError, "%v", err)
+	}
+
+	return out[0].Interface(), nil
+}
+
+func (m *Method) decodeParams(params []byte) (reflect.Value, error) {
+	pt := m.params
+	ptr := pt.Kind() == reflect.Ptr
+	if ptr {
+		pt = pt.Elem()
+	}
+
+	p := reflect.New(pt)
+
+	if len(params) > 0 && string(params) != "null" {
+		if err := json.Unmarshal(params, p.Interface()); err != nil {
+			return reflect.Value{}, err
+		}
+	}
+
+	if ptr {
+		return p, nil
+	}
+
+	return p.Elem(), nil
+}
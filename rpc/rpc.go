@@ -2,17 +2,13 @@ package rpc
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
 	"net"
-	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/sourcegraph/jsonrpc2"
 )
 
-var registeredMethods = sync.Map{}
-
 const (
 	// DefaultAddress is the network address used by the rpc server if none is given.
 	DefaultAddress = "127.0.0.1:0"
@@ -32,21 +28,46 @@ func Start(address string) (net.Addr, error) {
 		return nil, err
 	}
 
+	go serve(lis)
+
+	return lis.Addr(), nil
+}
+
+// serve accepts rpc clients on the given listener until it is closed.
+func serve(lis net.Listener) {
 	ctx := context.Background()
 	h := &Handler{}
 
-	go func() {
-		for {
-			conn, err := lis.Accept()
-			if err != nil {
-				log.WithError(err).Warnf("error establishing connection with rpc client.")
+	var delay time.Duration
+
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			// temporary failures, like running out of file descriptors, must not
+			// shut the server down, so accepting is retried with an increasing
+			// delay, the same way net/http does. Any other error means the
+			// listener was closed.
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+
+				log.WithError(err).Warnf("error establishing connection with rpc client, retrying in %v.", delay)
+				time.Sleep(delay)
+
+				continue
 			}
-			stream := jsonrpc2.NewBufferedStream(conn, jsonrpc2.VarintObjectCodec{})
-			jsonrpc2.NewConn(ctx, stream, h)
+
+			log.WithError(err).Debug("rpc server stopped accepting connections.")
+			return
 		}
-	}()
 
-	return lis.Addr(), nil
+		delay = 0
+		stream := jsonrpc2.NewBufferedStream(conn, jsonrpc2.VarintObjectCodec{})
+		jsonrpc2.NewConn(ctx, stream, h)
+	}
 }
 
 // Handler handles JSON-RPC requests and notifications.
@@ -55,166 +76,40 @@ type Handler struct{}
 // Handle manages JSON-RPC requests and notifications, executing the requested
 // method and responding back to the client when needed.
 func (h *Handler) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
-	log.WithFields(log.Fields{
+	logger := log.WithFields(log.Fields{
 		"notification": req.Notif,
 		"method":       req.Method,
 		"id":           req.ID,
-	}).Info("rpc request received")
-
-	if _, ok := registeredMethods.Load(req.Method); !ok {
-		log.Errorf("rpc request method %s not supported", req.Method)
-
-		if !req.Notif {
-			var err error
-
-			resp := &jsonrpc2.Response{}
-			err = resp.SetResult(jsonrpc2.Error{
-				Code:    jsonrpc2.CodeMethodNotFound,
-				Message: fmt.Sprintf("method %s not found", req.Method),
-			})
-			if err != nil {
-				log.WithFields(log.Fields{
-					"notification": req.Notif,
-					"method":       req.Method,
-					"id":           req.ID,
-				}).WithError(err).Error("could not send rpc error response")
-
-				return
-			}
+	})
 
-			err = sendResponse(ctx, conn, req, resp)
-			if err != nil {
-				log.WithFields(log.Fields{
-					"notification": req.Notif,
-					"method":       req.Method,
-					"id":           req.ID,
-				}).WithError(err).Error("could not send rpc response")
+	logger.Info("rpc request received")
 
-				return
-			}
-		}
-
-		return
+	var params []byte
+	if req.Params != nil {
+		params = *req.Params
 	}
 
-	params, err := req.Params.MarshalJSON()
-	if err != nil {
-		log.WithFields(log.Fields{
-			"notification": req.Notif,
-			"method":       req.Method,
-			"id":           req.ID,
-		}).WithError(err).Warn("error executing rpc method.")
-
-		if !req.Notif {
-			var err error
-			resp := &jsonrpc2.Response{}
-
-			err = resp.SetResult(jsonrpc2.Error{
-				Code:    jsonrpc2.CodeInternalError,
-				Message: fmt.Sprintf("error executing rpc method %s", req.Method),
-			})
-			if err != nil {
-				log.WithFields(log.Fields{
-					"notification": req.Notif,
-					"method":       req.Method,
-					"id":           req.ID,
-				}).WithError(err).Error("could not send rpc error response")
-
-				return
-			}
-
-			err = sendResponse(ctx, conn, req, resp)
-			if err != nil {
-				log.WithFields(log.Fields{
-					"notification": req.Notif,
-					"method":       req.Method,
-					"id":           req.ID,
-				}).WithError(err).Error("could not send rpc response")
-
-				return
-			}
-		}
-
-		return
+	result, rerr := invoke(ctx, req.Method, params)
+	if rerr != nil {
+		logger.WithError(rerr).Warn("error executing rpc method.")
 	}
 
-	m, _ := registeredMethods.Load(req.Method)
-	rm, err := m.(Method)(params)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"notification": req.Notif,
-			"method":       req.Method,
-			"id":           req.ID,
-		}).WithError(err).Warn("error executing rpc method.")
-
-		if !req.Notif {
-			var err error
-
-			resp := &jsonrpc2.Response{}
-			err = resp.SetResult(jsonrpc2.Error{
-				Code:    jsonrpc2.CodeInternalError,
-				Message: fmt.Sprintf("error executing rpc method %s", req.Method),
-			})
-			if err != nil {
-				log.WithFields(log.Fields{
-					"notification": req.Notif,
-					"method":       req.Method,
-					"id":           req.ID,
-				}).WithError(err).Error("could not send rpc error response")
-
-				return
-			}
-
-			err = sendResponse(ctx, conn, req, resp)
-			if err != nil {
-				log.WithFields(log.Fields{
-					"notification": req.Notif,
-					"method":       req.Method,
-					"id":           req.ID,
-				}).WithError(err).Error("could not send rpc response")
-
-				return
-			}
-		}
-
+	if req.Notif {
 		return
 	}
 
-	if !req.Notif {
-		resp := &jsonrpc2.Response{ID: req.ID, Result: &rm}
-
-		err = sendResponse(ctx, conn, req, resp)
-		if err != nil {
-			log.WithFields(log.Fields{
-				"notification": req.Notif,
-				"method":       req.Method,
-				"id":           req.ID,
-			}).WithError(err).Error("could not send rpc response")
+	var err error
 
-			return
-		}
+	if rerr != nil {
+		err = conn.ReplyWithError(ctx, req.ID, rerr.toJsonRpc())
+	} else {
+		err = conn.Reply(ctx, req.ID, result)
 	}
-}
-
-// Register adds a new method that can be called remotely.
-func Register(name string, method Method) {
-	registeredMethods.Store(name, method)
-}
 
-// Method represents a procedure that can be called remotely.
-type Method func(params interface{}) (json.RawMessage, error)
-
-func sendResponse(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request, resp *jsonrpc2.Response) error {
-	if err := conn.SendResponse(ctx, resp); err != nil {
-		return err
+	if err != nil {
+		logger.WithError(err).Error("could not send rpc response")
+		return
 	}
 
-	log.WithFields(log.Fields{
-		"notification": req.Notif,
-		"method":       req.Method,
-		"id":           req.ID,
-	}).Info("rpc response sent.")
-
-	return nil
-
+	logger.Info("rpc response sent.")
 }
@@ -3,6 +3,7 @@ package rpc_test
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"os"
@@ -15,26 +16,24 @@ var (
 	addr net.Addr
 )
 
+type testParams struct {
+	Message string `json:"message"`
+}
+
+type testResult struct {
+	Message string `json:"message"`
+}
+
 func TestHandler(t *testing.T) {
-	responseTemplate := `{"message":"%s"}`
 	method := "test"
 	paramValue := "param"
-	expectedResponse := fmt.Sprintf(responseTemplate, paramValue)
-
-	rpc.Register(method, func(params interface{}) (json.RawMessage, error) {
-		var r []uint8
-		var ok bool
-
-		if r, ok = params.([]uint8); !ok {
-			return nil, fmt.Errorf("invalid parameter")
-		}
-
-		m := fmt.Sprintf(responseTemplate, string(r[1:6]))
+	expectedResponse := fmt.Sprintf(`{"message":"%s"}`, paramValue)
 
-		return json.RawMessage(m), nil
+	rpc.Register(method, func(params testParams) (*testResult, error) {
+		return &testResult{Message: params.Message}, nil
 	})
 
-	response, err := rpc.Call(context.Background(), addr.String(), method, paramValue)
+	response, err := rpc.Call(context.Background(), addr.String(), method, testParams{Message: paramValue})
 	if err != nil {
 		t.Errorf("error while calling remote procedure: %v", err)
 	}
@@ -49,11 +48,19 @@ func TestHandler(t *testing.T) {
 	}
 }
 
-func TestMethodNotRegistered(t *testing.T) {
-	method := "methodnotregistered"
-	expectedResponse := fmt.Sprintf(`{"code":-32601,"data":null,"message":"method %s not found"}`, method)
+func TestHandlerWithContextAndNoParams(t *testing.T) {
+	method := "testwithcontext"
+	expectedResponse := `{"message":"context"}`
+
+	rpc.Register(method, func(ctx context.Context) (map[string]string, error) {
+		if ctx == nil {
+			return nil, fmt.Errorf("missing context")
+		}
 
-	response, err := rpc.Call(context.Background(), addr.String(), method, "param")
+		return map[string]string{"message": "context"}, nil
+	})
+
+	response, err := rpc.Call(context.Background(), addr.String(), method, nil)
 	if err != nil {
 		t.Errorf("error while calling remote procedure: %v", err)
 	}
@@ -68,26 +75,81 @@ func TestMethodNotRegistered(t *testing.T) {
 	}
 }
 
+func TestMethodNotRegistered(t *testing.T) {
+	method := "methodnotregistered"
+
+	_, err := rpc.Call(context.Background(), addr.String(), method, "param")
+	assertRpcError(t, err, rpc.CodeMethodNotFound, fmt.Sprintf("method %s not found", method))
+}
+
 func TestMethodWithError(t *testing.T) {
 	method := "testwitherror"
-	expectedResponse := fmt.Sprintf(`{"code":-32603,"data":null,"message":"error executing rpc method %s"}`, method)
 
-	rpc.Register(method, func(params interface{}) (json.RawMessage, error) {
-		return nil, fmt.Errorf("error")
+	rpc.Register(method, func() (*testResult, error) {
+		return nil, fmt.Errorf("something went wrong")
 	})
 
-	response, err := rpc.Call(context.Background(), addr.String(), method, "param")
-	if err != nil {
-		t.Errorf("error while calling remote procedure: %v", err)
+	_, err := rpc.Call(context.Background(), addr.String(), method, nil)
+	assertRpcError(t, err, rpc.CodeInternalError, "something went wrong")
+}
+
+func TestMethodWithCustomError(t *testing.T) {
+	method := "testwithcustomerror"
+
+	rpc.Register(method, func() (*testResult, error) {
+		return nil, rpc.NewError(42, "custom error")
+	})
+
+	_, err := rpc.Call(context.Background(), addr.String(), method, nil)
+	assertRpcError(t, err, 42, "custom error")
+}
+
+func TestMethodWithInvalidParams(t *testing.T) {
+	method := "testwithinvalidparams"
+
+	rpc.Register(method, func(params testParams) (*testResult, error) {
+		return &testResult{Message: params.Message}, nil
+	})
+
+	_, err := rpc.Call(context.Background(), addr.String(), method, "param")
+	assertRpcError(t, err, rpc.CodeInvalidParams, "")
+}
+
+func TestRegisterInvalidHandler(t *testing.T) {
+	tests := []interface{}{
+		"not a function",
+		func() error { return nil },
+		func(a, b string) (string, error) { return "", nil },
+		func() (string, string) { return "", "" },
 	}
 
-	json, err := json.Marshal(response)
-	if err != nil {
-		t.Errorf("error while parsing response to string: response: %s, err: %v", response, err)
+	for i, handler := range tests {
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Errorf("expected registration of handler %d to fail", i)
+				}
+			}()
+
+			rpc.Register(fmt.Sprintf("invalid%d", i), handler)
+		}()
 	}
+}
 
-	if expectedResponse != string(json) {
-		t.Errorf("unexpected response for remote procedure call: want: %s, got: %s", expectedResponse, string(json))
+func assertRpcError(t *testing.T, err error, code int64, message string) {
+	var rerr *rpc.Error
+
+	if !errors.As(err, &rerr) {
+		t.Errorf("expected rpc error, got: %v", err)
+		return
+	}
+
+	if rerr.Code != code {
+		t.Errorf("unexpected error code: want: %d, got: %d", code, rerr.Code)
+	}
+
+	if message != "" && rerr.Message != message {
+		t.Errorf("unexpected error message: want: %s, got: %s", message, rerr.Message)
 	}
 }
 
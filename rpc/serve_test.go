@@ -0,0 +1,57 @@
+package rpc
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// flakyListener fails with a temporary error the first time it accepts a
+// connection.
+type flakyListener struct {
+	net.Listener
+	failed bool
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if !l.failed {
+		l.failed = true
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Err: syscall.EMFILE}
+	}
+
+	return l.Listener.Accept()
+}
+
+func TestServeTemporaryError(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error creating listener: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		serve(&flakyListener{Listener: lis})
+		close(done)
+	}()
+
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatalf("error connecting to the rpc server: %v", err)
+	}
+	defer conn.Close()
+
+	select {
+	case <-done:
+		t.Fatalf("rpc server stopped after a temporary error")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	lis.Close()
+
+	select {
+	case <-done:
+	case <-time.After(1 * time.Second):
+		t.Errorf("rpc server didn't stop after its listener was closed")
+	}
+}
@@ -0,0 +1,50 @@
+package tunnel
+
+import (
+	"net"
+	"testing"
+)
+
+func TestChannelAccessLists(t *testing.T) {
+	tests := []struct {
+		allow    string
+		deny     string
+		addr     net.Addr
+		expected bool
+	}{
+		{"", "", &net.TCPAddr{IP: net.ParseIP("203.0.113.10")}, true},
+		{"192.168.1.0/24", "", &net.TCPAddr{IP: net.ParseIP("192.168.1.20")}, true},
+		{"192.168.1.0/24", "", &net.TCPAddr{IP: net.ParseIP("192.168.2.20")}, false},
+		{"192.168.1.0/24", "192.168.1.20", &net.TCPAddr{IP: net.ParseIP("192.168.1.20")}, false},
+		{"", "10.0.0.0/8, 172.16.0.0/12", &net.TCPAddr{IP: net.ParseIP("172.17.0.2")}, false},
+		{"", "10.0.0.0/8", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}, true},
+		{"::1", "", &net.TCPAddr{IP: net.ParseIP("::1")}, true},
+		{"127.0.0.1", "", &net.TCPAddr{IP: net.ParseIP("::ffff:127.0.0.1")}, true},
+		{"127.0.0.1", "", &net.UnixAddr{Name: "/tmp/mole.sock", Net: "unix"}, false},
+		{"", "127.0.0.1", &net.UnixAddr{Name: "/tmp/mole.sock", Net: "unix"}, true},
+	}
+
+	for id, test := range tests {
+		allow, err := ParseCIDRList(test.allow)
+		if err != nil {
+			t.Errorf("error parsing allow list on test %d: %v", id, err)
+			continue
+		}
+
+		deny, err := ParseCIDRList(test.deny)
+		if err != nil {
+			t.Errorf("error parsing deny list on test %d: %v", id, err)
+			continue
+		}
+
+		opts := ChannelOptions{Allow: allow, Deny: deny}
+		if opts.allows(test.addr) != test.expected {
+			t.Errorf("unexpected result for %s on test %d: expected: %t, value: %t", test.addr, id, test.expected, !test.expected)
+		}
+	}
+
+	_, err := ParseCIDRList("192.168.1.0/33")
+	if err == nil {
+		t.Errorf("invalid network address was accepted")
+	}
+}
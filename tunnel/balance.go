@@ -0,0 +1,265 @@
+package tunnel
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// Balance is the strategy used to pick the destination of each connection to
+// a channel with several destinations.
+type Balance string
+
+const (
+	// RoundRobin picks each destination in turn.
+	RoundRobin Balance = "round-robin"
+
+	// RandomBalance picks a destination at random.
+	RandomBalance Balance = "random"
+
+	// LeastConnections picks the destination serving the fewest connections.
+	LeastConnections Balance = "least-connections"
+)
+
+// DefaultHealthCheckInterval is the time between two health checks of the
+// destinations of a channel with several destinations.
+const DefaultHealthCheckInterval = 10 * time.Second
+
+// ParseBalance returns the balance strategy with the given name, where an
+// empty name means round-robin.
+func ParseBalance(strategy string) (Balance, error) {
+	switch Balance(strategy) {
+	case "":
+		return RoundRobin, nil
+	case RoundRobin, RandomBalance, LeastConnections:
+		return Balance(strategy), nil
+	default:
+		return "", fmt.Errorf("unknown load balancing strategy %s: must be one of %s, %s or %s", strategy, RoundRobin, RandomBalance, LeastConnections)
+	}
+}
+
+// ParseBackends parses a comma separated list of destination addresses,
+// expanded the same way channel destinations are.
+func ParseBackends(list string) []string {
+	var backends []string
+
+	for _, addr := range strings.Split(list, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+
+		backends = append(backends, expandAddress(addr))
+	}
+
+	return backends
+}
+
+// backend holds the state of one of the destinations of a channel.
+type backend struct {
+	// active is the number of connections to the destination being served.
+	active int
+	// down tells if the last attempt to reach the destination failed.
+	down bool
+}
+
+// balancer picks the destination of each connection to a channel, skipping
+// the destinations that could not be reached. Its state is kept by address,
+// so it survives changes to the channel destinations.
+type balancer struct {
+	mu       sync.Mutex
+	next     int
+	backends map[string]*backend
+}
+
+func newBalancer() *balancer {
+	return &balancer{backends: make(map[string]*backend)}
+}
+
+// backend returns the state of the given destination.
+//
+// The caller must hold b.mu.
+func (b *balancer) backend(address string) *backend {
+	be, ok := b.backends[address]
+	if !ok {
+		be = &backend{}
+		b.backends[address] = be
+	}
+
+	return be
+}
+
+// candidates returns the given destinations in the order they should be
+// tried by the next connection, leaving out those that are down unless all of
+// them are.
+func (b *balancer) candidates(addresses []string, strategy Balance) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var up []string
+	for _, addr := range addresses {
+		if !b.backend(addr).down {
+			up = append(up, addr)
+		}
+	}
+
+	if len(up) == 0 {
+		up = append(up, addresses...)
+	}
+
+	if len(up) < 2 {
+		return up
+	}
+
+	switch strategy {
+	case RandomBalance:
+		rand.Shuffle(len(up), func(i, j int) { up[i], up[j] = up[j], up[i] })
+	case LeastConnections:
+		sort.SliceStable(up, func(i, j int) bool {
+			return b.backends[up[i]].active < b.backends[up[j]].active
+		})
+	default:
+		start := b.next % len(up)
+		b.next++
+
+		rotated := make([]string, 0, len(up))
+		rotated = append(rotated, up[start:]...)
+		up = append(rotated, up[:start]...)
+	}
+
+	return up
+}
+
+// acquire counts a new connection to the given destination.
+func (b *balancer) acquire(address string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.backend(address).active++
+}
+
+// release counts the end of a connection to the given destination.
+func (b *balancer) release(address string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.backend(address).active--
+}
+
+// setDown records whether the given destination could be reached, returning
+// true if that changed.
+func (b *balancer) setDown(address string, down bool) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	be := b.backend(address)
+	changed := be.down != down
+	be.down = down
+
+	return changed
+}
+
+// destinations returns all destinations of a channel, which are the channel
+// destination followed by the backends on its options.
+func (ch *SSHChannel) destinations(opts ChannelOptions) []string {
+	return append([]string{ch.Destination}, opts.Backends...)
+}
+
+// markBackend records the result of an attempt to reach one of the
+// destinations of a channel with several destinations, logging when it goes
+// down or comes back.
+func (t *Tunnel) markBackend(channel *SSHChannel, address string, err error) {
+	if !channel.balancer.setDown(address, err != nil) {
+		return
+	}
+
+	fields := log.Fields{
+		"channel":     channel,
+		"destination": address,
+	}
+
+	if err != nil {
+		log.WithFields(fields).WithError(err).Warn("destination is unreachable, skipping it until it recovers")
+	} else {
+		log.WithFields(fields).Info("destination is reachable again")
+	}
+}
+
+// checkBackends dials the destinations of all channels with several
+// destinations every HealthCheckInterval, until the tunnel stops, so the ones
+// that can't be reached are skipped by new connections. Destinations are not
+// checked while the tunnel is disconnected from the ssh server.
+func (t *Tunnel) checkBackends() {
+	for {
+		time.Sleep(t.HealthCheckInterval)
+
+		if t.isStopped() {
+			return
+		}
+
+		t.mu.Lock()
+		channels := append([]*SSHChannel{}, t.channels...)
+		t.mu.Unlock()
+
+		for _, ch := range channels {
+			opts := t.channelOptions(ch)
+			if len(opts.Backends) == 0 || ch.isClosed() {
+				continue
+			}
+
+			for _, addr := range ch.destinations(opts) {
+				dial, err := t.destinationDialer(t.sshClient(), addr)
+				if err != nil {
+					continue
+				}
+
+				conn, err := dialTimeout(dial, t.healthCheckTimeout())
+				if err == nil {
+					conn.Close()
+				}
+
+				t.markBackend(ch, addr, err)
+			}
+		}
+	}
+}
+
+// healthCheckTimeout returns the maximum time waited for a destination to
+// accept a health check connection.
+func (t *Tunnel) healthCheckTimeout() time.Duration {
+	if timeout := t.destinationTimeout(); timeout > 0 && timeout < t.HealthCheckInterval {
+		return timeout
+	}
+
+	return t.HealthCheckInterval
+}
+
+// destinationDialer returns a function connecting to the given destination:
+// through the given connection to the ssh server on local tunnels, or from the
+// local host on remote tunnels. It fails if a local tunnel is not connected to
+// the ssh server.
+func (t *Tunnel) destinationDialer(client *ssh.Client, address string) (func() (net.Conn, error), error) {
+	switch t.Type {
+	case "local":
+		if client == nil {
+			return nil, fmt.Errorf("missing connection to the ssh server")
+		}
+
+		return func() (net.Conn, error) {
+			return client.Dial(network(address), address)
+		}, nil
+	case "remote":
+		return func() (net.Conn, error) {
+			return net.Dial(network(address), address)
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown tunnel type %s", t.Type)
+	}
+}
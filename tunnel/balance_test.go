@@ -0,0 +1,86 @@
+package tunnel
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseBalance(t *testing.T) {
+	tests := []struct {
+		strategy string
+		expected Balance
+		err      bool
+	}{
+		{"", RoundRobin, false},
+		{"round-robin", RoundRobin, false},
+		{"random", RandomBalance, false},
+		{"least-connections", LeastConnections, false},
+		{"weighted", "", true},
+	}
+
+	for _, test := range tests {
+		balance, err := ParseBalance(test.strategy)
+		if test.err != (err != nil) {
+			t.Errorf("unexpected error for strategy %s: %v", test.strategy, err)
+			continue
+		}
+
+		if balance != test.expected {
+			t.Errorf("unexpected strategy: expected %s, got %s", test.expected, balance)
+		}
+	}
+}
+
+func TestParseBackends(t *testing.T) {
+	backends := ParseBackends(" db2:5432, :5433,,db4:5432 ")
+	expected := []string{"db2:5432", "127.0.0.1:5433", "db4:5432"}
+
+	if !reflect.DeepEqual(backends, expected) {
+		t.Errorf("unexpected backends: expected %v, got %v", expected, backends)
+	}
+
+	if backends := ParseBackends(""); backends != nil {
+		t.Errorf("unexpected backends for an empty list: %v", backends)
+	}
+}
+
+func TestBalancerCandidates(t *testing.T) {
+	addrs := []string{"a:1", "b:1", "c:1"}
+
+	b := newBalancer()
+	for _, expected := range [][]string{{"a:1", "b:1", "c:1"}, {"b:1", "c:1", "a:1"}, {"c:1", "a:1", "b:1"}} {
+		if c := b.candidates(addrs, RoundRobin); !reflect.DeepEqual(c, expected) {
+			t.Errorf("unexpected round-robin candidates: expected %v, got %v", expected, c)
+		}
+	}
+
+	b = newBalancer()
+	b.setDown("b:1", true)
+	if c := b.candidates(addrs, RoundRobin); !reflect.DeepEqual(c, []string{"a:1", "c:1"}) {
+		t.Errorf("destinations down must be skipped: got %v", c)
+	}
+
+	b.setDown("a:1", true)
+	b.setDown("c:1", true)
+	if c := b.candidates(addrs, RandomBalance); len(c) != len(addrs) {
+		t.Errorf("all destinations must be tried when all of them are down: got %v", c)
+	}
+
+	b = newBalancer()
+	b.acquire("a:1")
+	b.acquire("a:1")
+	b.acquire("c:1")
+	if c := b.candidates(addrs, LeastConnections); !reflect.DeepEqual(c, []string{"b:1", "c:1", "a:1"}) {
+		t.Errorf("unexpected least-connections candidates: got %v", c)
+	}
+
+	b.release("a:1")
+	b.release("a:1")
+	if c := b.candidates(addrs, LeastConnections); !reflect.DeepEqual(c, []string{"a:1", "b:1", "c:1"}) {
+		t.Errorf("unexpected least-connections candidates after release: got %v", c)
+	}
+
+	if !b.setDown("a:1", true) || b.setDown("a:1", true) || !b.setDown("a:1", false) {
+		t.Errorf("setDown must only report changes")
+	}
+}
@@ -0,0 +1,410 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// pcapLinkTypeRaw is the pcap link type of packets starting with an IPv4
+	// or IPv6 header.
+	pcapLinkTypeRaw = 101
+
+	// maxSegment is the maximum amount of data carried by each synthesized TCP
+	// segment.
+	maxSegment = 32 * 1024
+
+	tcpFin = 0x01
+	tcpSyn = 0x02
+	tcpPsh = 0x08
+	tcpAck = 0x10
+)
+
+// ParseSize parses a size in bytes, such as "512K" or "10MB", accepting the
+// K, M and G suffixes as multiples of 1024. An empty string or zero means no
+// limit.
+func ParseSize(size string) (int64, error) {
+	n, err := parseBytes(size)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %s: must be a positive number of bytes, optionally followed by K, M or G", size)
+	}
+
+	return n, nil
+}
+
+// SetCaptureLimits sets the maximum size of each capture file and of all
+// capture files written by the tunnel together. Packets that would exceed
+// either limit, and any packet of the same connection after them, are not
+// written. Zero means no limit.
+func (t *Tunnel) SetCaptureLimits(fileSize, totalSize int64) {
+	t.mu.Lock()
+	t.captureMaxSize = fileSize
+	t.mu.Unlock()
+
+	t.captured.setMax(totalSize)
+}
+
+// startCapture creates the capture file of a connection to the given channel,
+// returning nil if the channel has no capture directory or the file can't be
+// created, in which case the connection is still served.
+func (t *Tunnel) startCapture(channel *SSHChannel, conn, destination net.Conn) *capture {
+	t.mu.Lock()
+	dir := channel.Options.Capture
+	maxSize := t.captureMaxSize
+	t.captures++
+	id := t.captures
+	t.mu.Unlock()
+
+	if dir == "" {
+		return nil
+	}
+
+	name := fmt.Sprintf("%s-%d-%s-%s.pcap",
+		time.Now().Format("20060102T150405.000000"),
+		id,
+		fileSafe(conn.RemoteAddr().String()),
+		fileSafe(channel.Destination))
+
+	c, err := newCapture(filepath.Join(dir, name), conn.RemoteAddr(), destination.RemoteAddr(), maxSize, t.captured)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"channel": channel,
+		}).WithError(err).Warn("could not create capture file, connection won't be captured")
+
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"channel": channel,
+		"file":    c.file.Name(),
+	}).Debug("capturing connection")
+
+	return c
+}
+
+// captureBudget keeps track of the data written to all capture files of a
+// tunnel.
+type captureBudget struct {
+	mu   sync.Mutex
+	max  int64
+	used int64
+}
+
+func (b *captureBudget) setMax(max int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.max = max
+}
+
+// take reserves room for n bytes, returning false if there is not enough.
+func (b *captureBudget) take(n int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.max > 0 && b.used+n > b.max {
+		return false
+	}
+
+	b.used += n
+
+	return true
+}
+
+// endpoint is one of the sides of a captured connection.
+type endpoint struct {
+	ip   net.IP
+	port uint16
+	// seq is the sequence number of the next segment sent by the endpoint.
+	seq uint32
+}
+
+// capture writes the data exchanged through a connection to a pcap file, as
+// TCP segments between the client and the destination of the connection, so
+// it can be inspected by tools like Wireshark and tcpdump.
+//
+// Segments are synthesized from the data read on each side, starting with a
+// three-way handshake and ending with a FIN segment from each side, so their
+// headers don't reflect the actual network traffic.
+type capture struct {
+	mu       sync.Mutex
+	file     *os.File
+	client   endpoint
+	server   endpoint
+	ipID     uint16
+	size     int64
+	maxSize  int64
+	budget   *captureBudget
+	stopped  bool
+	finished [2]bool
+}
+
+func newCapture(path string, client, server net.Addr, maxSize int64, budget *captureBudget) (*capture, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &capture{
+		file:    f,
+		client:  newEndpoint(client, net.IPv4(192, 0, 2, 1)),
+		server:  newEndpoint(server, net.IPv4(192, 0, 2, 2)),
+		maxSize: maxSize,
+		budget:  budget,
+	}
+
+	// both addresses must belong to the same family
+	if c.client.ip.To4() == nil || c.server.ip.To4() == nil {
+		c.client.ip = c.client.ip.To16()
+		c.server.ip = c.server.ip.To16()
+	} else {
+		c.client.ip = c.client.ip.To4()
+		c.server.ip = c.server.ip.To4()
+	}
+
+	// pcap global header: magic number, version 2.4, GMT offset, timestamp
+	// accuracy, snapshot length and link type.
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(hdr[4:], 2)
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], 65535)
+	binary.LittleEndian.PutUint32(hdr[20:], pcapLinkTypeRaw)
+
+	if !c.write(hdr) {
+		f.Close()
+		return nil, fmt.Errorf("capture size limit reached")
+	}
+
+	c.segment(true, tcpSyn, nil)
+	c.segment(false, tcpSyn|tcpAck, nil)
+	c.segment(true, tcpAck, nil)
+
+	return c, nil
+}
+
+// newEndpoint returns the endpoint at the given address, using def as its ip
+// address when the address doesn't carry one, like unix sockets or host
+// names.
+func newEndpoint(addr net.Addr, def net.IP) endpoint {
+	ep := endpoint{ip: def, seq: rand.Uint32()}
+
+	if addr == nil {
+		return ep
+	}
+
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return ep
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		ep.ip = ip
+	}
+
+	if p, err := strconv.ParseUint(port, 10, 16); err == nil {
+		ep.port = uint16(p)
+	}
+
+	return ep
+}
+
+// record writes the given data as sent by the client, if fromClient is set,
+// or by the destination.
+func (c *capture) record(fromClient bool, data []byte) {
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxSegment {
+			n = maxSegment
+		}
+
+		c.segment(fromClient, tcpPsh|tcpAck, data[:n])
+		data = data[n:]
+	}
+}
+
+// finish records the end of the data sent by one of the sides.
+func (c *capture) finish(fromClient bool) {
+	side := 0
+	if !fromClient {
+		side = 1
+	}
+
+	c.mu.Lock()
+	done := c.finished[side]
+	c.finished[side] = true
+	c.mu.Unlock()
+
+	if !done {
+		c.segment(fromClient, tcpFin|tcpAck, nil)
+	}
+}
+
+// Close closes the capture file.
+func (c *capture) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.file.Close()
+}
+
+// segment writes a TCP segment with the given flags and payload.
+func (c *capture) segment(fromClient bool, flags byte, payload []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	src, dst := &c.client, &c.server
+	if !fromClient {
+		src, dst = dst, src
+	}
+
+	var ack uint32
+	if flags&tcpAck != 0 {
+		ack = dst.seq
+	}
+
+	tcp := make([]byte, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], src.port)
+	binary.BigEndian.PutUint16(tcp[2:], dst.port)
+	binary.BigEndian.PutUint32(tcp[4:], src.seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	copy(tcp[20:], payload)
+
+	var ip, pseudo []byte
+	if len(src.ip) == net.IPv4len {
+		c.ipID++
+
+		ip = make([]byte, 20)
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(len(ip)+len(tcp)))
+		binary.BigEndian.PutUint16(ip[4:], c.ipID)
+		binary.BigEndian.PutUint16(ip[6:], 0x4000)
+		ip[8] = 64
+		ip[9] = 6
+		copy(ip[12:], src.ip)
+		copy(ip[16:], dst.ip)
+		binary.BigEndian.PutUint16(ip[10:], checksum(ip))
+
+		pseudo = make([]byte, 12)
+		copy(pseudo[0:], src.ip)
+		copy(pseudo[4:], dst.ip)
+		pseudo[9] = 6
+		binary.BigEndian.PutUint16(pseudo[10:], uint16(len(tcp)))
+	} else {
+		ip = make([]byte, 40)
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:], uint16(len(tcp)))
+		ip[6] = 6
+		ip[7] = 64
+		copy(ip[8:], src.ip)
+		copy(ip[24:], dst.ip)
+
+		pseudo = make([]byte, 40)
+		copy(pseudo[0:], src.ip)
+		copy(pseudo[16:], dst.ip)
+		binary.BigEndian.PutUint32(pseudo[32:], uint32(len(tcp)))
+		pseudo[39] = 6
+	}
+
+	binary.BigEndian.PutUint16(tcp[16:], checksum(pseudo, tcp))
+
+	src.seq += uint32(len(payload))
+	if flags&(tcpSyn|tcpFin) != 0 {
+		src.seq++
+	}
+
+	now := time.Now()
+	size := len(ip) + len(tcp)
+
+	rec := make([]byte, 16, 16+size)
+	binary.LittleEndian.PutUint32(rec[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(rec[8:], uint32(size))
+	binary.LittleEndian.PutUint32(rec[12:], uint32(size))
+	rec = append(rec, ip...)
+	rec = append(rec, tcp...)
+
+	c.write(rec)
+}
+
+// write appends data to the capture file, unless doing so would exceed the
+// size limits, which stops the capture.
+//
+// The caller must hold c.mu, except when the capture is being created.
+func (c *capture) write(data []byte) bool {
+	if c.stopped {
+		return false
+	}
+
+	n := int64(len(data))
+	if (c.maxSize > 0 && c.size+n > c.maxSize) || !c.budget.take(n) {
+		c.stopped = true
+
+		log.WithFields(log.Fields{
+			"file": c.file.Name(),
+		}).Info("capture size limit reached, the rest of the connection won't be captured")
+
+		return false
+	}
+
+	_, err := c.file.Write(data)
+	if err != nil {
+		c.stopped = true
+
+		log.WithFields(log.Fields{
+			"file": c.file.Name(),
+		}).WithError(err).Warn("could not write to capture file, the rest of the connection won't be captured")
+
+		return false
+	}
+
+	c.size += n
+
+	return true
+}
+
+// checksum returns the internet checksum of the concatenation of the given
+// buffers, all of which but the last must have an even length.
+func checksum(bufs ...[]byte) uint16 {
+	var sum uint32
+
+	for _, b := range bufs {
+		for i := 0; i+1 < len(b); i += 2 {
+			sum += uint32(b[i])<<8 | uint32(b[i+1])
+		}
+
+		if len(b)%2 == 1 {
+			sum += uint32(b[len(b)-1]) << 8
+		}
+	}
+
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+
+	return ^uint16(sum)
+}
+
+// fileSafe replaces the characters of an address that can't be part of a file
+// name on every platform.
+func fileSafe(s string) string {
+	return strings.NewReplacer(":", "_", "/", "_", "\\", "_", "[", "", "]", "").Replace(s)
+}
@@ -0,0 +1,237 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var errInvalidCapture = errors.New("invalid capture file")
+
+// capturedSegment is a TCP segment read back from a capture file.
+type capturedSegment struct {
+	src     net.IP
+	dst     net.IP
+	flags   byte
+	seq     uint32
+	ack     uint32
+	payload []byte
+}
+
+func TestCapture(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mole-capture")
+	if err != nil {
+		t.Errorf("error creating capture directory: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		client net.Addr
+		server net.Addr
+		family int
+	}{
+		{
+			&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 51234},
+			&net.TCPAddr{IP: net.ParseIP("10.0.0.5"), Port: 5432},
+			net.IPv4len,
+		},
+		{
+			&net.TCPAddr{IP: net.ParseIP("::1"), Port: 51234},
+			&net.TCPAddr{IP: net.ParseIP("10.0.0.5"), Port: 5432},
+			net.IPv6len,
+		},
+		{
+			&net.UnixAddr{Name: "/tmp/mole.sock", Net: "unix"},
+			nil,
+			net.IPv4len,
+		},
+	}
+
+	for id, test := range tests {
+		path := filepath.Join(dir, fmt.Sprintf("%d.pcap", id))
+
+		c, err := newCapture(path, test.client, test.server, 0, &captureBudget{})
+		if err != nil {
+			t.Errorf("error creating capture on test %d: %v", id, err)
+			continue
+		}
+
+		c.record(true, []byte("ping"))
+		c.record(false, []byte("pong"))
+		c.finish(true)
+		c.finish(false)
+		c.finish(false)
+		c.Close()
+
+		segments, err := readCapture(path)
+		if err != nil {
+			t.Errorf("error reading capture on test %d: %v", id, err)
+			continue
+		}
+
+		expectedFlags := []byte{tcpSyn, tcpSyn | tcpAck, tcpAck, tcpPsh | tcpAck, tcpPsh | tcpAck, tcpFin | tcpAck, tcpFin | tcpAck}
+		if len(segments) != len(expectedFlags) {
+			t.Errorf("unexpected number of segments on test %d: expected %d, got %d", id, len(expectedFlags), len(segments))
+			continue
+		}
+
+		for i, s := range segments {
+			if s.flags != expectedFlags[i] {
+				t.Errorf("unexpected flags on segment %d of test %d: expected %x, got %x", i, id, expectedFlags[i], s.flags)
+			}
+
+			if len(s.src) != test.family {
+				t.Errorf("unexpected address family on segment %d of test %d: %s", i, id, s.src)
+			}
+		}
+
+		syn, synAck, ping, pong := segments[0], segments[1], segments[3], segments[4]
+
+		if synAck.ack != syn.seq+1 || ping.seq != syn.seq+1 || pong.seq != synAck.seq+1 || pong.ack != ping.seq+4 {
+			t.Errorf("unexpected sequence numbers on test %d", id)
+		}
+
+		if string(ping.payload) != "ping" || !ping.src.Equal(syn.src) {
+			t.Errorf("unexpected client data on test %d: %q", id, ping.payload)
+		}
+
+		if string(pong.payload) != "pong" || !pong.src.Equal(syn.dst) {
+			t.Errorf("unexpected destination data on test %d: %q", id, pong.payload)
+		}
+	}
+}
+
+func TestCaptureLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mole-capture")
+	if err != nil {
+		t.Errorf("error creating capture directory: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	budget := &captureBudget{max: 2048}
+
+	c, err := newCapture(filepath.Join(dir, "1.pcap"), nil, nil, 1024, budget)
+	if err != nil {
+		t.Errorf("error creating capture: %v", err)
+		return
+	}
+
+	c.record(true, make([]byte, 600))
+	c.record(true, make([]byte, 600))
+	c.finish(true)
+	c.Close()
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "1.pcap"))
+	if err != nil {
+		t.Errorf("error reading capture: %v", err)
+		return
+	}
+
+	if len(data) > 1024 || len(data) < 600 {
+		t.Errorf("unexpected capture size: %d", len(data))
+	}
+
+	c, err = newCapture(filepath.Join(dir, "2.pcap"), nil, nil, 0, budget)
+	if err != nil {
+		t.Errorf("error creating capture: %v", err)
+		return
+	}
+
+	c.record(true, make([]byte, 1500))
+	c.Close()
+
+	if budget.used > budget.max {
+		t.Errorf("capture budget exceeded: %d", budget.used)
+	}
+
+	_, err = newCapture(filepath.Join(dir, "3.pcap"), nil, nil, 0, &captureBudget{max: 10})
+	if err == nil {
+		t.Errorf("expected error creating capture without room for its header")
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	size, err := ParseSize("10M")
+	if err != nil || size != 10*1024*1024 {
+		t.Errorf("unexpected size: %d, %v", size, err)
+	}
+
+	_, err = ParseSize("big")
+	if err == nil {
+		t.Errorf("expected error parsing invalid size")
+	}
+}
+
+// readCapture reads the TCP segments of a pcap file written by a capture,
+// validating their checksums.
+func readCapture(path string) ([]capturedSegment, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < 24 || binary.LittleEndian.Uint32(data) != 0xa1b2c3d4 || binary.LittleEndian.Uint32(data[20:]) != pcapLinkTypeRaw {
+		return nil, errInvalidCapture
+	}
+
+	var segments []capturedSegment
+
+	for data = data[24:]; len(data) > 0; {
+		if len(data) < 16 {
+			return nil, errInvalidCapture
+		}
+
+		size := int(binary.LittleEndian.Uint32(data[8:]))
+		if len(data) < 16+size {
+			return nil, errInvalidCapture
+		}
+
+		pkt := data[16 : 16+size]
+		data = data[16+size:]
+
+		var s capturedSegment
+		var tcp, pseudo []byte
+
+		if pkt[0]>>4 == 4 {
+			if checksum(pkt[:20]) != 0 {
+				return nil, errInvalidCapture
+			}
+
+			s.src, s.dst = net.IP(pkt[12:16]), net.IP(pkt[16:20])
+			tcp = pkt[20:]
+
+			pseudo = make([]byte, 12)
+			copy(pseudo, pkt[12:20])
+			pseudo[9] = 6
+			binary.BigEndian.PutUint16(pseudo[10:], uint16(len(tcp)))
+		} else {
+			s.src, s.dst = net.IP(pkt[8:24]), net.IP(pkt[24:40])
+			tcp = pkt[40:]
+
+			pseudo = make([]byte, 40)
+			copy(pseudo, pkt[8:40])
+			binary.BigEndian.PutUint32(pseudo[32:], uint32(len(tcp)))
+			pseudo[39] = 6
+		}
+
+		if checksum(pseudo, tcp) != 0 {
+			return nil, errInvalidCapture
+		}
+
+		s.seq = binary.BigEndian.Uint32(tcp[4:])
+		s.ack = binary.BigEndian.Uint32(tcp[8:])
+		s.flags = tcp[13]
+		s.payload = tcp[20:]
+
+		segments = append(segments, s)
+	}
+
+	return segments, nil
+}
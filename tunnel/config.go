@@ -1,21 +1,33 @@
 package tunnel
 
 import (
+	"errors"
 	"fmt"
+	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
-	"github.com/kevinburke/ssh_config"
 	log "github.com/sirupsen/logrus"
 )
 
 const homeVar = "$HOME"
 
+// systemConfigPath is the system-wide ssh config file, which is consulted
+// after the user's own config file, just like OpenSSH does.
+var systemConfigPath = "/etc/ssh/ssh_config"
+
 // SSHConfigFile finds specific attributes of a ssh server configured on a
 // ssh config file.
+//
+// Attributes are resolved the same way OpenSSH does: the user's config file
+// is read first, followed by the system-wide config file, and the first value
+// obtained for each attribute is used, except for the ones that can be given
+// multiple times, like IdentityFile, LocalForward and RemoteForward.
+// Include directives, Match blocks and "%" tokens are supported.
 type SSHConfigFile struct {
-	sshConfig *ssh_config.Config
+	sources []*sshConfigSource
 }
 
 // NewSSHConfigFile creates a new instance of SSHConfigFile based on the
@@ -30,126 +42,194 @@ func NewSSHConfigFile(configPath string) (*SSHConfigFile, error) {
 		configPath = strings.ReplaceAll(configPath, homeVar, home)
 	}
 
-	f, err := os.Open(filepath.Clean(configPath))
+	src, err := parseSSHConfig(filepath.Clean(configPath), false, 0)
 	if err != nil {
 		return nil, err
 	}
 
-	cfg, err := ssh_config.Decode(f)
+	log.Debugf("using ssh config file from: %s", configPath)
+
+	cfg := &SSHConfigFile{sources: []*sshConfigSource{src}}
+
+	sys, err := parseSSHConfig(systemConfigPath, true, 0)
 	if err != nil {
-		return nil, err
+		if !errors.Is(err, os.ErrNotExist) {
+			log.WithError(err).Warnf("ignoring system-wide ssh config file %s", systemConfigPath)
+		}
+	} else {
+		log.Debugf("using system-wide ssh config file from: %s", systemConfigPath)
+		cfg.sources = append(cfg.sources, sys)
 	}
 
-	log.Debugf("using ssh config file from: %s", configPath)
-
-	return &SSHConfigFile{sshConfig: cfg}, nil
+	return cfg, nil
 }
 
 func NewEmptySSHConfigStruct() *SSHConfigFile {
 	log.Debugf("generating an empty config struct")
-	return &SSHConfigFile{sshConfig: &ssh_config.Config{}}
+	return &SSHConfigFile{}
 }
 
 // Get consults a ssh config file to extract some ssh server attributes
 // from it, returning a SSHHost. Any attribute which its value is an empty
 // string is an attribute that could not be found in the ssh config file.
 func (r SSHConfigFile) Get(host string) *SSHHost {
-	hostname := r.getHostname(host)
-
-	port, err := r.sshConfig.Get(host, "Port")
-	if err != nil {
-		port = ""
+	o := r.resolve(host)
+
+	localForwards := o.forwards("localforward")
+	remoteForwards := o.forwards("remoteforward")
+
+	h := &SSHHost{
+		Port:           o.get("port"),
+		User:           o.get("user"),
+		Key:            o.path(o.get("identityfile")),
+		IdentityAgent:  o.identityAgent(),
+		LocalForwards:  localForwards,
+		RemoteForwards: remoteForwards,
 	}
 
-	user, err := r.sshConfig.Get(host, "User")
-	if err != nil {
-		user = ""
+	if o.get("hostname") != "" {
+		h.Hostname = o.hostname()
 	}
 
-	localForward, err := r.getForward("LocalForward", host)
-	if err != nil {
-		log.Warningf("error reading local forwarding configuration from ssh config file: %v", err)
+	if len(localForwards) > 0 {
+		h.LocalForward = localForwards[0]
 	}
 
-	remoteForward, err := r.getForward("RemoteForward", host)
-	if err != nil {
-		log.Warningf("error reading remote configuration from ssh config file: %v", err)
-	}
-
-	key := r.getKey(host)
-
-	identityAgent, err := r.sshConfig.Get(host, "IdentityAgent")
-	if err != nil {
-		identityAgent = ""
+	if len(remoteForwards) > 0 {
+		h.RemoteForward = remoteForwards[0]
 	}
 
-	return &SSHHost{
-		Hostname:      hostname,
-		Port:          port,
-		User:          user,
-		Key:           key,
-		IdentityAgent: identityAgent,
-		LocalForward:  localForward,
-		RemoteForward: remoteForward,
-	}
+	return h
 }
 
-func (r SSHConfigFile) getHostname(host string) string {
-	hostname, err := r.sshConfig.Get(host, "Hostname")
-	if err != nil {
-		return ""
+// Hosts returns the name of all hosts declared on the ssh config file that
+// match the given pattern, which follows the same syntax used by the ssh
+// config "Host" keyword (e.g. "db-*").
+//
+// Host declarations that are patterns themselves are not returned. If the
+// given pattern has no wildcards and is not declared on the file, it is
+// returned as is, since it can still be matched by other host declarations.
+func (r SSHConfigFile) Hosts(pattern string) ([]string, error) {
+	hosts := []string{}
+	seen := make(map[string]bool)
+
+	var walk func(sources []*sshConfigSource)
+	walk = func(sources []*sshConfigSource) {
+		for _, src := range sources {
+			for _, d := range src.directives {
+				if d.key == "include" {
+					walk(d.includes)
+					continue
+				}
+
+				if d.key != "host" {
+					continue
+				}
+
+				for _, name := range d.args {
+					if strings.ContainsAny(name, "*?!") || seen[name] {
+						continue
+					}
+
+					if matchPattern(pattern, name) {
+						seen[name] = true
+						hosts = append(hosts, name)
+					}
+				}
+			}
+		}
 	}
 
-	return hostname
-}
+	walk(r.sources)
 
-func (r SSHConfigFile) getForward(forwardType, host string) (*ForwardConfig, error) {
-	c, err := r.sshConfig.Get(host, forwardType)
-	if err != nil {
-		return nil, err
+	if len(hosts) == 0 && !strings.ContainsAny(pattern, "*?!") {
+		hosts = append(hosts, pattern)
 	}
 
-	if c == "" {
-		return nil, nil
-	}
+	return hosts, nil
+}
 
+// parseForward parses the arguments of a LocalForward or RemoteForward
+// keyword, which may take any of the forms below:
+//
+//	[bind_address:]port host:hostport
+//	[bind_address:]port socket_path
+//	socket_path host:hostport
+//	socket_path socket_path
+//
+// IPv6 addresses must be enclosed in square brackets and "/" can be used in
+// place of ":" to separate an address from its port.
+func parseForward(c string) (*ForwardConfig, error) {
 	l := strings.Fields(c)
 
 	if len(l) < 2 {
 		return nil, fmt.Errorf("malformed forwarding configuration on ssh config file: %s", l)
 	}
 
-	source := l[0]
-	destination := l[1]
-
-	if strings.HasPrefix(source, ":") {
-		source = fmt.Sprintf("127.0.0.1%s", source)
+	source, err := parseForwardEndpoint(l[0], true)
+	if err != nil {
+		return nil, err
 	}
 
-	if source != "" && !strings.Contains(source, ":") {
-		source = fmt.Sprintf("127.0.0.1:%s", source)
+	destination, err := parseForwardEndpoint(l[1], false)
+	if err != nil {
+		return nil, err
 	}
 
 	return &ForwardConfig{Source: source, Destination: destination}, nil
-
 }
 
-func (r SSHConfigFile) getKey(host string) string {
-	id, err := r.sshConfig.Get(host, "IdentityFile")
+// parseForwardEndpoint translates one side of a forwarding configuration to
+// an address mole can listen on or dial to. The bind address of a source
+// endpoint is optional and defaults to the loopback interface.
+func parseForwardEndpoint(endpoint string, source bool) (string, error) {
+	if strings.HasPrefix(endpoint, "~") {
+		endpoint = filepath.Join(os.Getenv("HOME"), endpoint[1:])
+	}
 
-	if err != nil {
-		return ""
+	if IsSocketPath(endpoint) {
+		return endpoint, nil
 	}
 
-	if id != "" {
-		if strings.HasPrefix(id, "~") {
-			return filepath.Join(os.Getenv("HOME"), id[1:])
+	var host, port string
+
+	if strings.HasPrefix(endpoint, "[") {
+		i := strings.Index(endpoint, "]")
+		if i < 0 {
+			return "", fmt.Errorf("malformed forwarding address on ssh config file: %s", endpoint)
 		}
 
-		return id
+		host = endpoint[1:i]
+		port = strings.TrimLeft(endpoint[i+1:], ":/")
+	} else if i := strings.LastIndexAny(endpoint, ":/"); i >= 0 {
+		host = endpoint[:i]
+		port = endpoint[i+1:]
+	} else if source {
+		port = endpoint
+	} else {
+		return "", fmt.Errorf("malformed forwarding address on ssh config file: missing port on %s", endpoint)
+	}
+
+	if _, err := strconv.Atoi(port); err != nil {
+		return "", fmt.Errorf("malformed forwarding address on ssh config file: invalid port on %s", endpoint)
 	}
 
-	return ""
+	switch {
+	case source && host == "":
+		host = "127.0.0.1"
+	case source && host == "*":
+		host = "0.0.0.0"
+	case host == "":
+		return "", fmt.Errorf("malformed forwarding address on ssh config file: missing host on %s", endpoint)
+	}
+
+	return net.JoinHostPort(host, port), nil
+}
+
+// IsSocketPath tells if a channel endpoint is the path of a unix socket
+// rather than a network address.
+func IsSocketPath(address string) bool {
+	return strings.HasPrefix(address, "/")
 }
 
 // SSHHost represents a host configuration extracted from a ssh config file.
@@ -161,6 +241,12 @@ type SSHHost struct {
 	IdentityAgent string
 	LocalForward  *ForwardConfig
 	RemoteForward *ForwardConfig
+
+	// LocalForwards and RemoteForwards hold every forwarding configuration
+	// declared for the host, while LocalForward and RemoteForward only hold the
+	// first one.
+	LocalForwards  []*ForwardConfig
+	RemoteForwards []*ForwardConfig
 }
 
 // String returns a string representation of a SSHHost.
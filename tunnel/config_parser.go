@@ -0,0 +1,580 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// matchExecTimeout is the maximum time the command of a "Match exec" criteria
+// is given to exit, after which it is killed and the criteria doesn't match.
+const matchExecTimeout = 5 * time.Second
+
+// maxIncludeDepth is the maximum number of nested Include directives allowed,
+// the same limit used by OpenSSH.
+const maxIncludeDepth = 16
+
+// multiValueKeys are the ssh config keywords that accumulate values instead of
+// keeping the first one obtained.
+var multiValueKeys = map[string]bool{
+	"certificatefile": true,
+	"dynamicforward":  true,
+	"identityfile":    true,
+	"localforward":    true,
+	"remoteforward":   true,
+	"sendenv":         true,
+	"setenv":          true,
+}
+
+var envVarRe = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// sshConfigSource holds the directives read from a single ssh config file.
+type sshConfigSource struct {
+	path string
+	// system tells if the file is (or was included by) the system-wide ssh
+	// config file, which changes how relative Include paths are resolved.
+	system     bool
+	directives []*sshDirective
+}
+
+// sshDirective is a single line of a ssh config file.
+type sshDirective struct {
+	// key is the lower case keyword of the directive.
+	key  string
+	args []string
+	line int
+	// includes holds the files loaded by an Include directive.
+	includes []*sshConfigSource
+}
+
+func parseSSHConfig(path string, system bool, depth int) (*sshConfigSource, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return parseSSHConfigReader(f, path, system, depth)
+}
+
+func parseSSHConfigReader(r io.Reader, path string, system bool, depth int) (*sshConfigSource, error) {
+	src := &sshConfigSource{path: path, system: system}
+
+	s := bufio.NewScanner(r)
+	line := 0
+
+	for s.Scan() {
+		line++
+
+		key, args, err := splitSSHConfigLine(s.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", path, line, err)
+		}
+
+		if key == "" {
+			continue
+		}
+
+		d := &sshDirective{key: key, args: args, line: line}
+
+		if key == "include" {
+			d.includes, err = includeSSHConfig(args, system, depth+1)
+			if err != nil {
+				return nil, fmt.Errorf("%s line %d: %v", path, line, err)
+			}
+		}
+
+		src.directives = append(src.directives, d)
+	}
+
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	return src, nil
+}
+
+// splitSSHConfigLine returns the lower case keyword and the arguments of a ssh
+// config file line. Both keyword and arguments are empty for blank lines and
+// comments.
+func splitSSHConfigLine(line string) (string, []string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", nil, nil
+	}
+
+	i := strings.IndexAny(line, " \t=")
+	if i < 0 {
+		return "", nil, fmt.Errorf("missing argument for %s", line)
+	}
+
+	key := strings.ToLower(line[:i])
+
+	rest := strings.TrimLeft(line[i:], " \t")
+	if strings.HasPrefix(rest, "=") {
+		rest = strings.TrimLeft(rest[1:], " \t")
+	}
+
+	var args []string
+	var arg strings.Builder
+	quoted, pending := false, false
+
+	for _, c := range rest {
+		switch {
+		case c == '"':
+			quoted = !quoted
+			pending = true
+		case !quoted && (c == ' ' || c == '\t'):
+			if pending {
+				args = append(args, arg.String())
+				arg.Reset()
+				pending = false
+			}
+		case !quoted && c == '#' && !pending:
+			// a word starting with "#" comments the rest of the line out.
+			goto done
+		default:
+			arg.WriteRune(c)
+			pending = true
+		}
+	}
+
+done:
+	if quoted {
+		return "", nil, fmt.Errorf("unterminated quote on %s", line)
+	}
+
+	if pending {
+		args = append(args, arg.String())
+	}
+
+	if len(args) == 0 {
+		return "", nil, fmt.Errorf("missing argument for %s", key)
+	}
+
+	return key, args, nil
+}
+
+// includeSSHConfig loads the files referenced by an Include directive. Paths
+// that are not absolute are relative to $HOME/.ssh or, for the system-wide
+// config file, to its own directory. Patterns matching no file are ignored.
+func includeSSHConfig(patterns []string, system bool, depth int) ([]*sshConfigSource, error) {
+	if depth > maxIncludeDepth {
+		return nil, fmt.Errorf("maximum include depth of %d exceeded", maxIncludeDepth)
+	}
+
+	var sources []*sshConfigSource
+
+	for _, p := range patterns {
+		p = expandHome(p)
+
+		if !filepath.IsAbs(p) {
+			if system {
+				p = filepath.Join(filepath.Dir(systemConfigPath), p)
+			} else {
+				home, err := os.UserHomeDir()
+				if err != nil {
+					return nil, err
+				}
+
+				p = filepath.Join(home, ".ssh", p)
+			}
+		}
+
+		matches, err := filepath.Glob(p)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, m := range matches {
+			src, err := parseSSHConfig(m, system, depth)
+			if err != nil {
+				return nil, err
+			}
+
+			sources = append(sources, src)
+		}
+	}
+
+	return sources, nil
+}
+
+// resolve evaluates all ssh config files for the given host, returning the
+// options that apply to it.
+func (r SSHConfigFile) resolve(host string) *sshOptions {
+	o := &sshOptions{host: host, values: make(map[string][]string), execs: make(map[string]bool)}
+
+	for _, src := range r.sources {
+		o.apply(src)
+	}
+
+	return o
+}
+
+// sshOptions holds the options resolved for a host.
+type sshOptions struct {
+	// host is the host name as given by the user.
+	host   string
+	values map[string][]string
+	// execs holds the result of each "Match exec" command already run while
+	// resolving the options, so each command runs at most once.
+	execs map[string]bool
+}
+
+// apply evaluates the directives of a ssh config file, keeping the ones that
+// apply to the host. Directives before the first Host or Match block apply to
+// all hosts.
+func (o *sshOptions) apply(src *sshConfigSource) {
+	active := true
+
+	for _, d := range src.directives {
+		switch d.key {
+		case "host":
+			active = matchPatternList(d.args, o.host)
+		case "match":
+			active = o.match(src, d)
+		case "include":
+			if active {
+				for _, inc := range d.includes {
+					o.apply(inc)
+				}
+			}
+		default:
+			if active {
+				o.set(d.key, strings.Join(d.args, " "))
+			}
+		}
+	}
+}
+
+func (o *sshOptions) set(key, value string) {
+	if multiValueKeys[key] {
+		o.values[key] = append(o.values[key], value)
+		return
+	}
+
+	if _, ok := o.values[key]; !ok {
+		o.values[key] = []string{value}
+	}
+}
+
+func (o *sshOptions) get(key string) string {
+	if v := o.values[key]; len(v) > 0 {
+		return v[0]
+	}
+
+	return ""
+}
+
+// match evaluates the criteria of a Match directive. Since mole reads the ssh
+// config files only once, both "canonical" and "final" criteria match as if
+// it was the final pass of OpenSSH.
+func (o *sshOptions) match(src *sshConfigSource, d *sshDirective) bool {
+	for i := 0; i < len(d.args); i++ {
+		criteria := strings.ToLower(d.args[i])
+
+		negate := strings.HasPrefix(criteria, "!")
+		criteria = strings.TrimPrefix(criteria, "!")
+
+		var matched bool
+
+		switch criteria {
+		case "all", "canonical", "final":
+			matched = true
+		case "host", "originalhost", "user", "localuser", "exec":
+			if i+1 >= len(d.args) {
+				log.Warnf("%s line %d: missing argument for Match %s", src.path, d.line, criteria)
+				return false
+			}
+
+			i++
+			arg := d.args[i]
+
+			switch criteria {
+			case "host":
+				matched = matchPatternList(strings.Split(arg, ","), o.hostname())
+			case "originalhost":
+				matched = matchPatternList(strings.Split(arg, ","), o.host)
+			case "user":
+				matched = matchPatternList(strings.Split(arg, ","), o.remoteUser())
+			case "localuser":
+				matched = matchPatternList(strings.Split(arg, ","), localUser())
+			case "exec":
+				matched = o.exec(arg)
+			}
+		default:
+			log.Warnf("%s line %d: unsupported Match criteria %s", src.path, d.line, criteria)
+			return false
+		}
+
+		if matched == negate {
+			return false
+		}
+	}
+
+	return true
+}
+
+// exec runs the command of a "Match exec" criteria, which matches if the
+// command exits successfully within matchExecTimeout. The same command is
+// only run once while resolving the options of a host.
+func (o *sshOptions) exec(command string) bool {
+	command = o.expandTokens(command)
+
+	if matched, ok := o.execs[command]; ok {
+		return matched
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), matchExecTimeout)
+	defer cancel()
+
+	err := exec.CommandContext(ctx, "/bin/sh", "-c", command).Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("command did not exit after %s", matchExecTimeout)
+	}
+
+	log.WithFields(log.Fields{
+		"command": command,
+		"host":    o.host,
+	}).WithError(err).Debug("ssh config Match exec evaluated")
+
+	o.execs[command] = err == nil
+
+	return err == nil
+}
+
+// hostname returns the name of the host to connect to, which is the host
+// given by the user unless the Hostname option says otherwise.
+func (o *sshOptions) hostname() string {
+	h := o.get("hostname")
+	if h == "" {
+		return o.host
+	}
+
+	return strings.NewReplacer("%h", o.host, "%%", "%").Replace(h)
+}
+
+// remoteUser returns the user to log in as, defaulting to the local user.
+func (o *sshOptions) remoteUser() string {
+	if u := o.get("user"); u != "" {
+		return u
+	}
+
+	return localUser()
+}
+
+func (o *sshOptions) port() string {
+	if p := o.get("port"); p != "" {
+		return p
+	}
+
+	return "22"
+}
+
+// identityAgent returns the IdentityAgent option, translating the special
+// values supported by OpenSSH.
+func (o *sshOptions) identityAgent() string {
+	a := o.get("identityagent")
+
+	switch a {
+	case "", "none":
+		return ""
+	case "SSH_AUTH_SOCK":
+		return "$SSH_AUTH_SOCK"
+	}
+
+	if strings.HasPrefix(a, "$") {
+		return a
+	}
+
+	return o.path(a)
+}
+
+// path expands "~", environment variables and "%" tokens of a path option
+// like IdentityFile and IdentityAgent.
+func (o *sshOptions) path(p string) string {
+	if p == "" {
+		return ""
+	}
+
+	p = expandHome(p)
+
+	p = envVarRe.ReplaceAllStringFunc(p, func(v string) string {
+		return os.Getenv(envVarRe.FindStringSubmatch(v)[1])
+	})
+
+	return o.expandTokens(p)
+}
+
+// forwards returns the forwarding configurations given by the key, which is
+// either localforward or remoteforward. Malformed values are skipped, so the
+// valid ones can still be used.
+func (o *sshOptions) forwards(key string) []*ForwardConfig {
+	var forwards []*ForwardConfig
+
+	for _, v := range o.values[key] {
+		f, err := parseForward(o.expandTokens(v))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"host":  o.host,
+				"key":   key,
+				"value": v,
+			}).WithError(err).Warn("skipping malformed forwarding configuration from ssh config file")
+
+			continue
+		}
+
+		forwards = append(forwards, f)
+	}
+
+	return forwards
+}
+
+// expandTokens replaces the "%" tokens supported by OpenSSH on the given
+// value:
+//
+//	%%  a literal "%"
+//	%d  local user home directory
+//	%h  remote host name
+//	%i  local user id
+//	%L  local host name, without domain
+//	%l  local host name
+//	%n  host name as given by the user
+//	%p  remote port
+//	%r  remote user name
+//	%u  local user name
+func (o *sshOptions) expandTokens(value string) string {
+	if !strings.Contains(value, "%") {
+		return value
+	}
+
+	var b strings.Builder
+
+	for i := 0; i < len(value); i++ {
+		if value[i] != '%' || i+1 == len(value) {
+			b.WriteByte(value[i])
+			continue
+		}
+
+		i++
+
+		switch value[i] {
+		case '%':
+			b.WriteByte('%')
+		case 'd':
+			home, _ := os.UserHomeDir()
+			b.WriteString(home)
+		case 'h':
+			b.WriteString(o.hostname())
+		case 'i':
+			b.WriteString(strconv.Itoa(os.Getuid()))
+		case 'L':
+			h, _ := os.Hostname()
+			b.WriteString(strings.SplitN(h, ".", 2)[0])
+		case 'l':
+			h, _ := os.Hostname()
+			b.WriteString(h)
+		case 'n':
+			b.WriteString(o.host)
+		case 'p':
+			b.WriteString(o.port())
+		case 'r':
+			b.WriteString(o.remoteUser())
+		case 'u':
+			b.WriteString(localUser())
+		default:
+			log.Warnf("unsupported token %%%c found on ssh config value %s", value[i], value)
+			b.WriteByte('%')
+			b.WriteByte(value[i])
+		}
+	}
+
+	return b.String()
+}
+
+func localUser() string {
+	u, err := user.Current()
+	if err != nil {
+		return os.Getenv("USER")
+	}
+
+	return u.Username
+}
+
+func expandHome(p string) string {
+	if p != "~" && !strings.HasPrefix(p, "~/") {
+		return p
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return p
+	}
+
+	return filepath.Join(home, p[1:])
+}
+
+// matchPatternList tells if a value matches a list of ssh config patterns. A
+// value matching any pattern prefixed by "!" never matches the list.
+func matchPatternList(patterns []string, value string) bool {
+	matched := false
+
+	for _, p := range patterns {
+		negated := strings.HasPrefix(p, "!")
+
+		if matchPattern(strings.TrimPrefix(p, "!"), value) {
+			if negated {
+				return false
+			}
+
+			matched = true
+		}
+	}
+
+	return matched
+}
+
+// matchPattern tells if a value matches a ssh config pattern, where "*"
+// matches zero or more characters and "?" matches exactly one character.
+// Matching is case insensitive.
+func matchPattern(pattern, value string) bool {
+	pattern = strings.ToLower(pattern)
+	value = strings.ToLower(value)
+
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := 0; i <= len(value); i++ {
+				if matchPattern(pattern[1:], value[i:]) {
+					return true
+				}
+			}
+
+			return false
+		case '?':
+			if len(value) == 0 {
+				return false
+			}
+		default:
+			if len(value) == 0 || pattern[0] != value[0] {
+				return false
+			}
+		}
+
+		pattern = pattern[1:]
+		value = value[1:]
+	}
+
+	return len(value) == 0
+}
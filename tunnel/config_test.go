@@ -1,11 +1,13 @@
 package tunnel
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
-
-	"github.com/kevinburke/ssh_config"
 )
 
 func TestSSHConfigFile(t *testing.T) {
@@ -27,8 +29,7 @@ Host example5
 
 `
 
-	c, _ := ssh_config.Decode(strings.NewReader(config))
-	cfg := &SSHConfigFile{sshConfig: c}
+	cfg := newSSHConfigFileFromString(t, config)
 
 	tests := []struct {
 		host     string
@@ -47,41 +48,45 @@ Host example5
 		{
 			"example2",
 			&SSHHost{
-				Hostname:     "",
-				Port:         "",
-				User:         "",
-				Key:          "",
-				LocalForward: &ForwardConfig{Source: "127.0.0.1:8080", Destination: "127.0.0.1:8080"},
+				Hostname:      "",
+				Port:          "",
+				User:          "",
+				Key:           "",
+				LocalForward:  &ForwardConfig{Source: "127.0.0.1:8080", Destination: "127.0.0.1:8080"},
+				LocalForwards: []*ForwardConfig{&ForwardConfig{Source: "127.0.0.1:8080", Destination: "127.0.0.1:8080"}},
 			},
 		},
 		{
 			"example3",
 			&SSHHost{
-				Hostname:     "",
-				Port:         "",
-				User:         "",
-				Key:          "",
-				LocalForward: &ForwardConfig{Source: "127.0.0.1:9090", Destination: "127.0.0.1:9090"},
+				Hostname:      "",
+				Port:          "",
+				User:          "",
+				Key:           "",
+				LocalForward:  &ForwardConfig{Source: "127.0.0.1:9090", Destination: "127.0.0.1:9090"},
+				LocalForwards: []*ForwardConfig{&ForwardConfig{Source: "127.0.0.1:9090", Destination: "127.0.0.1:9090"}},
 			},
 		},
 		{
 			"example4",
 			&SSHHost{
-				Hostname:      "",
-				Port:          "",
-				User:          "",
-				Key:           "",
-				RemoteForward: &ForwardConfig{Source: "127.0.0.1:80", Destination: "127.0.0.1:8080"},
+				Hostname:       "",
+				Port:           "",
+				User:           "",
+				Key:            "",
+				RemoteForward:  &ForwardConfig{Source: "127.0.0.1:80", Destination: "127.0.0.1:8080"},
+				RemoteForwards: []*ForwardConfig{&ForwardConfig{Source: "127.0.0.1:80", Destination: "127.0.0.1:8080"}},
 			},
 		},
 		{
 			"example5",
 			&SSHHost{
-				Hostname:      "",
-				Port:          "",
-				User:          "",
-				Key:           "",
-				RemoteForward: &ForwardConfig{Source: "192.168.1.100:80", Destination: "my-server:8080"},
+				Hostname:       "",
+				Port:           "",
+				User:           "",
+				Key:            "",
+				RemoteForward:  &ForwardConfig{Source: "192.168.1.100:80", Destination: "my-server:8080"},
+				RemoteForwards: []*ForwardConfig{&ForwardConfig{Source: "192.168.1.100:80", Destination: "my-server:8080"}},
 			},
 		},
 	}
@@ -95,3 +100,325 @@ Host example5
 		}
 	}
 }
+
+func TestSSHConfigFileMultipleForwards(t *testing.T) {
+	var config = `
+Host multi
+	LocalForward 8080 127.0.0.1:80
+	LocalForward 9090 127.0.0.1:90
+	RemoteForward 7070 127.0.0.1:70
+`
+
+	cfg := newSSHConfigFileFromString(t, config)
+
+	h := cfg.Get("multi")
+
+	expectedLocal := []*ForwardConfig{
+		{Source: "127.0.0.1:8080", Destination: "127.0.0.1:80"},
+		{Source: "127.0.0.1:9090", Destination: "127.0.0.1:90"},
+	}
+
+	if !reflect.DeepEqual(expectedLocal, h.LocalForwards) {
+		t.Errorf("unexpected local forwards: %s", h.LocalForwards)
+	}
+
+	if !reflect.DeepEqual(expectedLocal[0], h.LocalForward) {
+		t.Errorf("unexpected local forward: %s", h.LocalForward)
+	}
+
+	expectedRemote := []*ForwardConfig{
+		{Source: "127.0.0.1:7070", Destination: "127.0.0.1:70"},
+	}
+
+	if !reflect.DeepEqual(expectedRemote, h.RemoteForwards) {
+		t.Errorf("unexpected remote forwards: %s", h.RemoteForwards)
+	}
+}
+
+func TestSSHConfigFileMalformedForward(t *testing.T) {
+	var config = `
+Host malformed
+	LocalForward 8080 127.0.0.1:80
+	LocalForward 9090
+	LocalForward 7070 127.0.0.1:70
+`
+
+	cfg := newSSHConfigFileFromString(t, config)
+
+	h := cfg.Get("malformed")
+
+	expected := []*ForwardConfig{
+		{Source: "127.0.0.1:8080", Destination: "127.0.0.1:80"},
+		{Source: "127.0.0.1:7070", Destination: "127.0.0.1:70"},
+	}
+
+	if !reflect.DeepEqual(expected, h.LocalForwards) {
+		t.Errorf("unexpected local forwards: %s", h.LocalForwards)
+	}
+}
+
+func TestSSHConfigFileHosts(t *testing.T) {
+	var config = `
+Host db-1 db-2
+	Hostname 10.0.0.1
+Host web
+	Hostname 10.0.0.2
+Host db-*
+	User john
+`
+
+	cfg := newSSHConfigFileFromString(t, config)
+
+	tests := []struct {
+		pattern  string
+		expected []string
+	}{
+		{"db-*", []string{"db-1", "db-2"}},
+		{"web", []string{"web"}},
+		{"*", []string{"db-1", "db-2", "web"}},
+		{"undeclared", []string{"undeclared"}},
+		{"none-*", []string{}},
+	}
+
+	for _, test := range tests {
+		hosts, err := cfg.Hosts(test.pattern)
+		if err != nil {
+			t.Errorf("unexpected error for %s: %v", test.pattern, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(test.expected, hosts) {
+			t.Errorf("unexpected hosts for %s: expected %v, got %v", test.pattern, test.expected, hosts)
+		}
+	}
+}
+
+func TestParseForward(t *testing.T) {
+	tests := []struct {
+		forward       string
+		expected      *ForwardConfig
+		expectedError bool
+	}{
+		{"8080 example:80", &ForwardConfig{Source: "127.0.0.1:8080", Destination: "example:80"}, false},
+		{":8080 example:80", &ForwardConfig{Source: "127.0.0.1:8080", Destination: "example:80"}, false},
+		{"*:8080 example:80", &ForwardConfig{Source: "0.0.0.0:8080", Destination: "example:80"}, false},
+		{"192.168.1.1:8080 example/80", &ForwardConfig{Source: "192.168.1.1:8080", Destination: "example:80"}, false},
+		{"[::1]:8080 [fe80::1]:80", &ForwardConfig{Source: "[::1]:8080", Destination: "[fe80::1]:80"}, false},
+		{"8080 /var/run/app.sock", &ForwardConfig{Source: "127.0.0.1:8080", Destination: "/var/run/app.sock"}, false},
+		{"/tmp/local.sock example:80", &ForwardConfig{Source: "/tmp/local.sock", Destination: "example:80"}, false},
+		{"/tmp/local.sock /var/run/app.sock", &ForwardConfig{Source: "/tmp/local.sock", Destination: "/var/run/app.sock"}, false},
+		{"8080", nil, true},
+		{"8080 example", nil, true},
+		{"abc example:80", nil, true},
+	}
+
+	for _, test := range tests {
+		f, err := parseForward(test.forward)
+		if test.expectedError {
+			if err == nil {
+				t.Errorf("expected error for %s, got %s", test.forward, f)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("unexpected error for %s: %v", test.forward, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(test.expected, f) {
+			t.Errorf("unexpected result for %s: expected %s, got %s", test.forward, test.expected, f)
+		}
+	}
+}
+
+func newSSHConfigFileFromString(t *testing.T, config string) *SSHConfigFile {
+	src, err := parseSSHConfigReader(strings.NewReader(config), "config", false, 0)
+	if err != nil {
+		t.Fatalf("could not parse ssh config: %v", err)
+	}
+
+	return &SSHConfigFile{sources: []*sshConfigSource{src}}
+}
+
+func TestSSHConfigMatchExecRunsOnce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mole-match-exec")
+	if err != nil {
+		t.Fatalf("could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "runs")
+
+	cfg := newSSHConfigFileFromString(t, fmt.Sprintf(`
+Match exec "echo %%n >> %[1]s"
+    User first
+
+Match exec "echo %%n >> %[1]s"
+    Port 2222
+`, out))
+
+	h := cfg.Get("example")
+
+	if h.User != "first" || h.Port != "2222" {
+		t.Errorf("unexpected host settings: user=%s, port=%s", h.User, h.Port)
+	}
+
+	runs, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatalf("could not read the output of the match command: %v", err)
+	}
+
+	if string(runs) != "example\n" {
+		t.Errorf("match command is expected to run once per lookup, got output %q", runs)
+	}
+}
+
+func TestSSHConfigFileFixture(t *testing.T) {
+	sys := systemConfigPath
+	systemConfigPath = filepath.Join("testdata", "sshconfig", "ssh_config")
+	defer func() { systemConfigPath = sys }()
+
+	cfg, err := NewSSHConfigFile(filepath.Join("testdata", "sshconfig", "config"))
+	if err != nil {
+		t.Fatalf("could not read ssh config fixture: %v", err)
+	}
+
+	systemForward := &ForwardConfig{Source: "127.0.0.1:9000", Destination: "127.0.0.1:9000"}
+	dbForward := &ForwardConfig{Source: "127.0.0.1:5432", Destination: "127.0.0.1:5432"}
+	workForward := &ForwardConfig{Source: "127.0.0.1:8080", Destination: "127.0.0.1:80"}
+
+	tests := []struct {
+		host     string
+		expected *SSHHost
+	}{
+		{
+			"bastion",
+			&SSHHost{
+				Hostname:       "10.0.0.1",
+				Port:           "2222",
+				User:           "admin",
+				Key:            filepath.Join("testdata", ".ssh", "10.0.0.1_key"),
+				IdentityAgent:  filepath.Join("testdata", "agent", localUser()+".sock"),
+				RemoteForward:  systemForward,
+				RemoteForwards: []*ForwardConfig{systemForward},
+			},
+		},
+		{
+			"db-1",
+			&SSHHost{
+				Port:           "2222",
+				User:           "dba",
+				Key:            filepath.Join("testdata", ".ssh", "id_dba"),
+				IdentityAgent:  "/run/system-agent.sock",
+				LocalForward:   dbForward,
+				RemoteForward:  systemForward,
+				LocalForwards:  []*ForwardConfig{dbForward},
+				RemoteForwards: []*ForwardConfig{systemForward},
+			},
+		},
+		{
+			"db-legacy",
+			&SSHHost{
+				Port:           "2222",
+				User:           "legacy",
+				Key:            filepath.Join("testdata", ".ssh", "id_legacy"),
+				IdentityAgent:  "/run/system-agent.sock",
+				RemoteForward:  systemForward,
+				RemoteForwards: []*ForwardConfig{systemForward},
+			},
+		},
+		{
+			"work",
+			&SSHHost{
+				Hostname:       "work.example.com",
+				Port:           "2222",
+				User:           "default",
+				Key:            filepath.Join("testdata", ".ssh", "id_default"),
+				IdentityAgent:  "/run/system-agent.sock",
+				LocalForward:   workForward,
+				RemoteForward:  systemForward,
+				LocalForwards:  []*ForwardConfig{workForward},
+				RemoteForwards: []*ForwardConfig{systemForward},
+			},
+		},
+		{
+			"work-eu",
+			&SSHHost{
+				Hostname:       "work-eu.example.com",
+				Port:           "2222",
+				User:           "worker",
+				Key:            filepath.Join("testdata", ".ssh", "id_worker"),
+				IdentityAgent:  "/run/system-agent.sock",
+				RemoteForward:  systemForward,
+				RemoteForwards: []*ForwardConfig{systemForward},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		value := cfg.Get(test.host)
+
+		if !reflect.DeepEqual(test.expected, value) {
+			t.Errorf("unexpected result for %s:\n\texpected: %s\n\tvalue   : %s", test.host, test.expected, value)
+		}
+	}
+
+	hosts, err := cfg.Hosts("*")
+	if err != nil {
+		t.Fatalf("unexpected error listing hosts: %v", err)
+	}
+
+	expectedHosts := []string{"work", "bastion"}
+	if !reflect.DeepEqual(expectedHosts, hosts) {
+		t.Errorf("unexpected hosts: expected %v, got %v", expectedHosts, hosts)
+	}
+}
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		value    string
+		expected bool
+	}{
+		{[]string{"*"}, "example", true},
+		{[]string{"ex?mple"}, "EXAMPLE", true},
+		{[]string{"ex*"}, "other", false},
+		{[]string{"*.example.com", "!db.example.com"}, "web.example.com", true},
+		{[]string{"*.example.com", "!db.example.com"}, "db.example.com", false},
+		{[]string{"!db"}, "web", false},
+	}
+
+	for _, test := range tests {
+		if matched := matchPatternList(test.patterns, test.value); matched != test.expected {
+			t.Errorf("unexpected result matching %s against %v: expected %t, got %t", test.value, test.patterns, test.expected, matched)
+		}
+	}
+}
+
+func TestSplitSSHConfigLine(t *testing.T) {
+	tests := []struct {
+		line         string
+		expectedKey  string
+		expectedArgs []string
+	}{
+		{"  # a comment", "", nil},
+		{"Hostname example.com", "hostname", []string{"example.com"}},
+		{"Port=2222", "port", []string{"2222"}},
+		{"IdentityFile = \"/path/with space/key\"", "identityfile", []string{"/path/with space/key"}},
+		{"LocalForward 8080 example:80 # trailing comment", "localforward", []string{"8080", "example:80"}},
+	}
+
+	for _, test := range tests {
+		key, args, err := splitSSHConfigLine(test.line)
+		if err != nil {
+			t.Errorf("unexpected error for %s: %v", test.line, err)
+			continue
+		}
+
+		if key != test.expectedKey || !reflect.DeepEqual(test.expectedArgs, args) {
+			t.Errorf("unexpected result for %s: %s %v", test.line, key, args)
+		}
+	}
+}
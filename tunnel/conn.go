@@ -0,0 +1,136 @@
+package tunnel
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// activity keeps track of the last time data was transferred through a
+// connection.
+type activity struct {
+	last int64
+}
+
+func newActivity() *activity {
+	a := &activity{}
+	a.touch()
+
+	return a
+}
+
+func (a *activity) touch() {
+	atomic.StoreInt64(&a.last, time.Now().UnixNano())
+}
+
+// idle returns the time elapsed since data was last transferred.
+func (a *activity) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&a.last)))
+}
+
+// meteredConn is a net.Conn that records every successful read as activity
+// and on the capture, if any, and holds the data read back as long as needed
+// to respect the given limiters.
+type meteredConn struct {
+	net.Conn
+	activity *activity
+	limiters []*limiter
+	capture  *capture
+	// fromClient tells if the data is read from the client side of the
+	// connection.
+	fromClient bool
+}
+
+func (c *meteredConn) Read(b []byte) (int, error) {
+	if size := chunkSize(c.limiters); size > 0 && len(b) > size {
+		b = b[:size]
+	}
+
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.activity.touch()
+		throttle(c.limiters, n)
+
+		if c.capture != nil {
+			c.capture.record(c.fromClient, b[:n])
+		}
+	}
+
+	if err == io.EOF && c.capture != nil {
+		c.capture.finish(c.fromClient)
+	}
+
+	return n, err
+}
+
+// watchConn blocks until done is closed or one of the limits described by the
+// given options is reached, in which case the reason is returned.
+func watchConn(opts ChannelOptions, act *activity, done <-chan struct{}) string {
+	var lifetime, idle <-chan time.Time
+
+	if opts.MaxLifetime > 0 {
+		timer := time.NewTimer(opts.MaxLifetime)
+		defer timer.Stop()
+		lifetime = timer.C
+	}
+
+	var idleTimer *time.Timer
+	if opts.IdleTimeout > 0 {
+		idleTimer = time.NewTimer(opts.IdleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+
+	for {
+		select {
+		case <-done:
+			return ""
+		case <-lifetime:
+			return "maximum lifetime reached"
+		case <-idle:
+			elapsed := act.idle()
+			if elapsed >= opts.IdleTimeout {
+				return "idle timeout reached"
+			}
+
+			idleTimer.Reset(opts.IdleTimeout - elapsed)
+		}
+	}
+}
+
+// dialTimeout runs the given dial function, giving up after timeout, if
+// greater than zero. A connection established after giving up is closed.
+func dialTimeout(dial func() (net.Conn, error), timeout time.Duration) (net.Conn, error) {
+	if timeout <= 0 {
+		return dial()
+	}
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		conn, err := dial()
+		done <- result{conn, err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case r := <-done:
+		return r.conn, r.err
+	case <-timer.C:
+		go func() {
+			if r := <-done; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+
+		return nil, fmt.Errorf("dial timeout after %s", timeout)
+	}
+}
@@ -6,16 +6,29 @@ name and key when not provided.
 
 SSH Config File Support
 
-The module looks for the ssh config file stored on $HOME/.ssh/config only.
-There is no fallback support to try to use /etc/ssh/config.
+The module reads the ssh config file given by the user (e.g.
+$HOME/.ssh/config) followed by the system-wide /etc/ssh/ssh_config, resolving
+options the same way OpenSSH does: the first value obtained for an option is
+used, "Host *" blocks act as defaults when placed at the end of a file,
+Include directives are followed and Match blocks (all, canonical, final, host,
+originalhost, user, localuser and exec criteria) are evaluated.
 
 The current API supports the following ssh config file options:
 
 	Host
-  Hostname
-  User
-  Port
-  IdentityKey
+	Match
+	Include
+	Hostname
+	User
+	Port
+	IdentityFile
+	IdentityAgent
+	LocalForward
+	RemoteForward
+
+IdentityFile, IdentityAgent and unix socket paths of forwards may use "~",
+environment variables (e.g. ${HOME}) and the %%, %d, %h, %i, %L, %l, %n, %p,
+%r and %u tokens.
 
 For more information about SSH Local Port Forwarding, please visit:
 https://www.ssh.com/ssh/tunneling/example#sec-Local-Forwarding
@@ -0,0 +1,213 @@
+package tunnel
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// proxyRequestTimeout is the maximum time waited for clients of an HTTP proxy
+// channel to send their request.
+const proxyRequestTimeout = 30 * time.Second
+
+// httpProxy holds the settings of a channel acting as an HTTP proxy.
+type httpProxy struct {
+	// hosts lists the target hosts clients can connect to, either as exact
+	// names or as "*.<domain>" to match any host on a domain. An empty list
+	// allows any host.
+	hosts []string
+}
+
+// AddHTTPProxy adds a channel listening on the local source address that acts
+// as an HTTP proxy, connecting to the targets asked by clients, either through
+// CONNECT or through requests to absolute URIs, from the ssh server. Targets
+// must match one of the given hosts, if any. It must be called before the
+// tunnel starts and is only supported by local tunnels.
+func (t *Tunnel) AddHTTPProxy(source string, hosts []string) error {
+	if t.Type != "local" {
+		return fmt.Errorf("http proxy channels are only supported by local tunnels")
+	}
+
+	if source == "" {
+		return fmt.Errorf("invalid http proxy channel: missing source address")
+	}
+
+	ch := newSSHChannel(t.Type, expandAddress(source), "")
+	ch.proxy = &httpProxy{hosts: hosts}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.proxies = append(t.proxies, ch)
+
+	return nil
+}
+
+// HTTPProxies returns the HTTP proxy channels of the tunnel.
+func (t *Tunnel) HTTPProxies() []*SSHChannel {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return append([]*SSHChannel{}, t.proxies...)
+}
+
+// allows tells if clients can connect to the given host through the proxy.
+func (p *httpProxy) allows(host string) bool {
+	if len(p.hosts) == 0 {
+		return true
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	for _, h := range p.hosts {
+		h = strings.ToLower(h)
+
+		if h == host {
+			return true
+		}
+
+		if strings.HasPrefix(h, "*.") && strings.HasSuffix(host, h[1:]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// forwardProxy reads the request of a client connected to an HTTP proxy
+// channel and connects it to the target it asks for, through the ssh server.
+//
+// CONNECT requests are answered once the target is reached and the connection
+// is then piped to it as is. Plain HTTP requests to absolute URIs are sent to
+// the target on origin form, asking it to close the connection after the
+// response, so each connection serves a single request.
+func (t *Tunnel) forwardProxy(channel *SSHChannel, conn net.Conn) {
+	fields := log.Fields{
+		"channel": channel,
+		"client":  conn.RemoteAddr(),
+	}
+
+	fail := func(status int, err error) {
+		if status != 0 {
+			fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nConnection: close\r\nContent-Length: 0\r\n\r\n", status, http.StatusText(status))
+		}
+
+		conn.Close()
+		t.connClosed(channel)
+
+		if status == http.StatusForbidden {
+			t.countDenied(channel)
+		} else {
+			t.countFailed(channel)
+		}
+
+		log.WithFields(fields).WithError(err).Warn("closing http proxy client connection")
+	}
+
+	r := bufio.NewReader(conn)
+
+	conn.SetReadDeadline(time.Now().Add(proxyRequestTimeout))
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		fail(0, fmt.Errorf("invalid http request: %v", err))
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	target, err := proxyTarget(req)
+	if err != nil {
+		fail(http.StatusBadRequest, err)
+		return
+	}
+
+	fields["method"] = req.Method
+	fields["target"] = target
+
+	host, _, _ := net.SplitHostPort(target)
+	if !channel.proxy.allows(host) {
+		fail(http.StatusForbidden, fmt.Errorf("target host %s is not allowed", host))
+		return
+	}
+
+	client, err := t.connection()
+	if err != nil {
+		fail(http.StatusBadGateway, fmt.Errorf("could not connect to the ssh server: %v", err))
+		return
+	}
+
+	destination, err := dialTimeout(func() (net.Conn, error) {
+		return client.Dial("tcp", target)
+	}, t.destinationTimeout())
+	if err != nil {
+		fail(http.StatusBadGateway, fmt.Errorf("could not connect to the target: %v", err))
+		return
+	}
+
+	if req.Method == http.MethodConnect {
+		_, err = fmt.Fprint(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	} else {
+		req.Header.Del("Proxy-Connection")
+		req.Header.Del("Proxy-Authorization")
+		req.Close = true
+
+		err = req.Write(destination)
+	}
+
+	if err != nil {
+		destination.Close()
+		fail(0, err)
+		return
+	}
+
+	log.WithFields(fields).Info("http proxy connection established")
+
+	// data sent by the client right after its request is still buffered.
+	t.pipe(channel, &bufferedConn{Conn: conn, reader: r}, destination)
+}
+
+// proxyTarget returns the address of the target asked by a request to an HTTP
+// proxy.
+func proxyTarget(req *http.Request) (string, error) {
+	host, port := req.Host, "443"
+
+	if req.Method != http.MethodConnect {
+		if !req.URL.IsAbs() || req.URL.Scheme != "http" {
+			return "", fmt.Errorf("only CONNECT and requests to absolute http URIs are supported: %s %s", req.Method, req.RequestURI)
+		}
+
+		host, port = req.URL.Host, "80"
+	}
+
+	if host == "" {
+		return "", fmt.Errorf("missing target host")
+	}
+
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		host, port = h, p
+	}
+
+	return net.JoinHostPort(strings.Trim(host, "[]"), port), nil
+}
+
+// bufferedConn is a connection whose data is read through a buffered reader.
+type bufferedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// CloseWrite shuts down the writing side of the underlying connection, if
+// supported.
+func (c *bufferedConn) CloseWrite() error {
+	closeWrite(c.Conn)
+	return nil
+}
@@ -0,0 +1,76 @@
+package tunnel
+
+import (
+	"bufio"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestProxyTarget(t *testing.T) {
+	tests := []struct {
+		request  string
+		expected string
+		err      bool
+	}{
+		{"CONNECT example.com:8443 HTTP/1.1\r\nHost: example.com:8443\r\n\r\n", "example.com:8443", false},
+		{"CONNECT example.com HTTP/1.1\r\nHost: example.com\r\n\r\n", "example.com:443", false},
+		{"CONNECT [2001:db8::1]:22 HTTP/1.1\r\nHost: [2001:db8::1]:22\r\n\r\n", "[2001:db8::1]:22", false},
+		{"GET http://example.com/path HTTP/1.1\r\nHost: example.com\r\n\r\n", "example.com:80", false},
+		{"GET http://example.com:8080/path HTTP/1.1\r\nHost: example.com:8080\r\n\r\n", "example.com:8080", false},
+		{"GET /path HTTP/1.1\r\nHost: example.com\r\n\r\n", "", true},
+		{"GET https://example.com/path HTTP/1.1\r\nHost: example.com\r\n\r\n", "", true},
+	}
+
+	for _, test := range tests {
+		req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(test.request)))
+		if err != nil {
+			t.Errorf("error parsing request %q: %v", test.request, err)
+			continue
+		}
+
+		target, err := proxyTarget(req)
+		if test.err {
+			if err == nil {
+				t.Errorf("expected error for request %q", test.request)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("unexpected error for request %q: %v", test.request, err)
+			continue
+		}
+
+		if target != test.expected {
+			t.Errorf("unexpected target for request %q: expected %s, got %s", test.request, test.expected, target)
+		}
+	}
+}
+
+func TestHTTPProxyAllows(t *testing.T) {
+	p := &httpProxy{hosts: []string{"example.com", "*.internal.example.org"}}
+
+	tests := []struct {
+		host     string
+		expected bool
+	}{
+		{"example.com", true},
+		{"EXAMPLE.com.", true},
+		{"www.example.com", false},
+		{"db.internal.example.org", true},
+		{"internal.example.org", false},
+		{"example.org", false},
+	}
+
+	for _, test := range tests {
+		if allowed := p.allows(test.host); allowed != test.expected {
+			t.Errorf("unexpected result for host %s: expected %t, got %t", test.host, test.expected, allowed)
+		}
+	}
+
+	if !(&httpProxy{}).allows("anything") {
+		t.Errorf("proxies without an allow list must allow any host")
+	}
+}
@@ -0,0 +1,202 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ConnectionPolicy tells what happens to new connections to a channel that
+// reached its maximum number of concurrent connections.
+type ConnectionPolicy string
+
+const (
+	// QueuePolicy stops accepting connections until a slot is released, leaving
+	// new connections on the listener backlog.
+	QueuePolicy ConnectionPolicy = "queue"
+
+	// RejectPolicy closes new connections right away.
+	RejectPolicy ConnectionPolicy = "reject"
+
+	// HoldPolicy accepts new connections but only connects them to the channel
+	// destination once a slot is released.
+	HoldPolicy ConnectionPolicy = "hold"
+)
+
+var errChannelClosed = errors.New("tunnel channel closed while waiting for a connection slot")
+
+// ParseConnectionPolicy returns the connection policy with the given name,
+// which defaults to QueuePolicy if empty.
+func ParseConnectionPolicy(policy string) (ConnectionPolicy, error) {
+	switch ConnectionPolicy(policy) {
+	case "", QueuePolicy:
+		return QueuePolicy, nil
+	case RejectPolicy, HoldPolicy:
+		return ConnectionPolicy(policy), nil
+	default:
+		return "", fmt.Errorf("unknown connection policy %s: must be one of %s, %s or %s", policy, QueuePolicy, RejectPolicy, HoldPolicy)
+	}
+}
+
+// Kinds of channels reported by ChannelStats.
+const (
+	ForwardKind   = "forward"
+	HTTPProxyKind = "http-proxy"
+	UDPKind       = "udp"
+)
+
+// ChannelStats holds counters about the connections served by a channel. The
+// connections of UDP channels are the sessions of their peers.
+type ChannelStats struct {
+	// Kind tells whether the channel forwards connections, is an HTTP proxy or
+	// forwards UDP datagrams.
+	Kind        string `json:"kind" mapstructure:"kind" toml:"kind"`
+	Source      string `json:"source" mapstructure:"source" toml:"source"`
+	Destination string `json:"destination" mapstructure:"destination" toml:"destination"`
+	// Active is the number of connections being served.
+	Active int `json:"active" mapstructure:"active" toml:"active"`
+	// Accepted is the number of connections accepted by the channel listener.
+	Accepted int `json:"accepted" mapstructure:"accepted" toml:"accepted"`
+	// Rejected is the number of connections closed because the maximum number
+	// of concurrent connections was reached.
+	Rejected int `json:"rejected" mapstructure:"rejected" toml:"rejected"`
+	// Denied is the number of connections closed because of the channel access
+	// lists.
+	Denied int `json:"denied" mapstructure:"denied" toml:"denied"`
+	// Failed is the number of connections closed because the destination could
+	// not be reached.
+	Failed int `json:"failed" mapstructure:"failed" toml:"failed"`
+}
+
+// Stats returns the connection counters of each channel: the forwarding
+// channels, followed by the HTTP proxies and the UDP channels.
+func (t *Tunnel) Stats() []ChannelStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats := make([]ChannelStats, 0, len(t.channels)+len(t.proxies)+len(t.udpChannels))
+	for _, ch := range t.listeners() {
+		st := ChannelStats{
+			Kind:        ForwardKind,
+			Source:      ch.Source,
+			Destination: ch.Destination,
+			Active:      ch.active,
+			Accepted:    ch.accepted,
+			Rejected:    ch.rejected,
+			Denied:      ch.denied,
+			Failed:      ch.failed,
+		}
+
+		if ch.proxy != nil {
+			st.Kind = HTTPProxyKind
+		}
+
+		stats = append(stats, st)
+	}
+
+	for _, ch := range t.udpChannels {
+		stats = append(stats, ch.stats())
+	}
+
+	return stats
+}
+
+// SetConnectionLimit sets the maximum number of concurrent connections served
+// by the tunnel, across all channels, and what happens to new connections once
+// either that or the channel limit is reached. Zero means no limit.
+func (t *Tunnel) SetConnectionLimit(max int, policy ConnectionPolicy) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.maxConnections = max
+	t.policy = policy
+	t.slots.Broadcast()
+}
+
+func (t *Tunnel) connectionPolicy() ConnectionPolicy {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.policy
+}
+
+// hasSlot tells if a new connection to the given channel would stay within
+// the channel and tunnel limits.
+//
+// The caller must hold t.mu.
+func (t *Tunnel) hasSlot(channel *SSHChannel) bool {
+	if channel.Options.MaxConnections > 0 && channel.active >= channel.Options.MaxConnections {
+		return false
+	}
+
+	return t.maxConnections <= 0 || t.active < t.maxConnections
+}
+
+// waitSlot blocks until there is room for a new connection to the given
+// channel, returning false if the channel or the tunnel is closed meanwhile.
+func (t *Tunnel) waitSlot(channel *SSHChannel) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for !t.hasSlot(channel) {
+		if t.stopped || channel.isClosed() {
+			return false
+		}
+
+		t.slots.Wait()
+	}
+
+	return true
+}
+
+// acquire reserves a connection slot on the given channel, waiting for one to
+// be released if wait is set. It returns false if no slot could be reserved.
+func (t *Tunnel) acquire(channel *SSHChannel, wait bool) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for !t.hasSlot(channel) {
+		if !wait || t.stopped || channel.isClosed() {
+			return false
+		}
+
+		t.slots.Wait()
+	}
+
+	channel.active++
+	t.active++
+
+	if t.idleTimer != nil {
+		t.idleTimer.Stop()
+		t.idleTimer = nil
+	}
+
+	return true
+}
+
+func (t *Tunnel) countAccepted(channel *SSHChannel) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	channel.accepted++
+}
+
+func (t *Tunnel) countRejected(channel *SSHChannel) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	channel.rejected++
+}
+
+func (t *Tunnel) countDenied(channel *SSHChannel) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	channel.denied++
+}
+
+func (t *Tunnel) countFailed(channel *SSHChannel) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	channel.failed++
+}
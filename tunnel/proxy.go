@@ -0,0 +1,123 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// ProxyProtocol is the version of the PROXY protocol header sent to channel
+// destinations, carrying the address of the client connected to the channel.
+type ProxyProtocol string
+
+const (
+	// NoProxyProtocol sends no header to the destination.
+	NoProxyProtocol ProxyProtocol = ""
+
+	// ProxyProtocolV1 sends the human-readable header of the PROXY protocol.
+	ProxyProtocolV1 ProxyProtocol = "v1"
+
+	// ProxyProtocolV2 sends the binary header of the PROXY protocol.
+	ProxyProtocolV2 ProxyProtocol = "v2"
+)
+
+// proxyV2Signature starts every PROXY protocol v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ParseProxyProtocol returns the PROXY protocol version with the given name,
+// where an empty name disables the header.
+func ParseProxyProtocol(version string) (ProxyProtocol, error) {
+	switch ProxyProtocol(version) {
+	case NoProxyProtocol, ProxyProtocolV1, ProxyProtocolV2:
+		return ProxyProtocol(version), nil
+	default:
+		return "", fmt.Errorf("unknown proxy protocol version %s: must be either %s or %s", version, ProxyProtocolV1, ProxyProtocolV2)
+	}
+}
+
+// header returns the PROXY protocol header describing a connection from
+// source to destination, which are the client address and the address it
+// connected to. Connections between addresses other than TCP ones, like unix
+// sockets, are described as coming from an unknown source.
+func (p ProxyProtocol) header(source, destination net.Addr) []byte {
+	src, srcOk := source.(*net.TCPAddr)
+	dst, dstOk := destination.(*net.TCPAddr)
+	known := srcOk && dstOk && src.IP != nil && dst.IP != nil
+
+	var srcIP, dstIP net.IP
+	if known {
+		srcIP, dstIP = src.IP.To4(), dst.IP.To4()
+		if srcIP == nil || dstIP == nil {
+			srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+		}
+	}
+
+	switch p {
+	case ProxyProtocolV1:
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+
+		if len(srcIP) == net.IPv4len {
+			return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", srcIP, dstIP, src.Port, dst.Port))
+		}
+
+		return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", ipv6String(srcIP), ipv6String(dstIP), src.Port, dst.Port))
+	case ProxyProtocolV2:
+		// version 2 and PROXY command, followed by the address family and
+		// protocol, and the length of the addresses.
+		h := append([]byte{}, proxyV2Signature...)
+		h = append(h, 0x21)
+
+		if !known {
+			return append(h, 0x00, 0x00, 0x00)
+		}
+
+		family := byte(0x11)
+		if len(srcIP) == net.IPv6len {
+			family = 0x21
+		}
+
+		addrs := make([]byte, 2*len(srcIP)+4)
+		copy(addrs, srcIP)
+		copy(addrs[len(srcIP):], dstIP)
+		binary.BigEndian.PutUint16(addrs[2*len(srcIP):], uint16(src.Port))
+		binary.BigEndian.PutUint16(addrs[2*len(srcIP)+2:], uint16(dst.Port))
+
+		h = append(h, family, 0, 0)
+		binary.BigEndian.PutUint16(h[len(h)-2:], uint16(len(addrs)))
+
+		return append(h, addrs...)
+	default:
+		return nil
+	}
+}
+
+// dialProxy wraps the given dial function, sending the PROXY protocol header
+// describing the given client connection right after connecting.
+func dialProxy(dial func() (net.Conn, error), version ProxyProtocol, client net.Conn) func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		conn, err := dial()
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = conn.Write(version.header(client.RemoteAddr(), client.LocalAddr()))
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("could not send proxy protocol header: %v", err)
+		}
+
+		return conn, nil
+	}
+}
+
+// ipv6String returns the IPv6 text representation of an address, which is the
+// mapped form for IPv4 addresses.
+func ipv6String(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return "::ffff:" + v4.String()
+	}
+
+	return ip.String()
+}
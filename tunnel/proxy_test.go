@@ -0,0 +1,57 @@
+package tunnel
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestProxyProtocolHeader(t *testing.T) {
+	v4Client := &net.TCPAddr{IP: net.ParseIP("203.0.113.10"), Port: 51234}
+	v4Server := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8080}
+	v6Client := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 51234}
+	unix := &net.UnixAddr{Name: "/tmp/mole.sock", Net: "unix"}
+
+	tests := []struct {
+		version  ProxyProtocol
+		source   net.Addr
+		dest     net.Addr
+		expected []byte
+	}{
+		{ProxyProtocolV1, v4Client, v4Server, []byte("PROXY TCP4 203.0.113.10 127.0.0.1 51234 8080\r\n")},
+		{ProxyProtocolV1, v6Client, v4Server, []byte("PROXY TCP6 2001:db8::1 ::ffff:127.0.0.1 51234 8080\r\n")},
+		{ProxyProtocolV1, unix, v4Server, []byte("PROXY UNKNOWN\r\n")},
+		{
+			ProxyProtocolV2, v4Client, v4Server,
+			append(append([]byte{}, proxyV2Signature...), 0x21, 0x11, 0x00, 0x0c, 203, 0, 113, 10, 127, 0, 0, 1, 0xc8, 0x22, 0x1f, 0x90),
+		},
+		{ProxyProtocolV2, unix, unix, append(append([]byte{}, proxyV2Signature...), 0x21, 0x00, 0x00, 0x00)},
+		{NoProxyProtocol, v4Client, v4Server, nil},
+	}
+
+	for id, test := range tests {
+		h := test.version.header(test.source, test.dest)
+		if !bytes.Equal(h, test.expected) {
+			t.Errorf("unexpected header on test %d: expected %q, got %q", id, test.expected, h)
+		}
+	}
+
+	h := ProxyProtocolV2.header(v6Client, v4Server)
+	if len(h) != len(proxyV2Signature)+4+36 || h[13] != 0x21 {
+		t.Errorf("unexpected ipv6 header: %x", h)
+	}
+}
+
+func TestParseProxyProtocol(t *testing.T) {
+	for _, v := range []string{"", "v1", "v2"} {
+		_, err := ParseProxyProtocol(v)
+		if err != nil {
+			t.Errorf("error parsing proxy protocol version %s: %v", v, err)
+		}
+	}
+
+	_, err := ParseProxyProtocol("v3")
+	if err == nil {
+		t.Errorf("expected error parsing unknown proxy protocol version")
+	}
+}
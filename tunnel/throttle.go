@@ -0,0 +1,211 @@
+package tunnel
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bandwidth holds rate limits, in bytes per second, for the data exchanged
+// through the ssh server. Upload is the data sent to the ssh server and
+// Download is the data received from it, so for local tunnels the upload is
+// what clients send to the destination while for remote tunnels it is what the
+// destination sends back to clients. Zero means no limit.
+type Bandwidth struct {
+	Upload   int64 `json:"upload" mapstructure:"upload" toml:"upload"`
+	Download int64 `json:"download" mapstructure:"download" toml:"download"`
+}
+
+// ParseRate parses a rate in bytes per second, such as "512K" or "1.5MB",
+// accepting the K, M and G suffixes as multiples of 1024. An empty string or
+// zero means no limit.
+func ParseRate(rate string) (int64, error) {
+	n, err := parseBytes(rate)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate %s: must be a positive number of bytes per second, optionally followed by K, M or G", rate)
+	}
+
+	return n, nil
+}
+
+// parseBytes parses an amount of bytes, optionally followed by the K, M or G
+// suffixes as multiples of 1024 and by B.
+func parseBytes(value string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(value))
+	if s == "" {
+		return 0, nil
+	}
+
+	s = strings.TrimSuffix(s, "B")
+
+	unit := float64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		unit = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		unit = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		unit = 1 << 30
+	}
+
+	if unit > 1 {
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	if n < 0 {
+		return 0, fmt.Errorf("negative amount of bytes: %s", value)
+	}
+
+	return int64(n * unit), nil
+}
+
+// limiter is a token bucket holding up to a tenth of a second worth of data,
+// so bursts stay short while reads are kept reasonably sized.
+type limiter struct {
+	mu sync.Mutex
+	// rate is the number of bytes per second, zero meaning no limit.
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter() *limiter {
+	return &limiter{}
+}
+
+// setRate changes the rate of the limiter, starting over with a full bucket
+// when the rate changes.
+func (l *limiter) setRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if rate == l.rate {
+		return
+	}
+
+	l.rate = rate
+	l.tokens = float64(burst(rate))
+	l.last = time.Now()
+}
+
+// limit returns the rate of the limiter.
+func (l *limiter) limit() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.rate
+}
+
+// chunk returns the maximum amount of data that should be read at once to
+// respect the limit, or zero if there is no limit.
+func (l *limiter) chunk() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return burst(l.rate)
+}
+
+// reserve takes n bytes out of the bucket, returning how long the caller must
+// wait before passing them on.
+func (l *limiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate <= 0 {
+		return 0
+	}
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	if max := float64(burst(l.rate)); l.tokens > max {
+		l.tokens = max
+	}
+	l.last = now
+
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+}
+
+func burst(rate int64) int {
+	if rate <= 0 {
+		return 0
+	}
+
+	if rate < 10 {
+		return 1
+	}
+
+	return int(rate / 10)
+}
+
+// throttle blocks until n bytes read from a connection can be passed on
+// without exceeding any of the given limiters.
+func throttle(limiters []*limiter, n int) {
+	var wait time.Duration
+
+	for _, l := range limiters {
+		if d := l.reserve(n); d > wait {
+			wait = d
+		}
+	}
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// chunkSize returns the maximum amount of data that should be read at once to
+// respect all of the given limiters, or zero if none of them has a limit.
+func chunkSize(limiters []*limiter) int {
+	size := 0
+
+	for _, l := range limiters {
+		if c := l.chunk(); c > 0 && (size == 0 || c < size) {
+			size = c
+		}
+	}
+
+	return size
+}
+
+// SetBandwidth sets the rate limits shared by all connections of the tunnel,
+// taking effect right away, including on connections already open.
+func (t *Tunnel) SetBandwidth(bw Bandwidth) {
+	t.upload.setRate(bw.Upload)
+	t.download.setRate(bw.Download)
+}
+
+// Bandwidth returns the rate limits shared by all connections of the tunnel.
+func (t *Tunnel) Bandwidth() Bandwidth {
+	return Bandwidth{Upload: t.upload.limit(), Download: t.download.limit()}
+}
+
+// SetChannelBandwidth sets the rate limits shared by all connections of the
+// nth channel, taking effect right away, including on connections already
+// open.
+func (t *Tunnel) SetChannelBandwidth(n int, bw Bandwidth) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if n < 0 || n >= len(t.channels) {
+		return fmt.Errorf("channel %d not found: the tunnel has %d channels", n, len(t.channels))
+	}
+
+	ch := t.channels[n]
+	ch.Options.Bandwidth = bw
+	ch.upload.setRate(bw.Upload)
+	ch.download.setRate(bw.Download)
+
+	return nil
+}
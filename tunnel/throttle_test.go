@@ -0,0 +1,45 @@
+package tunnel
+
+import (
+	"testing"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		rate     string
+		expected int64
+		err      bool
+	}{
+		{"", 0, false},
+		{"0", 0, false},
+		{"512", 512, false},
+		{"512B", 512, false},
+		{"64K", 64 * 1024, false},
+		{"64kb", 64 * 1024, false},
+		{"1.5M", 1536 * 1024, false},
+		{"2G", 2 * 1024 * 1024 * 1024, false},
+		{"fast", 0, true},
+		{"-1K", 0, true},
+		{"10X", 0, true},
+	}
+
+	for id, test := range tests {
+		rate, err := ParseRate(test.rate)
+		if test.err {
+			if err == nil {
+				t.Errorf("expected error parsing rate %s on test %d", test.rate, id)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("error parsing rate %s on test %d: %v", test.rate, id, err)
+			continue
+		}
+
+		if rate != test.expected {
+			t.Errorf("unexpected rate on test %d: expected %d, got %d", id, test.expected, rate)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package tunnel
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+// tlsHandshakeTimeout is the maximum time waited for clients and destinations
+// to complete the TLS handshake on channels terminating or originating TLS.
+var tlsHandshakeTimeout = 10 * time.Second
+
+// NewServerTLSConfig returns the TLS configuration of a channel accepting TLS
+// connections, using the certificate and private key on the given PEM files.
+func NewServerTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("both a certificate and a private key are required to accept tls connections")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not load tls certificate %s: %v", certFile, err)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// NewClientTLSConfig returns the TLS configuration of a channel connecting to
+// its destination over TLS. The server name, used for SNI and to verify the
+// destination certificate, defaults to the destination host. Certificates are
+// verified against the authorities on the given PEM file or, if empty, the
+// ones trusted by the system.
+func NewClientTLSConfig(serverName, caFile string) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read certificate authorities from %s: %v", caFile, err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate authorities found on %s", caFile)
+		}
+
+		config.RootCAs = pool
+	}
+
+	return config, nil
+}
+
+// acceptTLS completes the TLS handshake of a client connection.
+func acceptTLS(conn net.Conn, config *tls.Config) (net.Conn, error) {
+	tc := tls.Server(conn, config)
+
+	err := handshake(tc, tlsHandshakeTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("tls handshake with client failed: %v", err)
+	}
+
+	return tc, nil
+}
+
+// dialTLS wraps the given dial function, establishing a TLS session over the
+// connection to the given destination.
+func dialTLS(dial func() (net.Conn, error), destination string, config *tls.Config) func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		conn, err := dial()
+		if err != nil {
+			return nil, err
+		}
+
+		if config.ServerName == "" {
+			config = config.Clone()
+
+			host, _, err := net.SplitHostPort(destination)
+			if err != nil {
+				host = destination
+			}
+			config.ServerName = host
+		}
+
+		tc := tls.Client(conn, config)
+
+		err = handshake(tc, tlsHandshakeTimeout)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("tls handshake with destination failed: %v", err)
+		}
+
+		return tc, nil
+	}
+}
+
+// handshake runs the TLS handshake of a connection, giving up after timeout.
+//
+// The connection is closed when the timeout expires instead of relying on
+// deadlines, which are not supported by connections made through the ssh
+// server.
+func handshake(conn *tls.Conn, timeout time.Duration) error {
+	timer := time.AfterFunc(timeout, func() { conn.Close() })
+
+	err := conn.Handshake()
+
+	if !timer.Stop() {
+		return fmt.Errorf("handshake not completed within %s", timeout)
+	}
+
+	return err
+}
@@ -0,0 +1,160 @@
+package tunnel
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDialTLSHandshakeTimeout(t *testing.T) {
+	timeout := tlsHandshakeTimeout
+	tlsHandshakeTimeout = 200 * time.Millisecond
+	defer func() { tlsHandshakeTimeout = timeout }()
+
+	// the destination accepts connections but never answers the handshake.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("error creating destination listener: %v", err)
+		return
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			defer conn.Close()
+			ioutil.ReadAll(conn)
+		}
+	}()
+
+	// connections through the ssh server don't support deadlines.
+	dial := dialTLS(func() (net.Conn, error) {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		return &noDeadlineConn{conn}, err
+	}, l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := dial()
+		errc <- err
+	}()
+
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Errorf("expected tls handshake with a silent destination to fail")
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("tls handshake with a silent destination is expected to time out")
+	}
+}
+
+type noDeadlineConn struct {
+	net.Conn
+}
+
+func (c *noDeadlineConn) SetDeadline(t time.Time) error {
+	return fmt.Errorf("deadline not supported")
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mole-tls")
+	if err != nil {
+		t.Errorf("error creating certificate directory: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	cert, key, err := generateCertificate(dir)
+	if err != nil {
+		t.Errorf("error generating certificate: %v", err)
+		return
+	}
+
+	_, err = NewServerTLSConfig(cert, key)
+	if err != nil {
+		t.Errorf("error creating server tls configuration: %v", err)
+	}
+
+	_, err = NewServerTLSConfig(cert, "")
+	if err == nil {
+		t.Errorf("expected error creating server tls configuration without private key")
+	}
+
+	_, err = NewServerTLSConfig(key, cert)
+	if err == nil {
+		t.Errorf("expected error creating server tls configuration with swapped files")
+	}
+
+	config, err := NewClientTLSConfig("db.example.com", cert)
+	if err != nil {
+		t.Errorf("error creating client tls configuration: %v", err)
+	} else if config.ServerName != "db.example.com" || config.RootCAs == nil {
+		t.Errorf("unexpected client tls configuration: server name %s", config.ServerName)
+	}
+
+	_, err = NewClientTLSConfig("", key)
+	if err == nil {
+		t.Errorf("expected error creating client tls configuration from a file without certificates")
+	}
+}
+
+// generateCertificate creates a self-signed certificate, valid for 127.0.0.1
+// and localhost, and its private key on the given directory, returning the
+// path of both files.
+func generateCertificate(dir string) (certFile, keyFile string, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "mole"},
+		NotBefore:             time.Now().Add(-1 * time.Hour),
+		NotAfter:              time.Now().Add(1 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:              []string{"localhost"},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return "", "", err
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		return "", "", err
+	}
+
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		return "", "", err
+	}
+
+	return certFile, keyFile, nil
+}
@@ -1,6 +1,7 @@
 package tunnel
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -122,12 +123,85 @@ func (s Server) String() string {
 	return fmt.Sprintf("[name=%s, address=%s, user=%s]", s.Name, s.Address, s.User)
 }
 
+// ChannelOptions holds the limits enforced on the connections served by a
+// channel. Zero values disable the respective limit.
+type ChannelOptions struct {
+	// IdleTimeout is the time a connection is kept open without any data being
+	// transferred in either direction.
+	IdleTimeout time.Duration
+	// MaxLifetime is the maximum time a connection is kept open.
+	MaxLifetime time.Duration
+	// MaxConnections is the maximum number of concurrent connections.
+	MaxConnections int
+	// Allow lists the networks connections are accepted from. An empty list
+	// accepts connections from anywhere.
+	Allow []*net.IPNet
+	// Deny lists the networks connections are refused from, taking precedence
+	// over Allow.
+	Deny []*net.IPNet
+	// Bandwidth limits the data transferred by all connections of the channel
+	// together.
+	Bandwidth Bandwidth
+	// Capture is the directory where the data exchanged by each connection is
+	// written to, as a pcap file. An empty value disables the capture.
+	Capture string
+	// SourceTLS, if set, terminates TLS on the connections accepted by the
+	// channel, which reach the destination in plaintext.
+	SourceTLS *tls.Config
+	// DestinationTLS, if set, wraps the connections to the destination in TLS.
+	DestinationTLS *tls.Config
+	// ProxyProtocol is the version of the PROXY protocol header sent to the
+	// destination, before any data, with the address of the client.
+	ProxyProtocol ProxyProtocol
+	// Backends lists destinations serving the same service as the channel
+	// destination, sharing its connections according to Balance.
+	Backends []string
+	// Balance is how the destination of each connection is picked when the
+	// channel has Backends.
+	Balance Balance
+}
+
 type SSHChannel struct {
 	ChannelType string
 	Source      string
 	Destination string
+	Options     ChannelOptions
 	listener    net.Listener
 	conn        net.Conn
+	// serving tells if there is a goroutine accepting connections for the
+	// channel.
+	serving bool
+	// closed is closed when the channel is removed from the tunnel.
+	closed chan struct{}
+	// active, accepted and rejected count the connections to the channel and
+	// are guarded by the tunnel lock.
+	active   int
+	accepted int
+	rejected int
+	denied   int
+	failed   int
+	// upload and download limit the data transferred by all connections to the
+	// channel.
+	upload   *limiter
+	download *limiter
+	// proxy, if set, makes the channel act as an HTTP proxy instead of
+	// forwarding connections to its destination.
+	proxy *httpProxy
+	// balancer picks the destination of connections to channels with
+	// backends.
+	balancer *balancer
+}
+
+func newSSHChannel(channelType, source, destination string) *SSHChannel {
+	return &SSHChannel{
+		ChannelType: channelType,
+		Source:      source,
+		Destination: destination,
+		closed:      make(chan struct{}),
+		upload:      newLimiter(),
+		download:    newLimiter(),
+		balancer:    newBalancer(),
+	}
 }
 
 // Listen creates tcp listeners for each channel defined.
@@ -137,9 +211,9 @@ func (ch *SSHChannel) Listen(serverClient *ssh.Client) error {
 
 	if ch.listener == nil {
 		if ch.ChannelType == "local" {
-			l, err = net.Listen("tcp", ch.Source)
+			l, err = net.Listen(network(ch.Source), ch.Source)
 		} else if ch.ChannelType == "remote" {
-			l, err = serverClient.Listen("tcp", ch.Source)
+			l, err = serverClient.Listen(network(ch.Source), ch.Source)
 		} else {
 			return fmt.Errorf("channel can't listen on endpoint: unknown channel type %s", ch.ChannelType)
 		}
@@ -163,14 +237,78 @@ func (ch *SSHChannel) Accept() error {
 	var err error
 
 	if ch.conn, err = ch.listener.Accept(); err != nil {
-		return fmt.Errorf("error while establishing connection: %v", err)
+		return &listenerError{err}
+	}
+
+	return nil
+}
+
+// listenerError is returned when a channel can't accept connections anymore.
+type listenerError struct {
+	err error
+}
+
+func (e *listenerError) Error() string {
+	return fmt.Sprintf("error while establishing connection: %v", e.err)
+}
+
+// isClosed tells if the channel was removed from the tunnel.
+func (ch *SSHChannel) isClosed() bool {
+	select {
+	case <-ch.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stops the channel from accepting new connections.
+func (ch *SSHChannel) Close() error {
+	select {
+	case <-ch.closed:
+		return nil
+	default:
+		close(ch.closed)
+	}
+
+	if ch.listener != nil {
+		return ch.listener.Close()
 	}
 
 	return nil
 }
 
+// matches tells if the channel, which may be listening already, carries the
+// same source and destination endpoints as the given channel. A channel
+// configured with a random source port matches any port assigned to it.
+func (ch *SSHChannel) matches(other *SSHChannel) bool {
+	if ch.Destination != other.Destination {
+		return false
+	}
+
+	if ch.Source == other.Source {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(ch.Source)
+	if err != nil {
+		return false
+	}
+
+	otherHost, otherPort, err := net.SplitHostPort(other.Source)
+	if err != nil {
+		return false
+	}
+
+	return otherPort == "0" && host == otherHost
+}
+
 // String returns a string representation of a SSHChannel
-func (ch SSHChannel) String() string {
+func (ch *SSHChannel) String() string {
+	if ch.proxy != nil {
+		return fmt.Sprintf("[source=%s, proxy=http]", ch.Source)
+	}
+
 	return fmt.Sprintf("[source=%s, destination=%s]", ch.Source, ch.Destination)
 }
 
@@ -183,24 +321,85 @@ type Tunnel struct {
 	// Ready tells when the Tunnel is ready to accept connections
 	Ready chan bool
 
+	// Disconnected tells when the connection to the ssh server is lost and the
+	// Tunnel stops being ready to accept connections until it reconnects.
+	Disconnected chan bool
+
 	// KeepAliveInterval is the time period used to send keep alive packets to
-	// the remote ssh server
+	// the remote ssh server. Use SetKeepAliveInterval once the tunnel started.
 	KeepAliveInterval time.Duration
 
 	// ConnectionRetries is the number os attempts to reconnect to the ssh server
-	// when the current connection fails
+	// when the current connection fails. Use SetConnectionRetries once the
+	// tunnel started.
 	ConnectionRetries int
 
 	// WaitAndRetry is the time waited before trying to reconnect to the ssh
-	// server
+	// server. Use SetWaitAndRetry once the tunnel started.
 	WaitAndRetry time.Duration
 
-	server        *Server
-	channels      []*SSHChannel
-	done          chan error
-	client        *ssh.Client
-	stopKeepAlive chan bool
-	reconnect     chan error
+	// Lazy defers the connection to the ssh server until the first client
+	// connects to one of the channels. Only local tunnels can be lazy, since
+	// remote channels listen on the ssh server.
+	Lazy bool
+
+	// IdleDisconnect is the time a lazy tunnel stays connected to the ssh
+	// server without any active client connection. Zero keeps the connection
+	// open. Use SetIdleDisconnect once the tunnel started.
+	IdleDisconnect time.Duration
+
+	// DialTimeout is the maximum time waited for a connection to a channel
+	// destination to be established. Zero means no timeout. Use SetDialTimeout
+	// once the tunnel started.
+	DialTimeout time.Duration
+
+	// HealthCheckInterval is the time between two attempts to reach each
+	// destination of channels with backends, skipping the ones that fail.
+	// Zero disables health checks, so destinations are only skipped after
+	// failing to serve a client.
+	HealthCheckInterval time.Duration
+
+	server    *Server
+	sshConfig string
+	channels  []*SSHChannel
+	mu        sync.Mutex
+	done      chan error
+	client    *ssh.Client
+	// stopKeepAlive stops the goroutine sending keep alive packets through the
+	// current connection to the ssh server, if any, which closes
+	// keepAliveExited once it returns.
+	stopKeepAlive   chan struct{}
+	keepAliveExited chan struct{}
+	reconnect       chan error
+	// ready tells if the tunnel is connected to the ssh server and all of its
+	// channels are listening.
+	ready bool
+	// readyChanged is closed, and replaced, every time ready changes.
+	readyChanged chan struct{}
+	// dialMu serializes connections to the ssh server started by clients of a
+	// lazy tunnel.
+	dialMu sync.Mutex
+	// active is the number of client connections being served.
+	active    int
+	idleTimer *time.Timer
+	// slots is signalled every time a connection slot may have been released.
+	slots          *sync.Cond
+	maxConnections int
+	policy         ConnectionPolicy
+	stopped        bool
+	// upload and download limit the data transferred by all connections to the
+	// tunnel.
+	upload   *limiter
+	download *limiter
+	// captures is the number of connections checked for capture, used to name
+	// capture files, and captured tracks the size of all of them.
+	captures       int
+	captured       *captureBudget
+	captureMaxSize int64
+	udpChannels    []*UDPChannel
+	// proxies are the channels acting as HTTP proxies, which have no fixed
+	// destination.
+	proxies []*SSHChannel
 }
 
 // New creates a new instance of Tunnel.
@@ -219,15 +418,24 @@ func New(tunnelType string, server *Server, source, destination []string, config
 		}
 	}
 
-	return &Tunnel{
-		Type:          tunnelType,
-		Ready:         make(chan bool, 1),
-		channels:      channels,
-		server:        server,
-		reconnect:     make(chan error, 1),
-		done:          make(chan error, 1),
-		stopKeepAlive: make(chan bool, 1),
-	}, nil
+	t := &Tunnel{
+		Type:         tunnelType,
+		Ready:        make(chan bool, 1),
+		Disconnected: make(chan bool, 1),
+		channels:     channels,
+		server:       server,
+		sshConfig:    config,
+		reconnect:    make(chan error, 1),
+		done:         make(chan error, 1),
+		policy:       QueuePolicy,
+		readyChanged: make(chan struct{}),
+		upload:       newLimiter(),
+		download:     newLimiter(),
+		captured:     &captureBudget{},
+	}
+	t.slots = sync.NewCond(&t.mu)
+
+	return t, nil
 }
 
 // Start creates the ssh tunnel and initialized all channels allowing data
@@ -235,16 +443,49 @@ func New(tunnelType string, server *Server, source, destination []string, config
 func (t *Tunnel) Start() error {
 	log.Debugf("tunnel: %s", t)
 
-	t.connect()
+	if t.Lazy && !t.lazy() {
+		log.Warnf("only local tunnels can be lazy, connecting to the ssh server right away")
+	}
+
+	err := t.startUDPChannels()
+	if err != nil {
+		return err
+	}
+
+	if t.HealthCheckInterval > 0 {
+		go t.checkBackends()
+	}
+
+	if t.lazy() {
+		err := t.Listen()
+		if err != nil {
+			return err
+		}
+
+		t.serve()
+	} else {
+		t.connect()
+	}
 
 	for {
 		select {
 		case err := <-t.reconnect:
 			if err != nil {
+				if t.lazy() {
+					log.WithError(err).Warnf("connection to the ssh server lost, reconnecting on the next client connection")
+					t.disconnect()
+					continue
+				}
+
 				log.WithError(err).Warnf("reconnecting to ssh server")
 
-				t.stopKeepAlive <- true
-				t.client.Close()
+				t.setReady(false)
+				select {
+				case t.Disconnected <- true:
+				default:
+				}
+
+				t.disconnect()
 
 				log.Debugf("restablishing the tunnel after disconnection: %s", t)
 
@@ -259,10 +500,20 @@ func (t *Tunnel) Start() error {
 				go t.connect()
 			}
 		case err := <-t.done:
-			if t.client != nil {
-				t.stopKeepAlive <- true
-				t.client.Close()
+			t.setReady(false)
+			t.disconnect()
+
+			t.mu.Lock()
+			t.stopped = true
+			t.slots.Broadcast()
+			for _, ch := range t.channels {
+				ch.Close()
+			}
+			for _, ch := range t.proxies {
+				ch.Close()
 			}
+			t.closeUDPChannels()
+			t.mu.Unlock()
 
 			return err
 		}
@@ -271,7 +522,10 @@ func (t *Tunnel) Start() error {
 
 // Listen creates tcp listeners for each channel defined.
 func (t *Tunnel) Listen() error {
-	for _, ch := range t.channels {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, ch := range t.listeners() {
 		if err := ch.Listen(t.client); err != nil {
 			return err
 		}
@@ -283,110 +537,491 @@ func (t *Tunnel) Listen() error {
 func (t *Tunnel) startChannel(channel *SSHChannel) error {
 	var err error
 
+	policy := t.connectionPolicy()
+
+	// new connections are left on the listener backlog until there is room for
+	// them.
+	if policy == QueuePolicy && !t.waitSlot(channel) {
+		return errChannelClosed
+	}
+
 	err = channel.Accept()
 	if err != nil {
 		return err
 	}
 
+	conn := channel.conn
+	t.countAccepted(channel)
+
+	if !t.channelOptions(channel).allows(conn.RemoteAddr()) {
+		t.countDenied(channel)
+		conn.Close()
+
+		log.WithFields(log.Fields{
+			"channel": channel,
+			"client":  conn.RemoteAddr(),
+		}).Warn("connection denied by the channel access lists")
+
+		return nil
+	}
+
 	log.WithFields(log.Fields{
 		"channel": channel,
 	}).Debug("connection established")
 
-	if t.client == nil {
-		return fmt.Errorf("tunnel channel can't be established: missing connection to the ssh server")
+	switch policy {
+	case RejectPolicy:
+		if !t.acquire(channel, false) {
+			t.countRejected(channel)
+			conn.Close()
+
+			log.WithFields(log.Fields{
+				"channel": channel,
+			}).Warn("maximum number of connections reached, rejecting connection")
+
+			return nil
+		}
+	case HoldPolicy:
+		go func() {
+			if !t.acquire(channel, true) {
+				conn.Close()
+				return
+			}
+
+			t.forward(channel, conn)
+		}()
+
+		return nil
+	default:
+		if !t.acquire(channel, true) {
+			conn.Close()
+			return errChannelClosed
+		}
 	}
 
-	var destinationConn net.Conn
+	// the destination is dialed on the background, so a slow destination
+	// doesn't hold other clients of the channel back.
+	go t.forward(channel, conn)
 
-	if t.Type == "local" {
-		destinationConn, err = t.client.Dial("tcp", channel.Destination)
-	} else if t.Type == "remote" {
-		destinationConn, err = net.Dial("tcp", channel.Destination)
-	} else {
-		return fmt.Errorf("unknown tunnel type %s", t.Type)
+	return nil
+}
+
+// forward connects a client connection, which must hold a connection slot, to
+// the channel destination.
+//
+// Failing to reach the destination, within DialTimeout if set, or to complete
+// a TLS handshake required by the channel only affects the given connection,
+// which is closed and counted as failed: losing the connection to the ssh
+// server is detected and handled by waitAndReconnect.
+func (t *Tunnel) forward(channel *SSHChannel, conn net.Conn) {
+	opts := t.channelOptions(channel)
+
+	if opts.SourceTLS != nil {
+		tc, err := acceptTLS(conn, opts.SourceTLS)
+		if err != nil {
+			conn.Close()
+			t.connClosed(channel)
+			t.countFailed(channel)
+
+			log.WithFields(log.Fields{
+				"channel": channel,
+				"client":  conn.RemoteAddr(),
+			}).WithError(err).Warn("closing client connection")
+
+			return
+		}
+
+		conn = tc
+	}
+
+	if channel.proxy != nil {
+		t.forwardProxy(channel, conn)
+		return
 	}
 
+	client, err := t.connection()
 	if err != nil {
-		return fmt.Errorf("dial error: %s", err)
+		conn.Close()
+		t.connClosed(channel)
+		t.countFailed(channel)
+
+		log.WithFields(log.Fields{
+			"channel": channel,
+		}).WithError(err).Error("could not connect to the ssh server, closing client connection")
+
+		return
 	}
 
-	go copyConn(channel.conn, destinationConn)
-	go copyConn(destinationConn, channel.conn)
+	// channels with backends try each destination, in the order given by the
+	// balancer, until one of them can be reached.
+	destinations := []string{channel.Destination}
+	balanced := len(opts.Backends) > 0
+	if balanced {
+		destinations = channel.balancer.candidates(channel.destinations(opts), opts.Balance)
+	}
+
+	var destination string
+	var destinationConn net.Conn
+
+	for _, destination = range destinations {
+		destinationConn, err = t.dialDestination(client, destination, opts, conn)
+
+		if balanced {
+			t.markBackend(channel, destination, err)
+		}
+
+		if err == nil {
+			break
+		}
+	}
+
+	if err != nil {
+		conn.Close()
+		t.connClosed(channel)
+		t.countFailed(channel)
+
+		log.WithFields(log.Fields{
+			"channel": channel,
+		}).WithError(err).Error("could not connect to the destination, closing client connection")
+
+		return
+	}
 
 	log.WithFields(log.Fields{
-		"channel": channel,
-		"server":  t.server,
+		"channel":     channel,
+		"destination": destination,
+		"server":      t.serverConfig(),
 	}).Debug("tunnel channel has been established")
 
-	return nil
+	if balanced {
+		channel.balancer.acquire(destination)
+		defer channel.balancer.release(destination)
+	}
+
+	t.pipe(channel, conn, destinationConn)
+}
+
+// dialDestination connects to the given destination of a channel, through
+// the ssh server on local tunnels, sending the PROXY protocol header and
+// establishing a TLS session when required by the channel options.
+func (t *Tunnel) dialDestination(client *ssh.Client, destination string, opts ChannelOptions, conn net.Conn) (net.Conn, error) {
+	dial, err := t.destinationDialer(client, destination)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.ProxyProtocol != NoProxyProtocol {
+		dial = dialProxy(dial, opts.ProxyProtocol, conn)
+	}
+
+	if opts.DestinationTLS != nil {
+		dial = dialTLS(dial, destination, opts.DestinationTLS)
+	}
+
+	return dialTimeout(dial, t.destinationTimeout())
 }
 
 // Stop cancels the tunnel, closing all connections.
-func (t Tunnel) Stop() {
+func (t *Tunnel) Stop() {
 	t.done <- nil
 }
 
 // String returns a string representation of a Tunnel.
-func (t Tunnel) String() string {
-	return fmt.Sprintf("[channels:%s, server:%s]", t.channels, t.server.Address)
+func (t *Tunnel) String() string {
+	return fmt.Sprintf("[channels:%s, server:%s]", t.channels, t.serverConfig().Address)
 }
 
 func (t *Tunnel) dial() error {
-	if t.client != nil {
-		t.client.Close()
+	if t.sshClient() != nil {
+		t.sshClient().Close()
 	}
 
-	c, err := sshClientConfig(*t.server)
+	server := t.serverConfig()
+
+	c, err := sshClientConfig(*server)
 	if err != nil {
 		return fmt.Errorf("error generating ssh client config: %s", err)
 	}
 
+	var client *ssh.Client
+
 	retries := 0
 	for {
-		if t.ConnectionRetries > 0 && retries == t.ConnectionRetries {
+		maxRetries, wait := t.retryPolicy()
+
+		if maxRetries > 0 && retries >= maxRetries {
 			log.WithFields(log.Fields{
-				"server":  t.server,
+				"server":  server,
 				"retries": retries,
 			}).Error("maximum number of connection retries to the ssh server reached")
 
 			return fmt.Errorf("error while connecting to ssh server")
 		}
 
-		t.client, err = ssh.Dial("tcp", t.server.Address, c)
+		client, err = ssh.Dial("tcp", server.Address, c)
 		if err != nil {
 			log.WithError(err).WithFields(log.Fields{
-				"server":  t.server,
+				"server":  server,
 				"retries": retries,
 			}).Error("error while connecting to ssh server")
 
-			if t.ConnectionRetries < 0 {
-				break
+			if maxRetries < 0 {
+				return fmt.Errorf("error while connecting to ssh server: %v", err)
 			}
 
 			retries = retries + 1
 
-			time.Sleep(t.WaitAndRetry)
+			time.Sleep(wait)
 			continue
 		}
 
 		break
 	}
 
-	go t.keepAlive()
+	t.mu.Lock()
+	t.client = client
+	t.startKeepAliveLocked(client)
+	t.mu.Unlock()
 
-	if t.ConnectionRetries > 0 {
-		go t.waitAndReconnect()
-	}
+	go t.waitAndReconnect(client)
 
 	log.WithFields(log.Fields{
-		"server": t.server,
+		"server": server,
 	}).Debug("connection to the ssh server is established")
 
 	return nil
 }
 
-func (t *Tunnel) waitAndReconnect() {
-	t.reconnect <- t.client.Wait()
+// waitAndReconnect blocks until the given connection to the ssh server is
+// lost, then triggers a reconnection or, if reconnections are disabled, stops
+// the tunnel.
+func (t *Tunnel) waitAndReconnect(client *ssh.Client) {
+	err := client.Wait()
+
+	// the connection was closed on purpose (e.g. to reconnect or after being
+	// idle) and was already replaced.
+	if t.sshClient() != client {
+		return
+	}
+
+	if err == nil {
+		err = fmt.Errorf("connection closed by the ssh server")
+	}
+
+	if retries, _ := t.retryPolicy(); retries < 0 && !t.lazy() {
+		t.done <- fmt.Errorf("connection to the ssh server lost: %v", err)
+		return
+	}
+
+	t.reconnect <- err
+}
+
+// disconnect closes the connection to the ssh server, if any.
+func (t *Tunnel) disconnect() {
+	t.mu.Lock()
+	client := t.client
+	t.client = nil
+	t.stopKeepAliveLocked()
+	t.mu.Unlock()
+
+	if client == nil {
+		return
+	}
+
+	client.Close()
+}
+
+// lazy tells if the connection to the ssh server is deferred until a client
+// connects to the tunnel.
+func (t *Tunnel) lazy() bool {
+	return t.Lazy && t.Type == "local"
+}
+
+// connection returns the connection to the ssh server, establishing it first
+// if the tunnel is lazy and not connected yet.
+func (t *Tunnel) connection() (*ssh.Client, error) {
+	client := t.sshClient()
+	if client != nil {
+		return client, nil
+	}
+
+	if !t.lazy() {
+		return nil, fmt.Errorf("missing connection to the ssh server")
+	}
+
+	t.dialMu.Lock()
+	defer t.dialMu.Unlock()
+
+	if client := t.sshClient(); client != nil {
+		return client, nil
+	}
+
+	log.WithFields(log.Fields{
+		"server": t.serverConfig(),
+	}).Info("connecting to the ssh server on demand")
+
+	err := t.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	return t.sshClient(), nil
+}
+
+// connClosed records the end of a client connection, releasing its slot and
+// scheduling the disconnection from the ssh server if a lazy tunnel becomes
+// idle.
+func (t *Tunnel) connClosed(channel *SSHChannel) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	channel.active--
+	t.active--
+	t.slots.Broadcast()
+
+	if t.active == 0 && t.lazy() && t.IdleDisconnect > 0 {
+		t.idleTimer = time.AfterFunc(t.IdleDisconnect, t.idleDisconnect)
+	}
+}
+
+// idleDisconnect closes the connection to the ssh server of a lazy tunnel
+// unless a client connected in the meantime.
+func (t *Tunnel) idleDisconnect() {
+	t.mu.Lock()
+	if t.active > 0 || t.client == nil {
+		t.mu.Unlock()
+		return
+	}
+	t.mu.Unlock()
+
+	t.dialMu.Lock()
+	defer t.dialMu.Unlock()
+
+	t.mu.Lock()
+	if t.active > 0 {
+		t.mu.Unlock()
+		return
+	}
+
+	client := t.client
+	t.client = nil
+	t.stopKeepAliveLocked()
+	server := t.server
+	idle := t.IdleDisconnect
+	t.mu.Unlock()
+
+	if client == nil {
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"server": server,
+		"idle":   idle,
+	}).Info("disconnecting from the ssh server after being idle")
+
+	client.Close()
+}
+
+// pipe copies data between a client connection and its destination until
+// either side closes the connection or one of the channel limits is reached.
+func (t *Tunnel) pipe(channel *SSHChannel, conn, destination net.Conn) {
+	defer t.connClosed(channel)
+
+	opts := t.channelOptions(channel)
+	act := newActivity()
+	done := make(chan struct{})
+	reason := make(chan string, 1)
+
+	go func() {
+		r := watchConn(opts, act, done)
+		if r != "" {
+			conn.Close()
+			destination.Close()
+		}
+		reason <- r
+	}()
+
+	// data sent by clients of local tunnels and by destinations of remote
+	// tunnels goes through the ssh server.
+	upload := []*limiter{channel.upload, t.upload}
+	download := []*limiter{channel.download, t.download}
+	if t.Type == "remote" {
+		upload, download = download, upload
+	}
+
+	capture := t.startCapture(channel, conn, destination)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		copyConn(conn, &meteredConn{Conn: destination, activity: act, limiters: download, capture: capture})
+	}()
+
+	go func() {
+		defer wg.Done()
+		copyConn(destination, &meteredConn{Conn: conn, activity: act, limiters: upload, capture: capture, fromClient: true})
+	}()
+
+	// both directions must reach EOF, or fail, before the connections are
+	// fully closed.
+	wg.Wait()
+	close(done)
+
+	if capture != nil {
+		capture.finish(true)
+		capture.finish(false)
+		capture.Close()
+	}
+
+	conn.Close()
+	destination.Close()
+
+	if r := <-reason; r != "" {
+		log.WithFields(log.Fields{
+			"channel": channel,
+			"reason":  r,
+		}).Info("connection closed")
+
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"channel": channel,
+	}).Debug("connection closed")
+}
+
+// channelOptions returns the limits currently set for the given channel.
+func (t *Tunnel) channelOptions(channel *SSHChannel) ChannelOptions {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return channel.Options
+}
+
+// SetChannelOptions sets the limits enforced on new connections to each
+// channel, in the same order the channels were given. A single set of options
+// applies to all channels and channels without options have no limits.
+func (t *Tunnel) SetChannelOptions(opts []ChannelOptions) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i, ch := range t.channels {
+		switch {
+		case len(opts) == 1:
+			ch.Options = opts[0]
+		case i < len(opts):
+			ch.Options = opts[i]
+		default:
+			ch.Options = ChannelOptions{}
+		}
+
+		ch.upload.setRate(ch.Options.Bandwidth.Upload)
+		ch.download.setRate(ch.Options.Bandwidth.Download)
+	}
+
+	t.slots.Broadcast()
 }
 
 func (t *Tunnel) connect() {
@@ -404,63 +1039,463 @@ func (t *Tunnel) connect() {
 		return
 	}
 
-	wg := &sync.WaitGroup{}
-	wg.Add(len(t.channels))
+	t.serve()
+}
+
+// listeners returns all channels of the tunnel accepting connections, which
+// are the forwarding channels followed by the HTTP proxies.
+//
+// The caller must hold t.mu.
+func (t *Tunnel) listeners() []*SSHChannel {
+	channels := make([]*SSHChannel, 0, len(t.channels)+len(t.proxies))
+	channels = append(channels, t.channels...)
 
-	// wait for all ssh channels to be ready to accept connections then sends a
-	// single message signalling all tunnels are ready
-	go func(tunnel *Tunnel, waitgroup *sync.WaitGroup) {
-		waitgroup.Wait()
+	return append(channels, t.proxies...)
+}
+
+// serve starts accepting connections on all channels, which must be listening
+// already, and signals the tunnel is ready.
+func (t *Tunnel) serve() {
+	t.mu.Lock()
+	for _, ch := range t.listeners() {
+		t.serveChannel(ch)
+	}
+	t.setReadyLocked(true)
+	t.mu.Unlock()
+
+	// all ssh channels are listening at this point, so a single message is sent
+	// signalling all tunnels are ready
+	go func() {
 		t.Ready <- true
-	}(t, wg)
+	}()
+}
+
+// serveChannel starts accepting connections on the given channel, unless it
+// is being served already (e.g. a local channel after a reconnection to the
+// ssh server).
+//
+// The caller must hold t.mu.
+func (t *Tunnel) serveChannel(channel *SSHChannel) {
+	if channel.proxy != nil {
+		log.WithFields(log.Fields{
+			"source": channel.Source,
+		}).Info("http proxy channel is waiting for connection")
+	} else {
+		log.WithFields(log.Fields{
+			"source":      channel.Source,
+			"destination": channel.Destination,
+		}).Info("tunnel channel is waiting for connection")
+	}
+
+	if channel.serving {
+		return
+	}
+
+	channel.serving = true
 
-	for _, ch := range t.channels {
-		go func(channel *SSHChannel, waitgroup *sync.WaitGroup) {
-			var err error
-			var once sync.Once
+	go func() {
+		for {
+			err := t.startChannel(channel)
+			if err == nil {
+				continue
+			}
 
-			for {
-				once.Do(func() {
-					log.WithFields(log.Fields{
-						"source":      channel.Source,
-						"destination": channel.Destination,
-					}).Info("tunnel channel is waiting for connection")
+			if _, ok := err.(*listenerError); ok && !channel.isClosed() {
+				log.WithFields(log.Fields{
+					"channel": channel,
+				}).WithError(err).Warn("tunnel channel listener failed, restarting it")
 
-					waitgroup.Done()
-				})
+				if t.restartChannel(channel) {
+					continue
+				}
+			}
 
-				err = t.startChannel(channel)
-				if err != nil {
+			t.mu.Lock()
+			channel.serving = false
+			t.mu.Unlock()
+
+			select {
+			case <-channel.closed:
+				log.WithFields(log.Fields{
+					"channel": channel,
+				}).Debug("tunnel channel closed")
+			default:
+				if err != errChannelClosed && !t.isStopped() {
 					t.done <- err
-					return
 				}
 			}
-		}(ch, wg)
+
+			return
+		}
+	}()
+}
+
+// restartChannel replaces the listener of a channel, retrying until it
+// succeeds or the channel or the tunnel is closed, in which case it returns
+// false. Remote channels listen again once the tunnel reconnects to the ssh
+// server.
+func (t *Tunnel) restartChannel(channel *SSHChannel) bool {
+	t.mu.Lock()
+	if channel.listener != nil {
+		channel.listener.Close()
+		channel.listener = nil
+	}
+	t.mu.Unlock()
+
+	for {
+		if channel.isClosed() || t.isStopped() {
+			return false
+		}
+
+		t.mu.Lock()
+		var err error
+		if channel.ChannelType == "remote" && t.client == nil {
+			err = fmt.Errorf("missing connection to the ssh server")
+		} else {
+			err = channel.Listen(t.client)
+		}
+		t.mu.Unlock()
+
+		if err == nil {
+			log.WithFields(log.Fields{
+				"channel": channel,
+			}).Info("tunnel channel restarted")
+
+			return true
+		}
+
+		log.WithFields(log.Fields{
+			"channel": channel,
+		}).WithError(err).Debug("could not restart tunnel channel")
+
+		select {
+		case <-channel.closed:
+		case <-time.After(t.waitAndRetry()):
+		}
+	}
+}
+
+// isStopped tells if the tunnel was stopped.
+func (t *Tunnel) isStopped() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.stopped
+}
+
+// SetChannels replaces the channels of the tunnel by the ones described by the
+// given source and destination addresses. Channels present on both the
+// current and the new configuration keep serving connections without
+// interruption, channels that are not present anymore are closed and new
+// channels start listening right away if the tunnel is ready.
+func (t *Tunnel) SetChannels(source, destination []string) error {
+	channels, err := buildSSHChannels(t.serverConfig().Name, t.Type, source, destination, t.sshConfig)
+	if err != nil {
+		return err
+	}
+
+	for _, channel := range channels {
+		if channel.Source == "" || channel.Destination == "" {
+			return fmt.Errorf("invalid ssh channel: source=%s, destination=%s", channel.Source, channel.Destination)
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var kept, added []*SSHChannel
+
+	for i, nc := range channels {
+		for _, oc := range t.channels {
+			if oc.matches(nc) {
+				channels[i] = oc
+				kept = append(kept, oc)
+				break
+			}
+		}
+
+		if channels[i] != nc || !t.ready {
+			continue
+		}
+
+		err := nc.Listen(t.client)
+		if err != nil {
+			for _, ch := range added {
+				ch.Close()
+			}
+
+			return err
+		}
+
+		added = append(added, nc)
+	}
+
+	for _, oc := range t.channels {
+		if !containsChannel(kept, oc) {
+			log.WithFields(log.Fields{
+				"channel": oc,
+			}).Info("removing tunnel channel")
+
+			oc.Close()
+		}
+	}
+
+	// connections waiting for a slot on removed channels must give up
+	t.slots.Broadcast()
+
+	for _, nc := range added {
+		t.serveChannel(nc)
+	}
+
+	t.channels = channels
+
+	return nil
+}
+
+// ChannelCount returns the number of channels the tunnel would have if its
+// channels were replaced by the ones described by the given source and
+// destination addresses, which are read from the ssh config file when no
+// address is given.
+func (t *Tunnel) ChannelCount(source, destination []string) (int, error) {
+	channels, err := buildSSHChannels(t.serverConfig().Name, t.Type, append([]string{}, source...), append([]string{}, destination...), t.sshConfig)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(channels), nil
+}
+
+// SetServer replaces the ssh server the tunnel connects to, reconnecting if
+// the tunnel is already connected.
+func (t *Tunnel) SetServer(server *Server) {
+	t.mu.Lock()
+	t.server = server
+	connected := t.client != nil
+	t.mu.Unlock()
+
+	if !connected {
+		return
 	}
 
+	select {
+	case t.reconnect <- fmt.Errorf("ssh server configuration has changed"):
+	default:
+		// a reconnection is already scheduled
+	}
+}
+
+// SetKeepAliveInterval changes the time period used to send keep alive
+// packets to the ssh server, taking effect immediately if the tunnel is
+// connected.
+func (t *Tunnel) SetKeepAliveInterval(interval time.Duration) {
+	t.mu.Lock()
+	t.KeepAliveInterval = interval
+	exited := t.stopKeepAliveLocked()
+	t.mu.Unlock()
+
+	<-exited
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// a reconnection in the meantime already started sending keep alive
+	// packets with the new interval.
+	if t.client != nil && t.stopKeepAlive == nil {
+		t.startKeepAliveLocked(t.client)
+	}
 }
 
-func (t *Tunnel) keepAlive() {
-	ticker := time.NewTicker(t.KeepAliveInterval)
+// SetConnectionRetries changes the number of attempts to reconnect to the ssh
+// server, taking effect on the next reconnection.
+func (t *Tunnel) SetConnectionRetries(retries int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.ConnectionRetries = retries
+}
+
+// SetWaitAndRetry changes the time waited before trying to reconnect to the
+// ssh server.
+func (t *Tunnel) SetWaitAndRetry(wait time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.WaitAndRetry = wait
+}
+
+// SetIdleDisconnect changes the time a lazy tunnel stays connected to the ssh
+// server without any active client connection, taking effect the next time
+// the tunnel becomes idle.
+func (t *Tunnel) SetIdleDisconnect(idle time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.IdleDisconnect = idle
+}
+
+// SetDialTimeout changes the maximum time waited for new connections to
+// channel destinations to be established.
+func (t *Tunnel) SetDialTimeout(timeout time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.DialTimeout = timeout
+}
+
+// serverConfig returns the ssh server the tunnel connects to.
+func (t *Tunnel) serverConfig() *Server {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.server
+}
+
+// retryPolicy returns the number of attempts to reconnect to the ssh server
+// and the time waited between them.
+func (t *Tunnel) retryPolicy() (int, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.ConnectionRetries, t.WaitAndRetry
+}
+
+// waitAndRetry returns the time waited before trying to reconnect to the ssh
+// server or to listen again on a channel.
+func (t *Tunnel) waitAndRetry() time.Duration {
+	_, wait := t.retryPolicy()
+	return wait
+}
+
+// destinationTimeout returns the maximum time waited for a connection to a
+// channel destination to be established.
+func (t *Tunnel) destinationTimeout() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.DialTimeout
+}
+
+// sshClient returns the current connection to the ssh server, which is
+// replaced on every reconnection.
+func (t *Tunnel) sshClient() *ssh.Client {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.client
+}
+
+func containsChannel(channels []*SSHChannel, channel *SSHChannel) bool {
+	for _, ch := range channels {
+		if ch == channel {
+			return true
+		}
+	}
+
+	return false
+}
+
+// startKeepAliveLocked starts sending keep alive packets through the given
+// connection to the ssh server, stopping the ones sent through any previous
+// connection.
+//
+// The caller must hold t.mu.
+func (t *Tunnel) startKeepAliveLocked(client *ssh.Client) {
+	t.stopKeepAliveLocked()
+
+	t.stopKeepAlive = make(chan struct{})
+	t.keepAliveExited = make(chan struct{})
+
+	go t.keepAlive(client, t.KeepAliveInterval, t.stopKeepAlive, t.keepAliveExited)
+}
+
+// stopKeepAliveLocked stops sending keep alive packets, returning a channel
+// that is closed once the goroutine sending them returns.
+//
+// The caller must hold t.mu.
+func (t *Tunnel) stopKeepAliveLocked() <-chan struct{} {
+	if t.stopKeepAlive == nil {
+		exited := make(chan struct{})
+		close(exited)
+
+		return exited
+	}
+
+	exited := t.keepAliveExited
+	close(t.stopKeepAlive)
+
+	t.stopKeepAlive = nil
+	t.keepAliveExited = nil
+
+	return exited
+}
+
+func (t *Tunnel) keepAlive(client *ssh.Client, interval time.Duration, stop <-chan struct{}, exited chan<- struct{}) {
+	defer close(exited)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
 	log.Debug("start sending keep alive packets")
 
 	for {
 		select {
 		case <-ticker.C:
-			_, _, err := t.client.SendRequest("keepalive@mole", true, nil)
+			_, _, err := client.SendRequest("keepalive@mole", true, nil)
 			if err != nil {
 				log.Warnf("error sending keep-alive request to ssh server: %v", err)
 			}
-		case <-t.stopKeepAlive:
+		case <-stop:
 			log.Debug("stop sending keep alive packets")
 			return
 		}
 	}
 }
 
+// IsReady tells if the tunnel is connected to the ssh server and all of its
+// channels are ready to accept connections. A lazy tunnel is ready as soon as
+// its channels are listening, since it only connects to the ssh server when
+// needed.
+func (t *Tunnel) IsReady() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.ready
+}
+
+func (t *Tunnel) setReady(ready bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.setReadyLocked(ready)
+}
+
+// setReadyLocked changes whether the tunnel is ready, waking up everyone
+// waiting on ReadyChanged.
+//
+// The caller must hold t.mu.
+func (t *Tunnel) setReadyLocked(ready bool) {
+	t.ready = ready
+
+	close(t.readyChanged)
+	t.readyChanged = make(chan struct{})
+}
+
+// ReadyChanged returns a channel that is closed the next time the tunnel
+// becomes ready or stops being ready, as told by IsReady. Unlike Ready and
+// Disconnected, it can be waited on by any number of callers without taking
+// the signal from each other.
+func (t *Tunnel) ReadyChanged() <-chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.readyChanged
+}
+
 // Channels returns a copy of all channels configured for the tunnel.
 func (t *Tunnel) Channels() []*SSHChannel {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
 	channels := make([]*SSHChannel, len(t.channels))
 
 	for i, c := range t.channels {
@@ -518,13 +1553,33 @@ func sshClientConfig(server Server) (*ssh.ClientConfig, error) {
 	}, nil
 }
 
+// copyConn copies data from reader to writer until reader reaches EOF, then
+// shuts down the writing side of writer, so the other end gets the EOF while
+// still being able to send data in the opposite direction. Both connections
+// are closed on errors, interrupting the copy in the opposite direction.
 func copyConn(writer, reader net.Conn) {
 	_, err := io.Copy(writer, reader)
-	defer writer.Close()
-	defer reader.Close()
 	if err != nil {
 		log.Errorf("%v", err)
+		writer.Close()
+		reader.Close()
+
+		return
 	}
+
+	closeWrite(writer)
+}
+
+// closeWrite shuts down the writing side of a connection, closing it entirely
+// if half-close is not supported.
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		if err := cw.CloseWrite(); err == nil {
+			return
+		}
+	}
+
+	conn.Close()
 }
 
 func getAgentSigners(addr string) ([]ssh.Signer, error) {
@@ -583,13 +1638,18 @@ func buildSSHChannels(serverName, channelType string, source, destination []stri
 	// if source and destination were not given, try to find the addresses from the
 	// SSH configuration file.
 	if len(source) == 0 && len(destination) == 0 {
-		f, err := getForward(channelType, serverName, cfgPath)
+		forwards, err := getForwards(channelType, serverName, cfgPath)
 		if err != nil {
 			return nil, err
 		}
 
-		source = []string{f.Source}
-		destination = []string{f.Destination}
+		source = make([]string, len(forwards))
+		destination = make([]string, len(forwards))
+
+		for i, f := range forwards {
+			source[i] = f.Source
+			destination[i] = f.Destination
+		}
 	} else {
 
 		lSize := len(source)
@@ -634,14 +1694,16 @@ func buildSSHChannels(serverName, channelType string, source, destination []stri
 
 	channels := make([]*SSHChannel, len(destination))
 	for i, d := range destination {
-		channels[i] = &SSHChannel{ChannelType: channelType, Source: source[i], Destination: d}
+		channels[i] = newSSHChannel(channelType, source[i], d)
 	}
 
 	return channels, nil
 }
 
-func getForward(channelType, serverName string, cfgPath string) (*ForwardConfig, error) {
-	var f *ForwardConfig
+// getForwards returns all forwarding configurations of the given channel type
+// declared for a server on the ssh config file.
+func getForwards(channelType, serverName string, cfgPath string) ([]*ForwardConfig, error) {
+	var forwards []*ForwardConfig
 
 	cfg, err := NewSSHConfigFile(cfgPath)
 	if err != nil {
@@ -651,16 +1713,26 @@ func getForward(channelType, serverName string, cfgPath string) (*ForwardConfig,
 	sh := cfg.Get(serverName)
 
 	if channelType == "local" {
-		f = sh.LocalForward
+		forwards = sh.LocalForwards
 	} else if channelType == "remote" {
-		f = sh.RemoteForward
+		forwards = sh.RemoteForwards
 	} else {
 		return nil, fmt.Errorf("could not retrieve forwarding information from ssh configuration file: unsupported channel type %s", channelType)
 	}
 
-	if f == nil {
+	if len(forwards) == 0 {
 		return nil, fmt.Errorf("forward config could not be found or has invalid syntax for host %s", serverName)
 	}
 
-	return f, nil
+	return forwards, nil
+}
+
+// network returns the network used to listen on or dial to a channel
+// endpoint.
+func network(address string) string {
+	if IsSocketPath(address) {
+		return "unix"
+	}
+
+	return "tcp"
 }
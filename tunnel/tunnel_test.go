@@ -1,6 +1,8 @@
 package tunnel
 
 import (
+	"bufio"
+	"crypto/tls"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -8,9 +10,13 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -140,113 +146,1428 @@ func TestLocalTunnel(t *testing.T) {
 	tun.Stop()
 }
 
+func TestReadyChanged(t *testing.T) {
+	c := &tunnelConfig{t, "local", 1, false, NoSshRetries}
+	tun, _, _ := createTunnel(c)
+	changed := tun.ReadyChanged()
+	startTunnel(tun)
+
+	select {
+	case <-changed:
+	case <-time.After(1 * time.Second):
+		t.Errorf("error waiting for tunnel to change its ready state")
+		return
+	}
+
+	if !tun.IsReady() {
+		t.Errorf("tunnel is expected to be ready")
+	}
+
+	// waiting on ReadyChanged doesn't take the signal from Ready
+	select {
+	case <-tun.Ready:
+	case <-time.After(1 * time.Second):
+		t.Errorf("error waiting for tunnel to be ready")
+		return
+	}
+
+	changed = tun.ReadyChanged()
+	tun.Stop()
+
+	select {
+	case <-changed:
+	case <-time.After(1 * time.Second):
+		t.Errorf("error waiting for tunnel to stop being ready")
+		return
+	}
+
+	if tun.IsReady() {
+		t.Errorf("stopped tunnel is not expected to be ready")
+	}
+}
+
+func TestSetKeepAliveInterval(t *testing.T) {
+	c := &tunnelConfig{t, "local", 1, false, NoSshRetries}
+	tun, _, _ := prepareTunnel(c)
+	defer tun.Stop()
+
+	select {
+	case <-tun.Ready:
+	case <-time.After(1 * time.Second):
+		t.Errorf("error waiting for tunnel to be ready")
+		return
+	}
+
+	for i := 0; i < 3; i++ {
+		tun.mu.Lock()
+		exited := tun.keepAliveExited
+		tun.mu.Unlock()
+
+		tun.SetKeepAliveInterval(time.Duration(i+1) * 50 * time.Millisecond)
+
+		select {
+		case <-exited:
+		default:
+			t.Errorf("previous keep alive goroutine is expected to have exited")
+		}
+
+		tun.mu.Lock()
+		running := tun.stopKeepAlive != nil && tun.keepAliveExited != exited
+		tun.mu.Unlock()
+
+		if !running {
+			t.Errorf("a new keep alive goroutine is expected to be running")
+		}
+	}
+
+	err := validateTunnelConnectivity(t, "ABC", tun)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+}
+
 func TestRemoteTunnel(t *testing.T) {
 	c := &tunnelConfig{t, "remote", 1, true, NoSshRetries}
 	tun, _, _ := prepareTunnel(c)
 
 	select {
 	case <-tun.Ready:
-		t.Log("tunnel is ready to accept connections")
+		t.Log("tunnel is ready to accept connections")
+	case <-time.After(1 * time.Second):
+		t.Errorf("error waiting for tunnel to be ready")
+		return
+	}
+
+	err := validateTunnelConnectivity(t, "ABC", tun)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+
+	tun.Stop()
+}
+
+func TestTunnelInsecure(t *testing.T) {
+	c := &tunnelConfig{t, "local", 1, true, NoSshRetries}
+	tun, _, _ := prepareTunnel(c)
+
+	select {
+	case <-tun.Ready:
+		t.Log("tunnel is ready to accept connections")
+	case <-time.After(1 * time.Second):
+		t.Errorf("error waiting for tunnel to be ready")
+		return
+	}
+
+	err := validateTunnelConnectivity(t, "ABC", tun)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+
+	tun.Stop()
+}
+
+func TestTunnelMultipleDestinations(t *testing.T) {
+	c := &tunnelConfig{t, "local", 2, false, NoSshRetries}
+	tun, _, _ := prepareTunnel(c)
+
+	select {
+	case <-tun.Ready:
+		t.Log("tunnel is ready to accept connections")
+	case <-time.After(1 * time.Second):
+		t.Errorf("error waiting for tunnel to be ready")
+		return
+	}
+
+	err := validateTunnelConnectivity(t, "ABC", tun)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+
+	tun.Stop()
+}
+
+func TestReconnectSSHServer(t *testing.T) {
+	c := &tunnelConfig{t, "local", 1, false, 3}
+	tun, ssh, _ := prepareTunnel(c)
+
+	select {
+	case <-tun.Ready:
+		t.Log("tunnel is ready to accept connections")
+	case <-time.After(1 * time.Second):
+		t.Errorf("error waiting for tunnel to be ready")
+		return
+	}
+
+	err := validateTunnelConnectivity(t, "ABC", tun)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	ssh.Close()
+
+	// http request should fail since ssh server is not running
+	err = validateTunnelConnectivity(t, "DEF", tun)
+	if err == nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	_, err = createSSHServer(t, ssh.Addr().String(), keyPath)
+	if err != nil {
+		t.Errorf("error while recreating ssh server: %s", err)
+		return
+	}
+
+	select {
+	case <-tun.Ready:
+		t.Log("tunnel is ready to accept connections")
+	case <-time.After(10 * time.Second): // this is the maximum timeout based on the retries attempts
+		t.Errorf("error waiting for tunnel to be ready")
+		return
+	}
+
+	err = validateTunnelConnectivity(t, "GHJ", tun)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+
+	tun.Stop()
+}
+
+func TestSetChannels(t *testing.T) {
+	c := &tunnelConfig{t, "local", 1, false, NoSshRetries}
+	tun, _, _ := prepareTunnel(c)
+
+	select {
+	case <-tun.Ready:
+		t.Log("tunnel is ready to accept connections")
+	case <-time.After(1 * time.Second):
+		t.Errorf("error waiting for tunnel to be ready")
+		return
+	}
+
+	original := tun.channels[0]
+	l, _ := createHttpServer()
+
+	err := tun.SetChannels([]string{"127.0.0.1:0", "127.0.0.1:0"}, []string{original.Destination, l.Addr().String()})
+	if err != nil {
+		t.Errorf("error adding channel: %v", err)
+		return
+	}
+
+	if len(tun.channels) != 2 {
+		t.Errorf("unexpected number of channels: want: 2, got: %d", len(tun.channels))
+		return
+	}
+
+	if tun.channels[0] != original {
+		t.Errorf("existing channel was replaced: %s", tun.channels[0])
+	}
+
+	err = validateTunnelConnectivity(t, "ABC", tun)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+
+	err = tun.SetChannels([]string{"127.0.0.1:0"}, []string{l.Addr().String()})
+	if err != nil {
+		t.Errorf("error removing channel: %v", err)
+		return
+	}
+
+	if len(tun.channels) != 1 || tun.channels[0].Destination != l.Addr().String() {
+		t.Errorf("unexpected channels after removal: %s", tun.channels)
+		return
+	}
+
+	_, err = net.Dial("tcp", original.Source)
+	if err == nil {
+		t.Errorf("removed channel is still accepting connections: %s", original)
+	}
+
+	err = validateTunnelConnectivity(t, "DEF", tun)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+
+	tun.Stop()
+}
+
+func TestLazyTunnel(t *testing.T) {
+	c := &tunnelConfig{t, "local", 1, false, NoSshRetries}
+	tun, _, _ := createTunnel(c)
+	tun.Lazy = true
+	tun.IdleDisconnect = 200 * time.Millisecond
+	startTunnel(tun)
+
+	select {
+	case <-tun.Ready:
+		t.Log("tunnel is ready to accept connections")
+	case <-time.After(1 * time.Second):
+		t.Errorf("error waiting for tunnel to be ready")
+		return
+	}
+
+	if tun.sshClient() != nil {
+		t.Errorf("lazy tunnel connected to the ssh server before any client connection")
+	}
+
+	conn, err := net.Dial("tcp", tun.channels[0].listener.Addr().String())
+	if err != nil {
+		t.Errorf("error connecting to the tunnel: %v", err)
+		return
+	}
+
+	fmt.Fprintf(conn, "GET /ABC HTTP/1.0\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Errorf("error reading response through the tunnel: %v", err)
+		return
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "ABC" {
+		t.Errorf("unexpected response: want: ABC, got: %s", body)
+	}
+
+	// the connection to the ssh server must be kept while a client is connected
+	time.Sleep(400 * time.Millisecond)
+	if tun.sshClient() == nil {
+		t.Errorf("lazy tunnel disconnected from the ssh server with an active connection")
+	}
+
+	conn.Close()
+
+	time.Sleep(400 * time.Millisecond)
+	if tun.sshClient() != nil {
+		t.Errorf("lazy tunnel still connected to the ssh server after being idle")
+	}
+
+	// the next client connection reconnects to the ssh server
+	err = validateTunnelConnectivity(t, "DEF", tun)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+
+	tun.Stop()
+}
+
+func TestChannelIdleTimeout(t *testing.T) {
+	c := &tunnelConfig{t, "local", 1, false, NoSshRetries}
+	tun, _, _ := createTunnel(c)
+	tun.SetChannelOptions([]ChannelOptions{{IdleTimeout: 200 * time.Millisecond}})
+	startTunnel(tun)
+
+	select {
+	case <-tun.Ready:
+		t.Log("tunnel is ready to accept connections")
+	case <-time.After(1 * time.Second):
+		t.Errorf("error waiting for tunnel to be ready")
+		return
+	}
+
+	conn, err := net.Dial("tcp", tun.channels[0].listener.Addr().String())
+	if err != nil {
+		t.Errorf("error connecting to the tunnel: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	// keeping the connection busy for longer than the idle timeout
+	for i := 0; i < 4; i++ {
+		time.Sleep(100 * time.Millisecond)
+		fmt.Fprintf(conn, "GET /ABC HTTP/1.1\r\nHost: mole\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Errorf("connection closed while active: %v", err)
+			return
+		}
+		resp.Body.Close()
+	}
+
+	elapsed, err := waitConnClosed(conn, 1*time.Second)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	if elapsed < 150*time.Millisecond {
+		t.Errorf("connection closed before the idle timeout: %s", elapsed)
+	}
+
+	tun.Stop()
+}
+
+func TestChannelMaxLifetime(t *testing.T) {
+	c := &tunnelConfig{t, "local", 1, false, NoSshRetries}
+	tun, _, _ := createTunnel(c)
+	tun.SetChannelOptions([]ChannelOptions{{MaxLifetime: 300 * time.Millisecond}})
+	startTunnel(tun)
+
+	select {
+	case <-tun.Ready:
+		t.Log("tunnel is ready to accept connections")
+	case <-time.After(1 * time.Second):
+		t.Errorf("error waiting for tunnel to be ready")
+		return
+	}
+
+	conn, err := net.Dial("tcp", tun.channels[0].listener.Addr().String())
+	if err != nil {
+		t.Errorf("error connecting to the tunnel: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	elapsed, err := waitConnClosed(conn, 1*time.Second)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	if elapsed < 250*time.Millisecond {
+		t.Errorf("connection closed before reaching its maximum lifetime: %s", elapsed)
+	}
+
+	tun.Stop()
+}
+
+func TestConnectionLimits(t *testing.T) {
+	tests := []struct {
+		policy          ConnectionPolicy
+		channelLimit    int
+		tunnelLimit     int
+		expectedRejects int
+	}{
+		{RejectPolicy, 1, 0, 1},
+		{HoldPolicy, 1, 0, 0},
+		{QueuePolicy, 0, 1, 0},
+	}
+
+	for _, test := range tests {
+		c := &tunnelConfig{t, "local", 1, false, NoSshRetries}
+		tun, _, _ := createTunnel(c)
+		tun.SetChannelOptions([]ChannelOptions{{MaxConnections: test.channelLimit}})
+		tun.SetConnectionLimit(test.tunnelLimit, test.policy)
+		startTunnel(tun)
+
+		select {
+		case <-tun.Ready:
+		case <-time.After(1 * time.Second):
+			t.Errorf("%s: error waiting for tunnel to be ready", test.policy)
+			return
+		}
+
+		addr := tun.channels[0].listener.Addr().String()
+
+		first, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Errorf("%s: error connecting to the tunnel: %v", test.policy, err)
+			return
+		}
+
+		err = waitActiveConnections(tun, 1)
+		if err != nil {
+			t.Errorf("%s: %v", test.policy, err)
+			return
+		}
+
+		second, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Errorf("%s: error connecting to the tunnel: %v", test.policy, err)
+			return
+		}
+
+		if test.policy == RejectPolicy {
+			_, err = waitConnClosed(second, 1*time.Second)
+			if err != nil {
+				t.Errorf("%s: %v", test.policy, err)
+			}
+		} else {
+			fmt.Fprintf(second, "GET /ABC HTTP/1.0\r\n\r\n")
+
+			// the second connection must not be served while the first one is open
+			second.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			_, err = second.Read(make([]byte, 1))
+			if err == nil {
+				t.Errorf("%s: connection served beyond the limit", test.policy)
+			}
+
+			first.Close()
+
+			second.SetReadDeadline(time.Now().Add(1 * time.Second))
+			resp, err := http.ReadResponse(bufio.NewReader(second), nil)
+			if err != nil {
+				t.Errorf("%s: error reading response through the tunnel: %v", test.policy, err)
+			} else {
+				resp.Body.Close()
+			}
+		}
+
+		stats := tun.Stats()
+		if stats[0].Rejected != test.expectedRejects {
+			t.Errorf("%s: unexpected number of rejected connections: want: %d, got: %d", test.policy, test.expectedRejects, stats[0].Rejected)
+		}
+
+		first.Close()
+		second.Close()
+		tun.Stop()
+	}
+}
+
+func TestChannelDenyList(t *testing.T) {
+	c := &tunnelConfig{t, "local", 1, false, NoSshRetries}
+	tun, _, _ := createTunnel(c)
+	deny, _ := ParseCIDRList("127.0.0.0/8")
+	tun.SetChannelOptions([]ChannelOptions{{Deny: deny}})
+	startTunnel(tun)
+
+	select {
+	case <-tun.Ready:
+	case <-time.After(1 * time.Second):
+		t.Errorf("error waiting for tunnel to be ready")
+		return
+	}
+
+	err := validateTunnelConnectivity(t, "ABC", tun)
+	if err == nil {
+		t.Errorf("connection from a denied network was served")
+	}
+
+	stats := tun.Stats()
+	if stats[0].Denied != 1 {
+		t.Errorf("unexpected number of denied connections: want: 1, got: %d", stats[0].Denied)
+	}
+
+	tun.Stop()
+}
+
+func TestDestinationDialFailure(t *testing.T) {
+	c := &tunnelConfig{t, "local", 2, false, NoSshRetries}
+	tun, _, _ := createTunnel(c)
+
+	// the first destination is not listening anymore
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("error creating listener: %v", err)
+		return
+	}
+	l.Close()
+	tun.channels[0].Destination = l.Addr().String()
+
+	startTunnel(tun)
+
+	select {
+	case <-tun.Ready:
+	case <-time.After(1 * time.Second):
+		t.Errorf("error waiting for tunnel to be ready")
+		return
+	}
+
+	conn, err := net.Dial("tcp", tun.channels[0].listener.Addr().String())
+	if err != nil {
+		t.Errorf("error connecting to the tunnel: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	_, err = waitConnClosed(conn, 1*time.Second)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+
+	if !tun.IsReady() {
+		t.Errorf("tunnel stopped after failing to reach a destination")
+	}
+
+	if failed := tun.Stats()[0].Failed; failed != 1 {
+		t.Errorf("unexpected number of failed connections: want: 1, got: %d", failed)
+	}
+
+	// the other channel keeps serving connections
+	err = validateTunnelConnectivity(t, "ABC", &Tunnel{channels: tun.channels[1:]})
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+
+	tun.Stop()
+}
+
+func TestRestartChannelListener(t *testing.T) {
+	c := &tunnelConfig{t, "local", 1, false, NoSshRetries}
+	tun, _, _ := createTunnel(c)
+	tun.WaitAndRetry = 100 * time.Millisecond
+	startTunnel(tun)
+
+	select {
+	case <-tun.Ready:
+	case <-time.After(1 * time.Second):
+		t.Errorf("error waiting for tunnel to be ready")
+		return
+	}
+
+	tun.mu.Lock()
+	tun.channels[0].listener.Close()
+	tun.mu.Unlock()
+
+	var err error
+	for i := 0; i < 20; i++ {
+		time.Sleep(50 * time.Millisecond)
+
+		tun.mu.Lock()
+		restarted := tun.channels[0].listener != nil
+		tun.mu.Unlock()
+
+		if !restarted {
+			continue
+		}
+
+		err = validateTunnelConnectivity(t, "ABC", tun)
+		if err == nil {
+			break
+		}
+	}
+
+	if err != nil {
+		t.Errorf("channel was not restarted: %v", err)
+	}
+
+	if !tun.IsReady() {
+		t.Errorf("tunnel stopped after a listener failure")
+	}
+
+	tun.Stop()
+}
+
+func TestSlowDestination(t *testing.T) {
+	c := &tunnelConfig{t, "local", 1, false, NoSshRetries}
+	tun, _, _ := createTunnel(c)
+	tun.DialTimeout = 300 * time.Millisecond
+	setDialDelay(tun.channels[0].Destination, 1*time.Second)
+	startTunnel(tun)
+
+	select {
+	case <-tun.Ready:
+	case <-time.After(1 * time.Second):
+		t.Errorf("error waiting for tunnel to be ready")
+		return
+	}
+
+	slow, err := net.Dial("tcp", tun.channels[0].listener.Addr().String())
+	if err != nil {
+		t.Errorf("error connecting to the tunnel: %v", err)
+		return
+	}
+	defer slow.Close()
+
+	// making sure the slow connection is being dialed before the next one
+	time.Sleep(50 * time.Millisecond)
+
+	err = validateTunnelConnectivity(t, "ABC", tun)
+	if err != nil {
+		t.Errorf("connection held back by a slow dial: %v", err)
+	}
+
+	elapsed, err := waitConnClosed(slow, 2*time.Second)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	if elapsed > 900*time.Millisecond {
+		t.Errorf("slow dial was not interrupted by the dial timeout: %s", elapsed)
+	}
+
+	if failed := tun.Stats()[0].Failed; failed != 1 {
+		t.Errorf("unexpected number of failed connections: want: 1, got: %d", failed)
+	}
+
+	tun.Stop()
+}
+
+func TestHalfClose(t *testing.T) {
+	// the destination only replies once the client is done sending its request
+	dst, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("error creating destination: %v", err)
+		return
+	}
+	defer dst.Close()
+
+	go func() {
+		for {
+			conn, err := dst.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(conn net.Conn) {
+				defer conn.Close()
+
+				req, _ := ioutil.ReadAll(conn)
+				fmt.Fprintf(conn, "received %d bytes", len(req))
+			}(conn)
+		}
+	}()
+
+	c := &tunnelConfig{t, "local", 1, false, NoSshRetries}
+	tun, _, _ := createTunnel(c)
+	tun.channels[0].Destination = dst.Addr().String()
+	startTunnel(tun)
+
+	select {
+	case <-tun.Ready:
+	case <-time.After(1 * time.Second):
+		t.Errorf("error waiting for tunnel to be ready")
+		return
+	}
+
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", tun.channels[0].listener.Addr().String())
+		if err != nil {
+			t.Errorf("error connecting to the tunnel: %v", err)
+			return
+		}
+
+		fmt.Fprintf(conn, "ABC")
+		err = conn.(*net.TCPConn).CloseWrite()
+		if err != nil {
+			t.Errorf("error closing the write side of the connection: %v", err)
+		}
+
+		conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+		resp, err := ioutil.ReadAll(conn)
+		conn.Close()
+
+		if err != nil {
+			t.Errorf("error reading the response after half-closing the connection: %v", err)
+			continue
+		}
+
+		if string(resp) != "received 3 bytes" {
+			t.Errorf("unexpected response after half-closing the connection: %q", resp)
+		}
+	}
+
+	err = waitActiveConnections(tun, 0)
+	if err != nil {
+		t.Errorf("connections were not fully closed: %v", err)
+	}
+
+	tun.Stop()
+}
+
+func TestBandwidthLimits(t *testing.T) {
+	const size = 20 * 1024
+
+	// the destination counts the bytes received and replies with as many bytes
+	dst, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("error creating destination: %v", err)
+		return
+	}
+	defer dst.Close()
+
+	go func() {
+		for {
+			conn, err := dst.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(conn net.Conn) {
+				defer conn.Close()
+
+				req, _ := ioutil.ReadAll(conn)
+				conn.Write(req)
+			}(conn)
+		}
+	}()
+
+	c := &tunnelConfig{t, "local", 1, false, NoSshRetries}
+	tun, _, _ := createTunnel(c)
+	tun.channels[0].Destination = dst.Addr().String()
+	startTunnel(tun)
+
+	select {
+	case <-tun.Ready:
+	case <-time.After(1 * time.Second):
+		t.Errorf("error waiting for tunnel to be ready")
+		return
+	}
+
+	transfer := func() (time.Duration, error) {
+		conn, err := net.Dial("tcp", tun.channels[0].listener.Addr().String())
+		if err != nil {
+			return 0, err
+		}
+		defer conn.Close()
+
+		start := time.Now()
+
+		_, err = conn.Write(make([]byte, size))
+		if err != nil {
+			return 0, err
+		}
+
+		err = conn.(*net.TCPConn).CloseWrite()
+		if err != nil {
+			return 0, err
+		}
+
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		resp, err := ioutil.ReadAll(conn)
+		if err != nil {
+			return 0, err
+		}
+
+		if len(resp) != size {
+			return 0, fmt.Errorf("unexpected response size: %d", len(resp))
+		}
+
+		return time.Since(start), nil
+	}
+
+	tests := []struct {
+		channel Bandwidth
+		tunnel  Bandwidth
+		slow    bool
+	}{
+		{Bandwidth{}, Bandwidth{}, false},
+		{Bandwidth{Upload: size}, Bandwidth{}, true},
+		{Bandwidth{}, Bandwidth{Download: size}, true},
+		{Bandwidth{Download: 100 * size}, Bandwidth{Upload: 100 * size}, false},
+	}
+
+	for id, test := range tests {
+		err = tun.SetChannelBandwidth(0, test.channel)
+		if err != nil {
+			t.Errorf("error setting channel bandwidth on test %d: %v", id, err)
+			continue
+		}
+		tun.SetBandwidth(test.tunnel)
+
+		elapsed, err := transfer()
+		if err != nil {
+			t.Errorf("error transferring data on test %d: %v", id, err)
+			continue
+		}
+
+		if test.slow && elapsed < 600*time.Millisecond {
+			t.Errorf("transfer not throttled on test %d: %s", id, elapsed)
+		}
+
+		if !test.slow && elapsed > 500*time.Millisecond {
+			t.Errorf("transfer throttled on test %d: %s", id, elapsed)
+		}
+	}
+
+	if err := tun.SetChannelBandwidth(1, Bandwidth{}); err == nil {
+		t.Errorf("expected error setting the bandwidth of a missing channel")
+	}
+
+	tun.Stop()
+}
+
+func TestChannelCapture(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mole-capture")
+	if err != nil {
+		t.Errorf("error creating capture directory: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	c := &tunnelConfig{t, "local", 1, false, NoSshRetries}
+	tun, _, _ := createTunnel(c)
+	tun.SetChannelOptions([]ChannelOptions{{Capture: dir}})
+	startTunnel(tun)
+
+	select {
+	case <-tun.Ready:
+	case <-time.After(1 * time.Second):
+		t.Errorf("error waiting for tunnel to be ready")
+		return
+	}
+
+	conn, err := net.Dial("tcp", tun.channels[0].listener.Addr().String())
+	if err != nil {
+		t.Errorf("error connecting to the tunnel: %v", err)
+		return
+	}
+
+	fmt.Fprintf(conn, "GET /ABC HTTP/1.1\r\nHost: mole\r\nConnection: close\r\n\r\n")
+	conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+	_, err = ioutil.ReadAll(conn)
+	conn.Close()
+
+	if err != nil {
+		t.Errorf("error reading the response: %v", err)
+		return
+	}
+
+	err = waitActiveConnections(tun, 0)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.pcap"))
+	if err != nil || len(files) != 1 {
+		t.Errorf("expected a single capture file, got %v: %v", files, err)
+		return
+	}
+
+	segments, err := readCapture(files[0])
+	if err != nil {
+		t.Errorf("error reading capture file: %v", err)
+		return
+	}
+
+	var request, response []byte
+	for _, s := range segments {
+		if s.src.Equal(segments[0].src) {
+			request = append(request, s.payload...)
+		} else {
+			response = append(response, s.payload...)
+		}
+	}
+
+	if !strings.HasPrefix(string(request), "GET /ABC") {
+		t.Errorf("request not captured: %q", request)
+	}
+
+	if !strings.HasSuffix(string(response), "ABC") {
+		t.Errorf("response not captured: %q", response)
+	}
+
+	tun.Stop()
+}
+
+func TestChannelTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mole-tls")
+	if err != nil {
+		t.Errorf("error creating certificate directory: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile, err := generateCertificate(dir)
+	if err != nil {
+		t.Errorf("error generating certificate: %v", err)
+		return
+	}
+
+	serverTLS, err := NewServerTLSConfig(certFile, keyFile)
+	if err != nil {
+		t.Errorf("error creating server tls configuration: %v", err)
+		return
+	}
+
+	clientTLS, err := NewClientTLSConfig("", certFile)
+	if err != nil {
+		t.Errorf("error creating client tls configuration: %v", err)
+		return
+	}
+
+	// the first channel terminates tls while the second one connects to a tls
+	// destination.
+	c := &tunnelConfig{t, "local", 2, false, NoSshRetries}
+	tun, _, _ := createTunnel(c)
+
+	dst, err := tls.Listen("tcp", "127.0.0.1:0", serverTLS)
+	if err != nil {
+		t.Errorf("error creating tls destination: %v", err)
+		return
+	}
+	defer dst.Close()
+
+	go http.Serve(dst, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "tls:%s", r.URL.Path[1:])
+	}))
+
+	tun.channels[1].Destination = dst.Addr().String()
+	tun.SetChannelOptions([]ChannelOptions{{SourceTLS: serverTLS}, {DestinationTLS: clientTLS}})
+	startTunnel(tun)
+
+	select {
+	case <-tun.Ready:
 	case <-time.After(1 * time.Second):
 		t.Errorf("error waiting for tunnel to be ready")
 		return
 	}
 
-	err := validateTunnelConnectivity(t, "ABC", tun)
-	if err != nil {
-		t.Errorf("%v", err)
+	get := func(url string, config *tls.Config) (string, error) {
+		client := http.Client{
+			Timeout:   1 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: config},
+		}
+
+		resp, err := client.Get(url)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+
+		return string(body), err
+	}
+
+	body, err := get(fmt.Sprintf("https://%s/ABC", tun.channels[0].listener.Addr()), clientTLS)
+	if err != nil || body != "ABC" {
+		t.Errorf("unexpected response from the tls source: %q: %v", body, err)
+	}
+
+	_, err = get(fmt.Sprintf("http://%s/ABC", tun.channels[0].listener.Addr()), nil)
+	if err == nil {
+		t.Errorf("expected error sending plaintext request to the tls source")
+	}
+
+	body, err = get(fmt.Sprintf("http://%s/DEF", tun.channels[1].listener.Addr()), nil)
+	if err != nil || body != "tls:DEF" {
+		t.Errorf("unexpected response from the tls destination: %q: %v", body, err)
+	}
+
+	tun.SetChannelOptions([]ChannelOptions{{SourceTLS: serverTLS}, {DestinationTLS: &tls.Config{ServerName: "example.com", RootCAs: clientTLS.RootCAs}}})
+
+	_, err = get(fmt.Sprintf("http://%s/DEF", tun.channels[1].listener.Addr()), nil)
+	if err == nil {
+		t.Errorf("expected error connecting to a tls destination with a mismatching server name")
 	}
 
 	tun.Stop()
 }
 
-func TestTunnelInsecure(t *testing.T) {
-	c := &tunnelConfig{t, "local", 1, true, NoSshRetries}
-	tun, _, _ := prepareTunnel(c)
+func TestProxyProtocol(t *testing.T) {
+	// the destination replies with the header received
+	dst, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("error creating destination: %v", err)
+		return
+	}
+	defer dst.Close()
+
+	go func() {
+		for {
+			conn, err := dst.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(conn net.Conn) {
+				defer conn.Close()
+
+				line, _ := bufio.NewReader(conn).ReadString('\n')
+				fmt.Fprint(conn, line)
+			}(conn)
+		}
+	}()
+
+	c := &tunnelConfig{t, "local", 1, false, NoSshRetries}
+	tun, _, _ := createTunnel(c)
+	tun.channels[0].Destination = dst.Addr().String()
+	tun.SetChannelOptions([]ChannelOptions{{ProxyProtocol: ProxyProtocolV1}})
+	startTunnel(tun)
 
 	select {
 	case <-tun.Ready:
-		t.Log("tunnel is ready to accept connections")
 	case <-time.After(1 * time.Second):
 		t.Errorf("error waiting for tunnel to be ready")
 		return
 	}
 
-	err := validateTunnelConnectivity(t, "ABC", tun)
+	conn, err := net.Dial("tcp", tun.channels[0].listener.Addr().String())
 	if err != nil {
-		t.Errorf("%v", err)
+		t.Errorf("error connecting to the tunnel: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	fmt.Fprint(conn, "data\n")
+	conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+
+	header, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Errorf("error reading proxy protocol header: %v", err)
+		return
+	}
+
+	client := conn.LocalAddr().(*net.TCPAddr)
+	listener := conn.RemoteAddr().(*net.TCPAddr)
+	expected := fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", client.IP, listener.IP, client.Port, listener.Port)
+
+	if header != expected {
+		t.Errorf("unexpected proxy protocol header: expected %q, got %q", expected, header)
 	}
 
 	tun.Stop()
 }
 
-func TestTunnelMultipleDestinations(t *testing.T) {
-	c := &tunnelConfig{t, "local", 2, false, NoSshRetries}
-	tun, _, _ := prepareTunnel(c)
+func TestUDPChannel(t *testing.T) {
+	// the destination echoes back every datagram received
+	dst, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("error creating destination: %v", err)
+		return
+	}
+	defer dst.Close()
+
+	go func() {
+		buf := make([]byte, maxDatagram)
+		for {
+			n, addr, err := dst.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			dst.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	relay, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("error creating udp relay: %v", err)
+		return
+	}
+	defer relay.Close()
+
+	go ServeUDPRelay(relay, time.Second)
+
+	c := &tunnelConfig{t, "local", 1, false, NoSshRetries}
+	tun, _, _ := createTunnel(c)
+
+	err = tun.AddUDPChannel("127.0.0.1:0", dst.LocalAddr().String(), relay.Addr().String(), time.Second)
+	if err != nil {
+		t.Errorf("error adding udp channel: %v", err)
+		return
+	}
+
+	startTunnel(tun)
+	defer tun.Stop()
 
 	select {
 	case <-tun.Ready:
-		t.Log("tunnel is ready to accept connections")
 	case <-time.After(1 * time.Second):
 		t.Errorf("error waiting for tunnel to be ready")
 		return
 	}
 
-	err := validateTunnelConnectivity(t, "ABC", tun)
+	conn, err := net.Dial("udp", tun.UDPChannels()[0].Source)
 	if err != nil {
-		t.Errorf("%v", err)
+		t.Errorf("error connecting to the udp channel: %v", err)
+		return
 	}
+	defer conn.Close()
 
-	tun.Stop()
+	for _, msg := range []string{"ping", "pong"} {
+		_, err = conn.Write([]byte(msg))
+		if err != nil {
+			t.Errorf("error sending datagram: %v", err)
+			return
+		}
+
+		buf := make([]byte, maxDatagram)
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Errorf("error receiving datagram: %v", err)
+			return
+		}
+
+		if string(buf[:n]) != msg {
+			t.Errorf("unexpected datagram: expected %s, got %s", msg, buf[:n])
+		}
+	}
+
+	stats := tun.Stats()
+	if len(stats) != 2 {
+		t.Errorf("unexpected number of channel stats: want: 2, got: %d", len(stats))
+		return
+	}
+
+	if st := stats[1]; st.Kind != UDPKind || st.Active != 1 || st.Accepted != 1 {
+		t.Errorf("unexpected udp channel stats: %+v", st)
+	}
 }
 
-func TestReconnectSSHServer(t *testing.T) {
-	c := &tunnelConfig{t, "local", 1, false, 3}
-	tun, ssh, _ := prepareTunnel(c)
+func TestUDPChannelRelayDown(t *testing.T) {
+	// the relay address is taken from a listener closed right away, so no one
+	// accepts connections on it.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("error reserving udp relay address: %v", err)
+		return
+	}
+	l.Close()
+
+	c := &tunnelConfig{t, "local", 1, false, NoSshRetries}
+	tun, _, _ := createTunnel(c)
+
+	err = tun.AddUDPChannel("127.0.0.1:0", "127.0.0.1:53", l.Addr().String(), time.Second)
+	if err != nil {
+		t.Errorf("error adding udp channel: %v", err)
+		return
+	}
+
+	startTunnel(tun)
+	defer tun.Stop()
 
 	select {
 	case <-tun.Ready:
-		t.Log("tunnel is ready to accept connections")
 	case <-time.After(1 * time.Second):
 		t.Errorf("error waiting for tunnel to be ready")
 		return
 	}
 
-	err := validateTunnelConnectivity(t, "ABC", tun)
+	ch := tun.UDPChannels()[0]
+
+	conn, err := net.Dial("udp", ch.Source)
 	if err != nil {
-		t.Errorf("%v", err)
+		t.Errorf("error connecting to the udp channel: %v", err)
 		return
 	}
+	defer conn.Close()
 
-	ssh.Close()
+	var first *udpSession
 
-	// http request should fail since ssh server is not running
-	err = validateTunnelConnectivity(t, "DEF", tun)
-	if err == nil {
-		t.Errorf("%v", err)
+	// the session that failed to reach the relay is kept, instead of a new one
+	// dialing the relay for every datagram.
+	for i := 0; i < 5; i++ {
+		_, err = conn.Write([]byte("ping"))
+		if err != nil {
+			t.Errorf("error sending datagram: %v", err)
+			return
+		}
+
+		time.Sleep(50 * time.Millisecond)
+
+		ch.mu.Lock()
+		s := ch.sessions[conn.LocalAddr().String()]
+		ch.mu.Unlock()
+
+		if s == nil {
+			t.Errorf("udp session is expected to be kept while the relay can't be reached")
+			return
+		}
+
+		if first == nil {
+			first = s
+		} else if s != first {
+			t.Errorf("udp session is not expected to be replaced while backing off")
+			return
+		}
+	}
+}
+
+func TestHTTPProxy(t *testing.T) {
+	c := &tunnelConfig{t, "local", 1, false, NoSshRetries}
+	tun, _, _ := createTunnel(c)
+	target := tun.channels[0].Destination
+
+	err := tun.AddHTTPProxy("127.0.0.1:0", []string{"127.0.0.1"})
+	if err != nil {
+		t.Errorf("error adding http proxy: %v", err)
 		return
 	}
 
-	_, err = createSSHServer(t, ssh.Addr().String(), keyPath)
+	startTunnel(tun)
+	defer tun.Stop()
+
+	select {
+	case <-tun.Ready:
+	case <-time.After(1 * time.Second):
+		t.Errorf("error waiting for tunnel to be ready")
+		return
+	}
+
+	proxy := tun.HTTPProxies()[0].Source
+
+	// plain http requests to absolute URIs
+	client := http.Client{
+		Timeout: 1 * time.Second,
+		Transport: &http.Transport{
+			Proxy: func(*http.Request) (*url.URL, error) {
+				return &url.URL{Scheme: "http", Host: proxy}, nil
+			},
+		},
+	}
+
+	resp, err := client.Get(fmt.Sprintf("http://%s/plain", target))
 	if err != nil {
-		t.Errorf("error while recreating ssh server: %s", err)
+		t.Errorf("error making http request through the proxy: %v", err)
+		return
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if string(body) != "plain" {
+		t.Errorf("unexpected response: expected plain, got %s", body)
+	}
+
+	// CONNECT requests
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Errorf("error connecting to the proxy: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(1 * time.Second))
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\nGET /tunneled HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", target, target, target)
+
+	r := bufio.NewReader(conn)
+	resp, err = http.ReadResponse(r, nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("unexpected response to CONNECT: %v, %v", resp, err)
+		return
+	}
+
+	resp, err = http.ReadResponse(r, nil)
+	if err != nil {
+		t.Errorf("error reading response through the proxy: %v", err)
+		return
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if string(body) != "tunneled" {
+		t.Errorf("unexpected response: expected tunneled, got %s", body)
+	}
+
+	// hosts not on the allow list
+	_, port, _ := net.SplitHostPort(target)
+	resp, err = client.Get(fmt.Sprintf("http://localhost:%s/denied", port))
+	if err != nil {
+		t.Errorf("error making http request through the proxy: %v", err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("unexpected status for a host not allowed: expected %d, got %d", http.StatusForbidden, resp.StatusCode)
+	}
+
+	stats := tun.Stats()
+	if len(stats) != 2 {
+		t.Errorf("unexpected number of channel stats: want: 2, got: %d", len(stats))
 		return
 	}
 
+	if st := stats[1]; st.Kind != HTTPProxyKind || st.Source != proxy || st.Denied != 1 {
+		t.Errorf("unexpected http proxy stats: %+v", st)
+	}
+}
+
+func TestLoadBalancing(t *testing.T) {
+	// each destination replies with its own name
+	destinations := map[string]net.Listener{}
+	for _, name := range []string{"a", "b"} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Errorf("error creating destination: %v", err)
+			return
+		}
+		defer l.Close()
+
+		go func(l net.Listener, name string) {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+
+				fmt.Fprint(conn, name)
+				conn.Close()
+			}
+		}(l, name)
+
+		destinations[name] = l
+	}
+
+	c := &tunnelConfig{t, "local", 1, false, NoSshRetries}
+	tun, _, _ := createTunnel(c)
+	tun.HealthCheckInterval = 100 * time.Millisecond
+	tun.channels[0].Destination = destinations["a"].Addr().String()
+	tun.SetChannelOptions([]ChannelOptions{{Backends: []string{destinations["b"].Addr().String()}, Balance: RoundRobin}})
+	startTunnel(tun)
+	defer tun.Stop()
+
 	select {
 	case <-tun.Ready:
-		t.Log("tunnel is ready to accept connections")
-	case <-time.After(10 * time.Second): // this is the maximum timeout based on the retries attempts
+	case <-time.After(1 * time.Second):
 		t.Errorf("error waiting for tunnel to be ready")
 		return
 	}
 
-	err = validateTunnelConnectivity(t, "GHJ", tun)
+	source := tun.channels[0].listener.Addr().String()
+	read := func() string {
+		conn, err := net.Dial("tcp", source)
+		if err != nil {
+			return err.Error()
+		}
+		defer conn.Close()
+
+		conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+		name, _ := ioutil.ReadAll(conn)
+
+		return string(name)
+	}
+
+	var got []string
+	for i := 0; i < 4; i++ {
+		got = append(got, read())
+	}
+
+	if expected := []string{"a", "b", "a", "b"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("unexpected destinations: expected %v, got %v", expected, got)
+	}
+
+	// the health check finds out the destination is gone
+	destinations["b"].Close()
+	time.Sleep(300 * time.Millisecond)
+
+	got = nil
+	for i := 0; i < 3; i++ {
+		got = append(got, read())
+	}
+
+	if expected := []string{"a", "a", "a"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("unexpected destinations after one of them failed: expected %v, got %v", expected, got)
+	}
+}
+
+// waitActiveConnections blocks until the tunnel serves the given number of
+// connections.
+func waitActiveConnections(tun *Tunnel, expected int) error {
+	for i := 0; i < 50; i++ {
+		active := 0
+		for _, st := range tun.Stats() {
+			active += st.Active
+		}
+
+		if active == expected {
+			return nil
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return fmt.Errorf("tunnel is not serving %d connections", expected)
+}
+
+// waitConnClosed blocks until the given connection is closed by the other side
+// and returns how long it took.
+func waitConnClosed(conn net.Conn, timeout time.Duration) (time.Duration, error) {
+	start := time.Now()
+	conn.SetReadDeadline(start.Add(timeout))
+
+	_, err := ioutil.ReadAll(conn)
 	if err != nil {
-		t.Errorf("%v", err)
+		return 0, fmt.Errorf("connection was not closed: %v", err)
 	}
 
-	tun.Stop()
+	return time.Since(start), nil
 }
 
 func validateTunnelConnectivity(t *testing.T, expected string, tun *Tunnel) error {
@@ -337,6 +1658,14 @@ func TestBuildSSHChannels(t *testing.T) {
 			expected:      1,
 			expectedError: nil,
 		},
+		{
+			serverName:    "hostWithMultipleLocalForwards",
+			source:        []string{},
+			destination:   []string{},
+			config:        "testdata/.ssh/config",
+			expected:      3,
+			expectedError: nil,
+		},
 		{
 			serverName:    "test",
 			source:        []string{":3360", ":8080"},
@@ -407,12 +1736,23 @@ type tunnelConfig struct {
 	ConnectionRetries int
 }
 
-// prepareTunnel creates a Tunnel object making sure all infrastructure
-// dependencies (ssh and http servers) are ready.
+// prepareTunnel creates and starts a Tunnel object making sure all
+// infrastructure dependencies (ssh and http servers) are ready.
 //
 // The 'remotes' argument tells how many remote endpoints will be available
 // through the tunnel.
 func prepareTunnel(config *tunnelConfig) (tun *Tunnel, ssh net.Listener, hss []*http.Server) {
+	tun, ssh, hss = createTunnel(config)
+	if tun != nil {
+		startTunnel(tun)
+	}
+
+	return tun, ssh, hss
+}
+
+// createTunnel creates a Tunnel object, without starting it, making sure all
+// infrastructure dependencies (ssh and http servers) are ready.
+func createTunnel(config *tunnelConfig) (tun *Tunnel, ssh net.Listener, hss []*http.Server) {
 	hss = make([]*http.Server, config.Destinations)
 
 	ssh, err := createSSHServer(config.T, "", keyPath)
@@ -457,6 +1797,11 @@ func prepareTunnel(config *tunnelConfig) (tun *Tunnel, ssh net.Listener, hss []*
 	tun.WaitAndRetry = 3 * time.Second
 	tun.KeepAliveInterval = 10 * time.Second
 
+	return tun, ssh, hss
+}
+
+// startTunnel starts the given tunnel on the background.
+func startTunnel(tun *Tunnel) {
 	go func(tun *Tunnel) {
 		err := tun.Start()
 		// FIXME: this message should be shown through *testing.t but using it here
@@ -466,8 +1811,6 @@ func prepareTunnel(config *tunnelConfig) (tun *Tunnel, ssh net.Listener, hss []*
 			fmt.Printf("error returned from tunnel start: %v", err)
 		}
 	}(tun)
-
-	return tun, ssh, hss
 }
 
 func prepareTestEnv() error {
@@ -482,6 +1825,10 @@ func prepareTestEnv() error {
 	configPath = filepath.Join(testDir, "config")
 	sshDir = testDir
 
+	// keep the tests away from the system-wide ssh config file of the host
+	// running them.
+	systemConfigPath = filepath.Join(testDir, "ssh_config")
+
 	fixtures := []map[string]string{
 		{
 			"from": filepath.Join(fixtureDir, "config"),
@@ -652,15 +1999,30 @@ func createSSHServer(t *testing.T, address string, keyPath string) (net.Listener
 						remoteIP := string(payload[pad : pad+l])
 						remotePort := binary.BigEndian.Uint32(payload[pad+l : pad+l+4])
 
-						conn, _, _ := newChan.Accept()
-						remoteConn, _ := net.Dial("tcp", fmt.Sprintf("%s:%d", remoteIP, remotePort))
+						remoteAddr := net.JoinHostPort(remoteIP, strconv.Itoa(int(remotePort)))
+						time.Sleep(nextDialDelay(remoteAddr))
+
+						remoteConn, err := net.Dial("tcp", remoteAddr)
+						if err != nil {
+							newChan.Reject(ssh.ConnectionFailed, err.Error())
+							return
+						}
+
+						conn, _, err := newChan.Accept()
+						if err != nil {
+							remoteConn.Close()
+							return
+						}
 
+						// half-closes are propagated in both directions, like OpenSSH does
 						go func() {
 							io.Copy(conn, remoteConn)
+							conn.CloseWrite()
 						}()
 
 						go func() {
 							io.Copy(remoteConn, conn)
+							remoteConn.(*net.TCPConn).CloseWrite()
 						}()
 					}(newChan)
 				}
@@ -671,6 +2033,30 @@ func createSSHServer(t *testing.T, address string, keyPath string) (net.Listener
 	return l, nil
 }
 
+var (
+	dialDelaysMu sync.Mutex
+	// dialDelays holds the time the test ssh server waits before connecting to
+	// each destination address, only once.
+	dialDelays = map[string]time.Duration{}
+)
+
+func setDialDelay(addr string, delay time.Duration) {
+	dialDelaysMu.Lock()
+	defer dialDelaysMu.Unlock()
+
+	dialDelays[addr] = delay
+}
+
+func nextDialDelay(addr string) time.Duration {
+	dialDelaysMu.Lock()
+	defer dialDelaysMu.Unlock()
+
+	delay := dialDelays[addr]
+	delete(dialDelays, addr)
+
+	return delay
+}
+
 // generateKnownHosts creates a new "known_hosts" file on a given path with a
 // single entry based on the given SSH server address and public key.
 func generateKnownHosts(sshAddr net.Addr, pubKeyPath, knownHostsPath string) error {
@@ -0,0 +1,527 @@
+package tunnel
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultUDPTimeout is the time a UDP session is kept open without any
+	// datagram going through it.
+	DefaultUDPTimeout = 1 * time.Minute
+
+	// maxDatagram is the maximum size of a datagram forwarded through a UDP
+	// channel.
+	maxDatagram = 65535
+
+	// udpQueueSize is the number of datagrams waiting to be sent to the relay,
+	// per session, before new ones are dropped.
+	udpQueueSize = 64
+
+	// udpRelayMinBackoff and udpRelayMaxBackoff bound the time a session waits
+	// before trying to connect to the relay again after failing to.
+	udpRelayMinBackoff = 1 * time.Second
+	udpRelayMaxBackoff = 30 * time.Second
+)
+
+// UDPChannel forwards the datagrams received on a local UDP socket to a
+// destination reachable from a UDP relay (see ServeUDPRelay), through the ssh
+// server.
+//
+// ssh only forwards TCP connections, so each peer sending datagrams to the
+// channel gets a session: a TCP connection to the relay, over the ssh
+// connection, carrying the datagrams exchanged with the destination, each
+// prefixed by its length. The relay address is given as seen by the ssh server.
+type UDPChannel struct {
+	Source      string
+	Destination string
+	Relay       string
+	// Timeout is the time a session is kept open without any datagram going
+	// through it.
+	Timeout time.Duration
+
+	conn     net.PacketConn
+	mu       sync.Mutex
+	sessions map[string]*udpSession
+	// accepted is the number of sessions started and failed the number of
+	// sessions closed before the relay could be reached.
+	accepted int
+	failed   int
+}
+
+// udpSession carries the datagrams exchanged by a peer of a UDP channel.
+type udpSession struct {
+	peer     net.Addr
+	queue    chan []byte
+	activity *activity
+}
+
+// AddUDPChannel adds a channel forwarding the datagrams received on the local
+// source address to the destination, through the UDP relay listening on the
+// given address, as seen by the ssh server. It must be called before the
+// tunnel starts and is only supported by local tunnels.
+func (t *Tunnel) AddUDPChannel(source, destination, relay string, timeout time.Duration) error {
+	if t.Type != "local" {
+		return fmt.Errorf("udp channels are only supported by local tunnels")
+	}
+
+	if source == "" || destination == "" || relay == "" {
+		return fmt.Errorf("invalid udp channel: source=%s, destination=%s, relay=%s", source, destination, relay)
+	}
+
+	if timeout <= 0 {
+		timeout = DefaultUDPTimeout
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.udpChannels = append(t.udpChannels, &UDPChannel{
+		Source:      expandAddress(source),
+		Destination: destination,
+		Relay:       relay,
+		Timeout:     timeout,
+		sessions:    make(map[string]*udpSession),
+	})
+
+	return nil
+}
+
+// UDPChannels returns the UDP channels of the tunnel.
+func (t *Tunnel) UDPChannels() []*UDPChannel {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return append([]*UDPChannel{}, t.udpChannels...)
+}
+
+// String returns a string representation of a UDPChannel.
+func (ch *UDPChannel) String() string {
+	return fmt.Sprintf("[source=udp://%s, destination=udp://%s, relay=%s]", ch.Source, ch.Destination, ch.Relay)
+}
+
+// stats returns the session counters of the channel.
+func (ch *UDPChannel) stats() ChannelStats {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	return ChannelStats{
+		Kind:        UDPKind,
+		Source:      ch.Source,
+		Destination: ch.Destination,
+		Active:      len(ch.sessions),
+		Accepted:    ch.accepted,
+		Failed:      ch.failed,
+	}
+}
+
+// startUDPChannels listens on the source address of every UDP channel and
+// serves their datagrams on the background. UDP channels listen locally, so
+// they keep listening across reconnections to the ssh server.
+func (t *Tunnel) startUDPChannels() error {
+	t.mu.Lock()
+	channels := t.udpChannels
+	t.mu.Unlock()
+
+	for _, ch := range channels {
+		conn, err := net.ListenPacket("udp", ch.Source)
+		if err != nil {
+			t.mu.Lock()
+			t.closeUDPChannels()
+			t.mu.Unlock()
+
+			return err
+		}
+
+		ch.mu.Lock()
+		ch.conn = conn
+		ch.Source = conn.LocalAddr().String()
+		ch.mu.Unlock()
+
+		log.WithFields(log.Fields{
+			"channel": ch,
+		}).Info("udp channel is waiting for datagrams")
+
+		go t.serveUDPChannel(ch)
+	}
+
+	return nil
+}
+
+// closeUDPChannels stops all UDP channels from receiving datagrams.
+//
+// The caller must hold t.mu.
+func (t *Tunnel) closeUDPChannels() {
+	for _, ch := range t.udpChannels {
+		ch.mu.Lock()
+		if ch.conn != nil {
+			ch.conn.Close()
+		}
+		ch.mu.Unlock()
+	}
+}
+
+// serveUDPChannel dispatches the datagrams received by a UDP channel to the
+// session of the peer that sent them, until the channel is closed.
+func (t *Tunnel) serveUDPChannel(ch *UDPChannel) {
+	buf := make([]byte, maxDatagram)
+
+	for {
+		n, peer, err := ch.conn.ReadFrom(buf)
+		if err != nil {
+			if !t.isStopped() {
+				log.WithFields(log.Fields{
+					"channel": ch,
+				}).WithError(err).Error("udp channel stopped receiving datagrams")
+			}
+
+			return
+		}
+
+		datagram := make([]byte, n)
+		copy(datagram, buf[:n])
+
+		ch.dispatch(t, peer, datagram)
+	}
+}
+
+// dispatch queues a datagram received from the given peer on its session,
+// creating the session if needed.
+func (ch *UDPChannel) dispatch(t *Tunnel, peer net.Addr, datagram []byte) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	s, ok := ch.sessions[peer.String()]
+	if !ok {
+		s = &udpSession{
+			peer:     peer,
+			queue:    make(chan []byte, udpQueueSize),
+			activity: newActivity(),
+		}
+		ch.sessions[peer.String()] = s
+		ch.accepted++
+
+		go t.runUDPSession(ch, s)
+	}
+
+	s.activity.touch()
+
+	// datagrams are dropped, like the network would do, when the destination
+	// can't keep up.
+	select {
+	case s.queue <- datagram:
+	default:
+		log.WithFields(log.Fields{
+			"channel": ch,
+			"peer":    peer,
+		}).Debug("udp session queue is full, dropping datagram")
+	}
+}
+
+// removeSession removes a session from the channel, so the next datagram of
+// its peer starts a new one, and logs the datagrams left on its queue. An idle
+// session is only removed if no datagram was received within the channel
+// timeout and none is waiting to be sent, telling whether it was removed.
+func (ch *UDPChannel) removeSession(s *udpSession, idle bool) bool {
+	ch.mu.Lock()
+	if idle && (len(s.queue) > 0 || s.activity.idle() < ch.Timeout) {
+		ch.mu.Unlock()
+		return false
+	}
+
+	delete(ch.sessions, s.peer.String())
+	ch.mu.Unlock()
+
+	// datagrams are only queued on sessions of the channel, so none can be
+	// added anymore.
+	if n := len(s.queue); n > 0 {
+		log.WithFields(log.Fields{
+			"channel": ch,
+			"peer":    s.peer,
+			"dropped": n,
+		}).Warn("udp session closed, dropping the datagrams waiting to be sent")
+	}
+
+	return true
+}
+
+// runUDPSession connects a session to the relay and exchanges datagrams with
+// it until the session expires or the connection to the relay is lost.
+func (t *Tunnel) runUDPSession(ch *UDPChannel, s *udpSession) {
+	fields := log.Fields{
+		"channel": ch,
+		"peer":    s.peer,
+	}
+
+	relay := t.connectRelay(ch, s, fields)
+	if relay == nil {
+		ch.mu.Lock()
+		ch.failed++
+		ch.mu.Unlock()
+
+		return
+	}
+	defer relay.Close()
+
+	log.WithFields(fields).Debug("udp session started")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		r := bufio.NewReader(relay)
+		for {
+			datagram, err := readFrame(r)
+			if err != nil {
+				return
+			}
+
+			s.activity.touch()
+
+			_, err = ch.conn.WriteTo(datagram, s.peer)
+			if err != nil {
+				log.WithFields(fields).WithError(err).Warn("could not send datagram to peer")
+			}
+		}
+	}()
+
+	timer := time.NewTimer(ch.Timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case datagram := <-s.queue:
+			err := writeFrame(relay, datagram)
+			if err != nil {
+				log.WithFields(fields).WithError(err).Warn("udp session closed")
+				ch.removeSession(s, false)
+				return
+			}
+		case <-timer.C:
+			idle := s.activity.idle()
+			if idle >= ch.Timeout && ch.removeSession(s, true) {
+				log.WithFields(fields).Debug("udp session expired")
+				return
+			}
+
+			if idle >= ch.Timeout {
+				// a datagram was received in the meantime.
+				idle = 0
+			}
+
+			timer.Reset(ch.Timeout - idle)
+		case <-done:
+			log.WithFields(fields).Debug("udp session closed by the relay")
+			ch.removeSession(s, false)
+			return
+		}
+	}
+}
+
+// connectRelay connects a session to the relay of its channel. Failed attempts
+// are retried after a back-off, which doubles on each failure, for as long as
+// the session keeps receiving datagrams, which are dropped in the meantime.
+// The session is removed, and nil returned, if it expires or the tunnel stops
+// before the relay can be reached.
+func (t *Tunnel) connectRelay(ch *UDPChannel, s *udpSession, fields log.Fields) net.Conn {
+	backoff := udpRelayMinBackoff
+
+	for {
+		relay, err := t.dialRelay(ch)
+		if err == nil {
+			return relay
+		}
+
+		log.WithFields(fields).WithError(err).WithField("retry", backoff).Error("could not connect to the udp relay, dropping datagrams until the next attempt")
+
+		timer := time.NewTimer(backoff)
+
+	wait:
+		for {
+			select {
+			case <-s.queue:
+				log.WithFields(fields).Debug("udp relay can't be reached, dropping datagram")
+			case <-timer.C:
+				break wait
+			}
+		}
+
+		if t.isStopped() {
+			ch.removeSession(s, false)
+			return nil
+		}
+
+		if ch.removeSession(s, true) {
+			log.WithFields(fields).Debug("udp session expired")
+			return nil
+		}
+
+		backoff *= 2
+		if backoff > udpRelayMaxBackoff {
+			backoff = udpRelayMaxBackoff
+		}
+	}
+}
+
+// dialRelay connects to the relay of a UDP channel, through the ssh server,
+// and asks it to relay datagrams to the channel destination.
+func (t *Tunnel) dialRelay(ch *UDPChannel) (net.Conn, error) {
+	client, err := t.connection()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := dialTimeout(func() (net.Conn, error) {
+		return client.Dial("tcp", ch.Relay)
+	}, t.destinationTimeout())
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeFrame(conn, []byte(ch.Destination))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// ServeUDPRelay accepts connections from UDP channels of other instances on
+// the given listener, relaying the datagrams carried by each of them to the
+// destination they ask for, until the listener is closed. Connections without
+// datagrams going through them for longer than timeout are closed.
+func ServeUDPRelay(l net.Listener, timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = DefaultUDPTimeout
+	}
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go relayUDP(conn, timeout)
+	}
+}
+
+// relayUDP relays the datagrams carried by a connection from a UDP channel.
+func relayUDP(conn net.Conn, timeout time.Duration) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	destination, err := readFrame(r)
+	if err != nil {
+		log.WithError(err).Warn("invalid udp relay request")
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	fields := log.Fields{
+		"client":      conn.RemoteAddr(),
+		"destination": string(destination),
+	}
+
+	udp, err := net.Dial("udp", string(destination))
+	if err != nil {
+		log.WithFields(fields).WithError(err).Warn("could not relay datagrams to destination")
+		return
+	}
+	defer udp.Close()
+
+	log.WithFields(fields).Debug("relaying datagrams")
+
+	act := newActivity()
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		if watchConn(ChannelOptions{IdleTimeout: timeout}, act, done) != "" {
+			conn.Close()
+		}
+	}()
+
+	go func() {
+		buf := make([]byte, maxDatagram)
+
+		for {
+			n, err := udp.Read(buf)
+			if err != nil {
+				// the destination not listening is reported by reads following
+				// the datagrams sent to it, which doesn't end the session.
+				if errors.Is(err, syscall.ECONNREFUSED) {
+					continue
+				}
+
+				return
+			}
+
+			act.touch()
+
+			if writeFrame(conn, buf[:n]) != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		datagram, err := readFrame(r)
+		if err != nil {
+			log.WithFields(fields).Debug("udp relay session closed")
+			return
+		}
+
+		act.touch()
+
+		_, err = udp.Write(datagram)
+		if err != nil && !errors.Is(err, syscall.ECONNREFUSED) {
+			log.WithFields(fields).WithError(err).Debug("could not send datagram to destination")
+		}
+	}
+}
+
+// writeFrame writes data prefixed by its length.
+func writeFrame(w io.Writer, data []byte) error {
+	if len(data) > maxDatagram {
+		return fmt.Errorf("datagram too large: %d bytes", len(data))
+	}
+
+	frame := make([]byte, 2+len(data))
+	binary.BigEndian.PutUint16(frame, uint16(len(data)))
+	copy(frame[2:], data)
+
+	_, err := w.Write(frame)
+
+	return err
+}
+
+// readFrame reads data prefixed by its length.
+func readFrame(r io.Reader) ([]byte, error) {
+	var size [2]byte
+
+	_, err := io.ReadFull(r, size[:])
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, binary.BigEndian.Uint16(size[:]))
+
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
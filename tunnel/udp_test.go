@@ -0,0 +1,40 @@
+package tunnel
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFrame(t *testing.T) {
+	tests := [][]byte{
+		{},
+		[]byte("datagram"),
+		bytes.Repeat([]byte{0xff}, maxDatagram),
+	}
+
+	var buf bytes.Buffer
+
+	for _, test := range tests {
+		err := writeFrame(&buf, test)
+		if err != nil {
+			t.Errorf("error writing frame of %d bytes: %v", len(test), err)
+		}
+	}
+
+	for _, test := range tests {
+		data, err := readFrame(&buf)
+		if err != nil {
+			t.Errorf("error reading frame of %d bytes: %v", len(test), err)
+			continue
+		}
+
+		if !bytes.Equal(data, test) {
+			t.Errorf("unexpected frame: expected %d bytes, got %d", len(test), len(data))
+		}
+	}
+
+	err := writeFrame(&buf, make([]byte, maxDatagram+1))
+	if err == nil {
+		t.Errorf("expected error writing a frame larger than %d bytes", maxDatagram)
+	}
+}